@@ -0,0 +1,411 @@
+// Package anim reads and writes LED animations in a compact native format:
+// a fixed header, one independently compressed chunk per frame, and an
+// index of chunk offsets so any frame can be read directly.
+//
+// All integers are little endian.  The 32 byte header is:
+//
+//	0   magic "LEDA"
+//	4   uint16 format version (1)
+//	6   uint8  channels per pixel (3)
+//	7   uint8  channel layout: 0 = RGB, 1 = GRB, 2 = BGR
+//	8   uint8  codec: 0 = none, 1 = snappy
+//	9   3 bytes reserved
+//	12  uint32 pixels per frame
+//	16  uint32 frame count
+//	20  float32 frames per second, or 0 if unspecified
+//	24  uint64 offset of the index
+//
+// The index is frame count + 1 uint64 offsets, where frame n is stored
+// between offsets n and n+1.
+package anim
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math"
+	"runtime"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	// Magic identifies an animation file.
+	Magic = "LEDA"
+
+	// Ext is the file extension for animations.
+	Ext = ".leda"
+
+	// MaxPixels is the most pixels a frame may have, which bounds how
+	// much memory decoding one takes.
+	MaxPixels = 1 << 20
+
+	version    = 1
+	headerSize = 32
+)
+
+// Channel layouts.
+const (
+	LayoutRGB = iota
+	LayoutGRB
+	LayoutBGR
+)
+
+// Codecs for frame chunks.
+const (
+	CodecNone = iota
+	CodecSnappy
+)
+
+var (
+	ErrNotAnim       = errors.New("not an animation file")
+	ErrVersion       = errors.New("unsupported animation version")
+	ErrLayout        = errors.New("unsupported channel layout")
+	ErrCodec         = errors.New("unsupported codec")
+	ErrCorrupt       = errors.New("corrupt animation file")
+	ErrFrameSize     = errors.New("frame is the wrong size")
+	ErrFrameRange    = errors.New("frame out of range")
+	ErrWriterClosed  = errors.New("writer is closed")
+	ErrInvalidHeader = errors.New("pixels must be > 0")
+	ErrTooManyPixels = errors.New("too many pixels per frame")
+)
+
+// Header describes an animation.
+type Header struct {
+	Pixels int
+	Frames int
+	FPS    float64
+	Layout int
+	Codec  int
+}
+
+func (h *Header) channels() int {
+	return 3
+}
+
+func (h *Header) frameSize() int {
+	return h.Pixels * h.channels()
+}
+
+func (h *Header) validate() error {
+	switch {
+	case h.Pixels <= 0 || h.Frames < 0 || h.FPS < 0:
+		return ErrInvalidHeader
+	case h.Pixels > MaxPixels:
+		return fmt.Errorf("%d, max %d: %w", h.Pixels, MaxPixels, ErrTooManyPixels)
+	case h.Layout < LayoutRGB || h.Layout > LayoutBGR:
+		return fmt.Errorf("%d: %w", h.Layout, ErrLayout)
+	case h.Codec < CodecNone || h.Codec > CodecSnappy:
+		return fmt.Errorf("%d: %w", h.Codec, ErrCodec)
+	}
+
+	return nil
+}
+
+func (h *Header) marshal(indexOffset uint64) []byte {
+	b := make([]byte, headerSize)
+	copy(b, Magic)
+	binary.LittleEndian.PutUint16(b[4:], version)
+	b[6] = byte(h.channels())
+	b[7] = byte(h.Layout)
+	b[8] = byte(h.Codec)
+	binary.LittleEndian.PutUint32(b[12:], uint32(h.Pixels))
+	binary.LittleEndian.PutUint32(b[16:], uint32(h.Frames))
+	binary.LittleEndian.PutUint32(b[20:], math.Float32bits(float32(h.FPS)))
+	binary.LittleEndian.PutUint64(b[24:], indexOffset)
+
+	return b
+}
+
+func unmarshalHeader(b []byte) (Header, uint64, error) {
+	if len(b) < headerSize || string(b[:4]) != Magic {
+		return Header{}, 0, ErrNotAnim
+	}
+	if v := binary.LittleEndian.Uint16(b[4:]); v != version {
+		return Header{}, 0, fmt.Errorf("%d: %w", v, ErrVersion)
+	}
+	if b[6] != 3 {
+		return Header{}, 0, fmt.Errorf("%d channels: %w", b[6], ErrLayout)
+	}
+
+	h := Header{
+		Layout: int(b[7]),
+		Codec:  int(b[8]),
+		Pixels: int(binary.LittleEndian.Uint32(b[12:])),
+		Frames: int(binary.LittleEndian.Uint32(b[16:])),
+		FPS:    float64(math.Float32frombits(binary.LittleEndian.Uint32(b[20:]))),
+	}
+
+	return h, binary.LittleEndian.Uint64(b[24:]), h.validate()
+}
+
+// Writer writes an animation one frame at a time.
+type Writer struct {
+	w       io.WriteSeeker
+	header  Header
+	offsets []uint64
+	offset  uint64
+	buf     []byte
+	closed  bool
+}
+
+// NewWriter starts writing an animation to w.  h.Frames is ignored; it's
+// set from the number of frames written.
+func NewWriter(w io.WriteSeeker, h Header) (*Writer, error) {
+	h.Frames = 0
+	if err := h.validate(); err != nil {
+		return nil, err
+	}
+
+	// Write a placeholder header to fill in on Close.
+	if _, err := w.Write(h.marshal(0)); err != nil {
+		return nil, err
+	}
+
+	return &Writer{w: w, header: h, offsets: []uint64{headerSize}, offset: headerSize}, nil
+}
+
+// WriteFrame appends a frame of Pixels RGB pixels, converting it to the
+// header's channel layout.
+func (w *Writer) WriteFrame(f []byte) error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	if len(f) != w.header.frameSize() {
+		return fmt.Errorf("%d bytes, want %d: %w", len(f), w.header.frameSize(), ErrFrameSize)
+	}
+
+	if w.header.Layout != LayoutRGB {
+		w.buf = append(w.buf[:0], f...)
+		swap(w.buf, w.header.Layout)
+		f = w.buf
+	}
+
+	chunk := f
+	if w.header.Codec == CodecSnappy {
+		chunk = snappy.Encode(nil, f)
+	}
+
+	if _, err := w.w.Write(chunk); err != nil {
+		return err
+	}
+	w.offset += uint64(len(chunk))
+	w.offsets = append(w.offsets, w.offset)
+	w.header.Frames++
+
+	return nil
+}
+
+// Close writes the index and final header.  It doesn't close the
+// underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	w.closed = true
+
+	index := make([]byte, 8*len(w.offsets))
+	for i, o := range w.offsets {
+		binary.LittleEndian.PutUint64(index[i*8:], o)
+	}
+	if _, err := w.w.Write(index); err != nil {
+		return err
+	}
+
+	if _, err := w.w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := w.w.Write(w.header.marshal(w.offset))
+
+	return err
+}
+
+// File is an animation in memory or mapped from disk.  It's also an
+// image.Image, with one row per frame, so it can be played like any other
+// pattern image.
+type File struct {
+	Header
+
+	data    []byte
+	offsets []uint64
+	unmap   func() error
+
+	mu     sync.Mutex
+	cached int
+	frame  []byte
+}
+
+// Open maps an animation file into memory.
+func Open(path string) (*File, error) {
+	data, unmap, err := mmap(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := parse(data)
+	if err != nil {
+		_ = unmap()
+		return nil, err
+	}
+
+	// Frames handed out by Frame() never point into data, so it's safe
+	// to unmap once nothing references the File.
+	f.unmap = unmap
+	runtime.SetFinalizer(f, (*File).Close)
+
+	return f, nil
+}
+
+// Decode reads an animation into memory.
+func Decode(r io.Reader) (image.Image, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return parse(data)
+}
+
+// DecodeConfig reads just an animation's header.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	b := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return image.Config{}, err
+	}
+
+	h, _, err := unmarshalHeader(b)
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	return image.Config{ColorModel: color.RGBAModel, Width: h.Pixels, Height: h.Frames}, nil
+}
+
+func init() {
+	image.RegisterFormat("leda", Magic, Decode, DecodeConfig)
+}
+
+func parse(data []byte) (*File, error) {
+	h, indexOffset, err := unmarshalHeader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	end := indexOffset + 8*uint64(h.Frames+1)
+	if indexOffset < headerSize || end > uint64(len(data)) || end < indexOffset {
+		return nil, ErrCorrupt
+	}
+
+	offsets := make([]uint64, h.Frames+1)
+	for i := range offsets {
+		offsets[i] = binary.LittleEndian.Uint64(data[indexOffset+uint64(i)*8:])
+		if offsets[i] > indexOffset || (i > 0 && offsets[i] < offsets[i-1]) {
+			return nil, ErrCorrupt
+		}
+	}
+
+	return &File{Header: h, data: data, offsets: offsets, cached: -1}, nil
+}
+
+// Frame decodes frame n into dst, reusing its storage if possible, and
+// returns it as RGB.
+func (f *File) Frame(dst []byte, n int) ([]byte, error) {
+	if n < 0 || n >= f.Frames {
+		return nil, fmt.Errorf("%d: %w", n, ErrFrameRange)
+	}
+
+	// Check the chunk is the right size before allocating for it.
+	size := f.frameSize()
+	chunk := f.data[f.offsets[n]:f.offsets[n+1]]
+	switch f.Codec {
+	case CodecSnappy:
+		if l, err := snappy.DecodedLen(chunk); err != nil || l != size {
+			return nil, fmt.Errorf("frame %d: %w", n, ErrCorrupt)
+		}
+	default:
+		if len(chunk) != size {
+			return nil, fmt.Errorf("frame %d: %w", n, ErrCorrupt)
+		}
+	}
+
+	if cap(dst) < size {
+		dst = make([]byte, size)
+	}
+	dst = dst[:size]
+
+	if f.Codec == CodecSnappy {
+		if _, err := snappy.Decode(dst, chunk); err != nil {
+			return nil, fmt.Errorf("frame %d: %w", n, err)
+		}
+	} else {
+		copy(dst, chunk)
+	}
+
+	if f.Layout != LayoutRGB {
+		swap(dst, f.Layout)
+	}
+
+	return dst, nil
+}
+
+// Close unmaps the file, if it was opened with Open.  The File must not be
+// used afterwards.
+func (f *File) Close() error {
+	runtime.SetFinalizer(f, nil)
+	if f.unmap == nil {
+		return nil
+	}
+
+	err := f.unmap()
+	f.unmap = nil
+	f.data = nil
+
+	return err
+}
+
+func (f *File) ColorModel() color.Model {
+	return color.RGBAModel
+}
+
+func (f *File) Bounds() image.Rectangle {
+	return image.Rect(0, 0, f.Pixels, f.Frames)
+}
+
+// At returns pixel x of frame y.  It's slow; use Frame for whole frames.
+func (f *File) At(x, y int) color.Color {
+	if x < 0 || x >= f.Pixels || y < 0 || y >= f.Frames {
+		return color.RGBA{}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.cached != y {
+		frame, err := f.Frame(f.frame, y)
+		if err != nil {
+			return color.RGBA{}
+		}
+		f.frame, f.cached = frame, y
+	}
+
+	p := f.frame[x*3:]
+	return color.RGBA{R: p[0], G: p[1], B: p[2], A: 0xff}
+}
+
+// swap converts between RGB and another layout in place.  Each layout's
+// conversion is its own inverse.
+func swap(f []byte, layout int) {
+	for i := 0; i+2 < len(f); i += 3 {
+		switch layout {
+		case LayoutGRB:
+			f[i], f[i+1] = f[i+1], f[i]
+		case LayoutBGR:
+			f[i], f[i+2] = f[i+2], f[i]
+		}
+	}
+}
@@ -0,0 +1,548 @@
+package anim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"math"
+	"time"
+
+	"golang.org/x/image/webp"
+)
+
+var (
+	ErrNotAnimated = errors.New("not an animated image")
+	ErrTooLarge    = errors.New("animation too large")
+)
+
+const (
+	// Largest canvas we'll composite frames onto.
+	maxCanvas = 4096
+
+	// Most memory a decoded Strip may use.
+	maxStripBytes = 256 << 20
+)
+
+// How a frame is cleared before the next one is drawn.
+const (
+	disposeNone = iota
+	disposeBackground
+	disposePrevious
+)
+
+// A Sampler appends a row of RGB pixels sampled from a frame of an
+// animation, composited onto its full canvas, to dst.
+type Sampler func(dst []byte, frame *image.RGBA) []byte
+
+// Flatten is a Sampler that takes every pixel of a frame, row by row, so
+// an animation of strips plays one strip per frame.
+func Flatten(dst []byte, frame *image.RGBA) []byte {
+	b := frame.Rect
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		pix := frame.Pix[frame.PixOffset(b.Min.X, y):]
+		for i := 0; i < b.Dx()*4; i += 4 {
+			dst = append(dst, pix[i], pix[i+1], pix[i+2])
+		}
+	}
+
+	return dst
+}
+
+// PathSampler returns a Sampler that takes the pixel at each of points, in
+// order, treating the animation as a texture.  Points outside the frame are
+// black.
+func PathSampler(points []image.Point) Sampler {
+	return func(dst []byte, frame *image.RGBA) []byte {
+		for _, p := range points {
+			if !p.In(frame.Rect) {
+				dst = append(dst, 0, 0, 0)
+				continue
+			}
+			i := frame.PixOffset(p.X, p.Y)
+			dst = append(dst, frame.Pix[i], frame.Pix[i+1], frame.Pix[i+2])
+		}
+
+		return dst
+	}
+}
+
+// Strip is an animation decoded into memory and sampled to one row of
+// pixels per frame.  Like File, it's an image.Image with one row per frame.
+type Strip struct {
+	Pixels int
+
+	rows   []byte
+	delays []time.Duration
+}
+
+// Frame copies frame n into dst, reusing its storage if possible.
+func (s *Strip) Frame(dst []byte, n int) ([]byte, error) {
+	if n < 0 || n >= len(s.delays) {
+		return nil, fmt.Errorf("%d: %w", n, ErrFrameRange)
+	}
+
+	size := s.Pixels * 3
+	if cap(dst) < size {
+		dst = make([]byte, size)
+	}
+	dst = dst[:size]
+	copy(dst, s.rows[n*size:])
+
+	return dst, nil
+}
+
+// RowDelay returns how long frame y should be shown.
+func (s *Strip) RowDelay(y int) time.Duration {
+	if y < 0 || y >= len(s.delays) {
+		return 0
+	}
+	return s.delays[y]
+}
+
+func (s *Strip) ColorModel() color.Model {
+	return color.RGBAModel
+}
+
+func (s *Strip) Bounds() image.Rectangle {
+	return image.Rect(0, 0, s.Pixels, len(s.delays))
+}
+
+func (s *Strip) At(x, y int) color.Color {
+	if x < 0 || x >= s.Pixels || y < 0 || y >= len(s.delays) {
+		return color.RGBA{}
+	}
+
+	p := s.rows[(y*s.Pixels+x)*3:]
+	return color.RGBA{R: p[0], G: p[1], B: p[2], A: 0xff}
+}
+
+// RowDelay returns how long each frame should be shown, or 0 if the file
+// doesn't say.
+func (f *File) RowDelay(y int) time.Duration {
+	if f.FPS <= 0 {
+		return 0
+	}
+	return time.Duration(math.Round(float64(time.Second) / f.FPS))
+}
+
+// DecodeAnimation decodes an animated GIF, PNG (APNG), or WebP, sampling
+// each frame with sample.  It returns ErrNotAnimated for anything else,
+// including GIFs with only one frame.
+func DecodeAnimation(data []byte, sample Sampler) (*Strip, error) {
+	a := &animator{sample: sample, strip: &Strip{}}
+
+	var err error
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		err = decodeGIF(data, a)
+	case bytes.HasPrefix(data, pngHeader):
+		err = decodeAPNG(data, a)
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		err = decodeWebP(data, a)
+	default:
+		err = ErrNotAnimated
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(a.strip.delays) == 0 {
+		return nil, ErrNotAnimated
+	}
+
+	return a.strip, nil
+}
+
+// frame is one decoded frame of an animation, to be drawn at an offset on
+// the canvas.
+type frame struct {
+	img     image.Image
+	at      image.Point
+	delay   time.Duration
+	over    bool
+	dispose int
+}
+
+// animator composites frames onto a canvas and samples the results into a
+// Strip.
+type animator struct {
+	sample        Sampler
+	canvas, saved *image.RGBA
+	strip         *Strip
+}
+
+func (a *animator) begin(width, height int) error {
+	if width <= 0 || height <= 0 || width > maxCanvas || height > maxCanvas {
+		return fmt.Errorf("canvas %dx%d: %w", width, height, ErrTooLarge)
+	}
+
+	a.canvas = image.NewRGBA(image.Rect(0, 0, width, height))
+
+	return nil
+}
+
+func (a *animator) add(f *frame) error {
+	if a.canvas == nil {
+		return ErrCorrupt
+	}
+
+	size := f.img.Bounds().Size()
+	r := image.Rectangle{f.at, f.at.Add(size)}.Intersect(a.canvas.Rect)
+	sp := f.img.Bounds().Min.Add(r.Min.Sub(f.at))
+
+	if f.dispose == disposePrevious {
+		if a.saved == nil {
+			a.saved = image.NewRGBA(a.canvas.Rect)
+		}
+		copy(a.saved.Pix, a.canvas.Pix)
+	}
+
+	op := draw.Src
+	if f.over {
+		op = draw.Over
+	}
+	draw.Draw(a.canvas, r, f.img, sp, op)
+
+	s := a.strip
+	n := len(s.rows)
+	s.rows = a.sample(s.rows, a.canvas)
+	switch {
+	case len(s.delays) == 0:
+		s.Pixels = (len(s.rows) - n) / 3
+		if s.Pixels == 0 {
+			return ErrNotAnimated
+		}
+	case len(s.rows)-n != s.Pixels*3:
+		return ErrCorrupt
+	}
+	if len(s.rows) > maxStripBytes {
+		return fmt.Errorf("%d frames of %d pixels: %w", len(s.delays)+1, s.Pixels, ErrTooLarge)
+	}
+
+	// Browsers show frames with tiny or missing delays for 100ms, and
+	// content is authored to match.
+	delay := f.delay
+	if delay <= 10*time.Millisecond {
+		delay = 100 * time.Millisecond
+	}
+	s.delays = append(s.delays, delay)
+
+	switch f.dispose {
+	case disposeBackground:
+		draw.Draw(a.canvas, r, image.Transparent, image.Point{}, draw.Src)
+	case disposePrevious:
+		copy(a.canvas.Pix, a.saved.Pix)
+	}
+
+	return nil
+}
+
+func decodeGIF(data []byte, a *animator) error {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if len(g.Image) < 2 {
+		return ErrNotAnimated
+	}
+
+	if err := a.begin(g.Config.Width, g.Config.Height); err != nil {
+		return err
+	}
+
+	for i, img := range g.Image {
+		f := &frame{img: img, at: img.Bounds().Min, over: true}
+		if i < len(g.Delay) {
+			f.delay = time.Duration(g.Delay[i]) * 10 * time.Millisecond
+		}
+		if i < len(g.Disposal) {
+			switch g.Disposal[i] {
+			case gif.DisposalBackground:
+				f.dispose = disposeBackground
+			case gif.DisposalPrevious:
+				f.dispose = disposePrevious
+			}
+		}
+		if err := a.add(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n")
+
+// decodeAPNG splits an APNG into a standalone PNG per frame, so image/png
+// can decode each one.
+func decodeAPNG(data []byte, a *animator) error {
+	var ihdr []byte
+	var shared [][]byte // Chunks like PLTE that every frame needs.
+	var cur *frame
+	var curSize image.Point
+	var curData [][]byte
+	animated, seenData := false, false
+
+	flush := func() error {
+		if cur == nil {
+			return nil
+		}
+		if len(curData) == 0 {
+			return ErrCorrupt
+		}
+
+		hdr := append([]byte(nil), ihdr...)
+		binary.BigEndian.PutUint32(hdr[0:], uint32(curSize.X))
+		binary.BigEndian.PutUint32(hdr[4:], uint32(curSize.Y))
+
+		buf := &bytes.Buffer{}
+		buf.Write(pngHeader)
+		writePNGChunk(buf, "IHDR", hdr)
+		for _, c := range shared {
+			buf.Write(c)
+		}
+		writePNGChunk(buf, "IDAT", bytes.Join(curData, nil))
+		writePNGChunk(buf, "IEND", nil)
+
+		img, err := png.Decode(buf)
+		if err != nil {
+			return err
+		}
+		cur.img = img
+		err = a.add(cur)
+		cur, curData = nil, nil
+
+		return err
+	}
+
+	for off := len(pngHeader); off+12 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[off:]))
+		typ := string(data[off+4 : off+8])
+		if n < 0 || off+12+n > len(data) {
+			return ErrCorrupt
+		}
+		chunk := data[off : off+12+n]
+		body := chunk[8 : 8+n]
+		off += 12 + n
+
+		switch typ {
+		case "IHDR":
+			if n != 13 {
+				return ErrCorrupt
+			}
+			ihdr = body
+		case "acTL":
+			if ihdr == nil {
+				return ErrCorrupt
+			}
+			if n != 8 || binary.BigEndian.Uint32(body) < 2 {
+				return ErrNotAnimated
+			}
+			animated = true
+			w, h := binary.BigEndian.Uint32(ihdr[0:]), binary.BigEndian.Uint32(ihdr[4:])
+			if err := a.begin(int(w), int(h)); err != nil {
+				return err
+			}
+		case "fcTL":
+			if err := flush(); err != nil {
+				return err
+			}
+			if n != 26 {
+				return ErrCorrupt
+			}
+			w, h := int(binary.BigEndian.Uint32(body[4:])), int(binary.BigEndian.Uint32(body[8:]))
+			x, y := int(binary.BigEndian.Uint32(body[12:])), int(binary.BigEndian.Uint32(body[16:]))
+			if w <= 0 || h <= 0 || w > maxCanvas || h > maxCanvas || x < 0 || y < 0 {
+				return ErrCorrupt
+			}
+			num, den := binary.BigEndian.Uint16(body[20:]), binary.BigEndian.Uint16(body[22:])
+			if den == 0 {
+				den = 100
+			}
+			curSize = image.Pt(w, h)
+			cur = &frame{
+				at:    image.Pt(x, y),
+				delay: time.Duration(num) * time.Second / time.Duration(den),
+				over:  body[25] == 1,
+			}
+			switch body[24] {
+			case 1:
+				cur.dispose = disposeBackground
+			case 2:
+				// There's nothing before the first frame to go back to.
+				cur.dispose = disposePrevious
+				if len(a.strip.delays) == 0 {
+					cur.dispose = disposeBackground
+				}
+			}
+		case "IDAT":
+			if !animated {
+				return ErrNotAnimated
+			}
+			// IDAT is the first frame only if an fcTL came before it.
+			seenData = true
+			if cur != nil {
+				curData = append(curData, body)
+			}
+		case "fdAT":
+			if cur == nil || n < 4 {
+				return ErrCorrupt
+			}
+			seenData = true
+			curData = append(curData, body[4:])
+		case "IEND":
+			return flush()
+		default:
+			if ihdr != nil && !seenData {
+				shared = append(shared, chunk)
+			}
+		}
+	}
+
+	if !animated {
+		return ErrNotAnimated
+	}
+
+	return flush()
+}
+
+func writePNGChunk(buf *bytes.Buffer, typ string, data []byte) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(len(data)))
+	buf.Write(b[:])
+
+	crc := crc32.NewIEEE()
+	_, _ = crc.Write([]byte(typ))
+	_, _ = crc.Write(data)
+
+	buf.WriteString(typ)
+	buf.Write(data)
+	binary.BigEndian.PutUint32(b[:], crc.Sum32())
+	buf.Write(b[:])
+}
+
+// riffChunks calls fn for each chunk in data.
+func riffChunks(data []byte, fn func(typ string, body []byte) error) error {
+	for off := 0; off+8 <= len(data); {
+		typ := string(data[off : off+4])
+		n := int(binary.LittleEndian.Uint32(data[off+4:]))
+		if n < 0 || off+8+n > len(data) {
+			return ErrCorrupt
+		}
+		if err := fn(typ, data[off+8:off+8+n]); err != nil {
+			return err
+		}
+		off += 8 + n + n&1
+	}
+
+	return nil
+}
+
+func uint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+func writeRIFFChunk(buf *bytes.Buffer, typ string, data []byte) {
+	var b [4]byte
+	buf.WriteString(typ)
+	binary.LittleEndian.PutUint32(b[:], uint32(len(data)))
+	buf.Write(b[:])
+	buf.Write(data)
+	if len(data)&1 == 1 {
+		buf.WriteByte(0)
+	}
+}
+
+// decodeWebP splits an animated WebP into a standalone WebP per frame, so
+// x/image/webp can decode each one.
+func decodeWebP(data []byte, a *animator) error {
+	animated := false
+
+	return riffChunks(data[12:], func(typ string, body []byte) error {
+		switch typ {
+		case "VP8X":
+			if len(body) < 10 || body[0]&0x02 == 0 {
+				return ErrNotAnimated
+			}
+			animated = true
+			return a.begin(uint24(body[4:])+1, uint24(body[7:])+1)
+		case "ANMF":
+			if !animated {
+				return ErrNotAnimated
+			}
+			if len(body) < 16 {
+				return ErrCorrupt
+			}
+
+			f := &frame{
+				at:    image.Pt(uint24(body[0:])*2, uint24(body[3:])*2),
+				delay: time.Duration(uint24(body[12:])) * time.Millisecond,
+				over:  body[15]&0x02 == 0,
+			}
+			if body[15]&0x01 != 0 {
+				f.dispose = disposeBackground
+			}
+			w, h := uint24(body[6:])+1, uint24(body[9:])+1
+
+			img, err := decodeWebPFrame(body[16:], w, h)
+			if err != nil {
+				return err
+			}
+			f.img = img
+
+			return a.add(f)
+		case "VP8 ", "VP8L":
+			return ErrNotAnimated
+		}
+
+		return nil
+	})
+}
+
+// decodeWebPFrame decodes the image data of an ANMF chunk.
+func decodeWebPFrame(data []byte, width, height int) (image.Image, error) {
+	var alph, bitstream []byte
+	var bitstreamType string
+	err := riffChunks(data, func(typ string, body []byte) error {
+		switch typ {
+		case "ALPH":
+			alph = body
+		case "VP8 ", "VP8L":
+			bitstream, bitstreamType = body, typ
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if bitstream == nil {
+		return nil, ErrCorrupt
+	}
+
+	payload := &bytes.Buffer{}
+	payload.WriteString("WEBP")
+	if alph != nil && bitstreamType == "VP8 " {
+		vp8x := make([]byte, 10)
+		vp8x[0] = 0x10 // Alpha
+		putUint24(vp8x[4:], width-1)
+		putUint24(vp8x[7:], height-1)
+		writeRIFFChunk(payload, "VP8X", vp8x)
+		writeRIFFChunk(payload, "ALPH", alph)
+	}
+	writeRIFFChunk(payload, bitstreamType, bitstream)
+
+	buf := &bytes.Buffer{}
+	writeRIFFChunk(buf, "RIFF", payload.Bytes())
+
+	return webp.Decode(buf)
+}
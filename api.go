@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Largest JSON request body accepted by the HTTP API.
+const maxAPIBody = 1 << 20
+
+// writeJSON marshals v as the response body.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+// readJSON unmarshals a request body into v, rejecting unknown fields.
+func readJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxAPIBody))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// authorized checks for the configured api_token as a bearer token or
+// basic auth password, and writes an error response if it's missing.
+// Without an api_token, authenticated endpoints are disabled.
+func authorized(w http.ResponseWriter, r *http.Request) bool {
+	token := currentConfig().APIToken
+	if token == "" {
+		http.Error(w, "set api_token to enable this endpoint", http.StatusForbidden)
+		return false
+	}
+
+	given := ""
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		given = strings.TrimPrefix(auth, "Bearer ")
+	} else if _, password, ok := r.BasicAuth(); ok {
+		given = password
+	}
+
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="led-controller"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
@@ -1,5 +1,41 @@
 package main
 
+import "sync"
+
+// AudioFeatures describe what the audio input is doing, as of the latest
+// feedback from the controller.
+type AudioFeatures struct {
+	// Average level in volts, and the live and recent maximum amplitude.
+	Volts        float64 `json:"volts"`
+	Amplitude    float64 `json:"amplitude"`
+	MaxAmplitude float64 `json:"max_amplitude"`
+
+	// Level is Amplitude relative to MaxAmplitude, from 0 to 1, or 0 if
+	// there's too little signal to tell.
+	Level float64 `json:"level"`
+}
+
+// audioInput holds the latest AudioFeatures, for Renderers to react to.
+type audioInput struct {
+	mu       sync.Mutex
+	features AudioFeatures
+}
+
+var audio = &audioInput{}
+
+func (a *audioInput) set(f AudioFeatures) {
+	a.mu.Lock()
+	a.features = f
+	a.mu.Unlock()
+}
+
+func (a *audioInput) get() AudioFeatures {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.features
+}
+
 type AudioMv struct {
 	Count float32 `json:"count,omitempty"`
 	Min   float32 `json:"min"`
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BlendAdd      = "add"
+	BlendMax      = "max"
+	BlendMultiply = "multiply"
+	BlendScreen   = "screen"
+	BlendAlpha    = "alpha"
+)
+
+var (
+	ErrInvalidBlend  = errors.New("blend must be add, max, multiply, screen, or alpha")
+	ErrNoLayerSource = errors.New("layer must set exactly one of image or color")
+	ErrNoSuchLayer   = errors.New("no such layer")
+	ErrDuplicateID   = errors.New("layer id already in use")
+)
+
+// LayerSpec describes a Compositor layer: where its frames come from, and
+// how they're blended with the layers below it.
+type LayerSpec struct {
+	ID      string `json:"id"`
+	Image   string `json:"image,omitempty"`
+	Color   string `json:"color,omitempty"`
+	Opacity *int   `json:"opacity,omitempty"`
+	Blend   string `json:"blend,omitempty"`
+}
+
+func (ls *LayerSpec) Validate() error {
+	if ls.ID == "" || strings.ContainsAny(ls.ID, "/ ") {
+		return fmt.Errorf("id %q: %w", ls.ID, ErrInvalidName)
+	}
+
+	switch {
+	case ls.Image != "" && ls.Color == "":
+		if !validPatternName(ls.Image) {
+			return fmt.Errorf("image %q: %w", ls.Image, ErrInvalidName)
+		}
+	case ls.Color != "" && ls.Image == "":
+		if _, err := parseColor(ls.Color); err != nil {
+			return fmt.Errorf("color %q: %w", ls.Color, err)
+		}
+	default:
+		return ErrNoLayerSource
+	}
+
+	return validateBlend(ls.Opacity, ls.Blend)
+}
+
+// validateBlend checks an optional opacity and blend mode.
+func validateBlend(opacity *int, blend string) error {
+	if opacity != nil && (*opacity < 0 || *opacity > 255) {
+		return fmt.Errorf("opacity %d must be >= 0 and <= 255: %w", *opacity, ErrInvalidValue)
+	}
+
+	switch blend {
+	case "", BlendAdd, BlendMax, BlendMultiply, BlendScreen, BlendAlpha:
+	default:
+		return fmt.Errorf("blend %q: %w", blend, ErrInvalidBlend)
+	}
+
+	return nil
+}
+
+// opacity returns the spec's opacity, defaulting to fully opaque.
+func (ls *LayerSpec) opacity() int {
+	if ls.Opacity == nil {
+		return 255
+	}
+	return *ls.Opacity
+}
+
+// newRenderer returns a Renderer for the layer's source.
+func (ls *LayerSpec) newRenderer() Renderer {
+	if ls.Color != "" {
+		c, _ := parseColor(ls.Color)
+		return c
+	}
+
+	if d := NewPatternDecoder(ls.Image); d != nil {
+		return d
+	}
+
+	return Frame{}
+}
+
+// layer is a LayerSpec and its running Renderer.
+type layer struct {
+	LayerSpec
+	renderer Renderer
+
+	// The renderer's Frame resized to the strip, when it's a different
+	// size, like a single color.
+	resized Frame
+}
+
+// blendLayer mixes frame f from an upper layer onto below, which it
+// modifies in place, using scratch as a temporary buffer.  It returns the
+// result and scratch, either of which may have been reallocated.
+func blendLayer(below, f, scratch Frame, mode string, opacity int) (Frame, Frame) {
+	if len(f) == 0 || opacity <= 0 {
+		return below, scratch
+	}
+	if len(below) == 0 {
+		if mode == BlendMultiply {
+			return below, scratch
+		}
+		return f.ScaleInto(below, opacity+1), scratch
+	}
+
+	t := opacity + 1
+	switch mode {
+	case BlendMax:
+		scratch = f.ScaleInto(scratch, t)
+		below = below.MergeInto(below, scratch)
+	case BlendMultiply:
+		scratch = below.MultInto(scratch, f)
+		below = below.LerpInto(below, scratch, t)
+	case BlendScreen:
+		scratch = below.ScreenInto(scratch, f)
+		below = below.LerpInto(below, scratch, t)
+	case BlendAlpha:
+		below = below.LerpInto(below, f, t)
+	default:
+		scratch = f.ScaleInto(scratch, t)
+		below = below.AddInto(below, scratch)
+	}
+
+	return below, scratch
+}
+
+// Compositor is a Renderer that stacks several layers, bottom first, each
+// blended onto the ones below it.
+type Compositor struct {
+	mu     sync.Mutex
+	layers []*layer
+	active bool
+
+	// Buffers reused for every frame.
+	buf, scratch Frame
+}
+
+// Layers returns the specs of all layers, bottom first.
+func (c *Compositor) Layers() []LayerSpec {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	specs := make([]LayerSpec, 0, len(c.layers))
+	for _, l := range c.layers {
+		spec := l.LayerSpec
+		opacity := l.opacity()
+		spec.Opacity = &opacity
+		specs = append(specs, spec)
+	}
+
+	return specs
+}
+
+func (c *Compositor) find(id string) int {
+	for i, l := range c.layers {
+		if l.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Add puts a new layer on top.
+func (c *Compositor) Add(spec LayerSpec) error {
+	return c.add(spec, false)
+}
+
+// Set replaces the source of the layer with spec's id, keeping its place
+// and, unless spec sets them, its opacity and blend mode.  If there's no
+// such layer, it puts a new one on top.
+func (c *Compositor) Set(spec LayerSpec) error {
+	return c.add(spec, true)
+}
+
+func (c *Compositor) add(spec LayerSpec, replace bool) error {
+	if err := spec.Validate(); err != nil {
+		return err
+	}
+
+	// Opening an image can take a while, so do it before locking out
+	// Render.
+	r := spec.newRenderer()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := c.find(spec.ID)
+	switch {
+	case i < 0:
+		c.layers = append(c.layers, &layer{LayerSpec: spec, renderer: r})
+	case !replace:
+		r.Close()
+		return fmt.Errorf("%q: %w", spec.ID, ErrDuplicateID)
+	default:
+		old := c.layers[i]
+		if spec.Opacity == nil {
+			spec.Opacity = old.Opacity
+		}
+		if spec.Blend == "" {
+			spec.Blend = old.Blend
+		}
+		if old.renderer != nil {
+			old.renderer.Close()
+		}
+		c.layers[i] = &layer{LayerSpec: spec, renderer: r}
+	}
+
+	return nil
+}
+
+// Update changes a layer's opacity and/or blend mode.
+func (c *Compositor) Update(id string, opacity *int, blend string) error {
+	if err := validateBlend(opacity, blend); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := c.find(id)
+	if i < 0 {
+		return fmt.Errorf("%q: %w", id, ErrNoSuchLayer)
+	}
+
+	if opacity != nil {
+		c.layers[i].Opacity = opacity
+	}
+	if blend != "" {
+		c.layers[i].Blend = blend
+	}
+
+	return nil
+}
+
+// Remove deletes a layer.
+func (c *Compositor) Remove(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := c.find(id)
+	if i < 0 {
+		return fmt.Errorf("%q: %w", id, ErrNoSuchLayer)
+	}
+
+	if l := c.layers[i]; l.renderer != nil {
+		l.renderer.Close()
+	}
+	c.layers = append(c.layers[:i], c.layers[i+1:]...)
+
+	return nil
+}
+
+// Move puts a layer at position index, where 0 is the bottom.
+func (c *Compositor) Move(id string, index int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := c.find(id)
+	if i < 0 {
+		return fmt.Errorf("%q: %w", id, ErrNoSuchLayer)
+	}
+	if index < 0 || index >= len(c.layers) {
+		return fmt.Errorf("index %d: %w", index, ErrInvalidValue)
+	}
+
+	l := c.layers[i]
+	c.layers = append(c.layers[:i], c.layers[i+1:]...)
+	c.layers = append(c.layers[:index], append([]*layer{l}, c.layers[index:]...)...)
+
+	return nil
+}
+
+// Play hands the Compositor to the Streamer, unless it's already playing.
+func (c *Compositor) Play(t *Streamer) {
+	c.mu.Lock()
+	active := c.active
+	c.active = true
+	c.mu.Unlock()
+
+	if !active {
+		c.restart()
+		t.SetRenderer(c)
+	}
+}
+
+// restart gives new Renderers to the layers Close stopped.
+func (c *Compositor) restart() {
+	c.mu.Lock()
+	var stopped []*layer
+	var specs []LayerSpec
+	for _, l := range c.layers {
+		if l.renderer == nil {
+			stopped = append(stopped, l)
+			specs = append(specs, l.LayerSpec)
+		}
+	}
+	c.mu.Unlock()
+
+	for i, l := range stopped {
+		r := specs[i].newRenderer()
+
+		c.mu.Lock()
+		if j := c.find(l.ID); c.active && j >= 0 && c.layers[j] == l && l.renderer == nil {
+			l.renderer = r
+		} else {
+			r.Close()
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *Compositor) Render(fc *FrameContext) Frame {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Blending needs every layer the same size: the strip's, or failing
+	// that the first layer's.
+	n := fc.Pixels * 3
+	f := c.buf[:0]
+	for _, l := range c.layers {
+		if l.renderer == nil {
+			continue
+		}
+		lf := l.renderer.Render(fc)
+		if n == 0 {
+			n = len(lf)
+		}
+		if len(lf) > 0 && len(lf) != n {
+			l.resized, _ = lf.ResizeInto(l.resized, n)
+			lf = l.resized
+		}
+		f, c.scratch = blendLayer(f, lf, c.scratch, l.Blend, l.opacity())
+	}
+
+	// With nothing drawn, the strip is black.
+	if len(f) == 0 {
+		f = grow(f, fc.Pixels*3)
+		for i := range f {
+			f[i] = 0
+		}
+	}
+	c.buf = f
+
+	return f
+}
+
+// Schema returns no params; layers are changed with LayerCommands.
+func (c *Compositor) Schema() []ParamSpec {
+	return nil
+}
+
+func (c *Compositor) Params() Params {
+	return Params{}
+}
+
+func (c *Compositor) SetParams(p Params) error {
+	return noParams(p)
+}
+
+// Reset starts every layer over.
+func (c *Compositor) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, l := range c.layers {
+		if l.renderer != nil {
+			l.renderer.Reset()
+		}
+	}
+}
+
+// Duration returns false, since the Compositor plays until it's changed.
+func (c *Compositor) Duration() (time.Duration, bool) {
+	return 0, false
+}
+
+// Close stops all layers.  They restart when the Compositor plays again.
+func (c *Compositor) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, l := range c.layers {
+		if l.renderer != nil {
+			l.renderer.Close()
+			l.renderer = nil
+		}
+	}
+	c.active = false
+}
+
+// LayerCommand is a websocket or API request to change the Compositor.
+type LayerCommand struct {
+	Op    string `json:"op"`
+	Index int    `json:"index,omitempty"`
+	LayerSpec
+}
+
+// Do applies a LayerCommand: "add", "set", "update", "remove", "move", or
+// "play".
+func (c *Compositor) Do(cmd *LayerCommand, t *Streamer) error {
+	var err error
+	switch cmd.Op {
+	case "add":
+		err = c.Add(cmd.LayerSpec)
+	case "set":
+		err = c.Set(cmd.LayerSpec)
+	case "update":
+		err = c.Update(cmd.ID, cmd.Opacity, cmd.Blend)
+	case "remove":
+		err = c.Remove(cmd.ID)
+	case "move":
+		err = c.Move(cmd.ID, cmd.Index)
+	case "play":
+	default:
+		return fmt.Errorf("op %q: %w", cmd.Op, ErrInvalidValue)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Any change to the layers means someone wants to see them.
+	c.Play(t)
+
+	return nil
+}
+
+// CompositorHandler serves the compositor API:
+//
+//	GET    /api/compositor               list layers, bottom first
+//	POST   /api/compositor               apply a LayerCommand
+//	PUT    /api/compositor/<id>          add or replace a layer, or update
+//	                                     its opacity and blend mode
+//	DELETE /api/compositor/<id>          remove a layer
+//	POST   /api/compositor/<id>/<index>  move a layer
+type CompositorHandler struct {
+	Compositor *Compositor
+	Streamer   *Streamer
+}
+
+func (h *CompositorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, index := splitTwo(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/compositor"), "/"), "/")
+
+	cmd := &LayerCommand{}
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, h.Compositor.Layers())
+		return
+	case id == "" && r.Method == http.MethodPost:
+		if err := readJSON(r, cmd); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case index == "" && r.Method == http.MethodPut:
+		if err := readJSON(r, cmd); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cmd.ID = id
+		cmd.Op = "set"
+		if cmd.Image == "" && cmd.Color == "" {
+			cmd.Op = "update"
+		}
+	case index == "" && r.Method == http.MethodDelete:
+		cmd.ID = id
+		cmd.Op = "remove"
+	case index != "" && r.Method == http.MethodPost:
+		i, err := strconv.Atoi(index)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cmd.ID = id
+		cmd.Op = "move"
+		cmd.Index = i
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := h.Compositor.Do(cmd, h.Streamer); err != nil {
+		code := http.StatusBadRequest
+		if errors.Is(err, ErrNoSuchLayer) {
+			code = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	writeJSON(w, h.Compositor.Layers())
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Config holds everything that can be set in the config file or with
+// flags.  A Config is never modified once it has been published by
+// setConfig(); reloading replaces it.
+type Config struct {
+	SerialPort      string   `json:"serial_port"`
+	BaudRate        int      `json:"baud_rate"`
+	NumPixels       int      `json:"num_pixels"`
+	FrameDelay      Duration `json:"frame_delay"`
+	ImageFrameQueue int      `json:"image_frame_queue"`
+	MaxBrightness   int      `json:"max_brightness"`
+	AudioDimming    int      `json:"audio_dimming"`
+	Listen          string   `json:"listen"`
+	RootDir         string   `json:"root_dir"`
+	Schedule        string   `json:"schedule"`
+	Latitude        float64  `json:"latitude"`
+	Longitude       float64  `json:"longitude"`
+	DefaultImage    string   `json:"default_image"`
+	DefaultColor    string   `json:"default_color,omitempty"`
+	Layout          string   `json:"layout,omitempty"`
+	APIToken        string   `json:"api_token,omitempty"`
+
+	Transition      TransitionConfig `json:"transition"`
+	ImageTransition TransitionConfig `json:"image_transition"`
+}
+
+// ConfigErrors lists every problem found in a Config.
+type ConfigErrors []string
+
+func (e ConfigErrors) Error() string {
+	return strings.Join(e, "; ")
+}
+
+var (
+	configMu sync.Mutex
+	config   *Config
+)
+
+// currentConfig returns the active Config.
+func currentConfig() *Config {
+	configMu.Lock()
+	defer configMu.Unlock()
+	return config
+}
+
+func setConfig(c *Config) {
+	configMu.Lock()
+	config = c
+	configMu.Unlock()
+}
+
+// configFromFlags copies flag values into c, either all of them, or only
+// the ones named in set.
+func configFromFlags(c *Config, set map[string]bool) {
+	from := func(name string) bool {
+		return set == nil || set[name]
+	}
+
+	if from("serial-port") {
+		c.SerialPort = *serialPort
+	}
+	if from("baud-rate") {
+		c.BaudRate = *baudRate
+	}
+	if from("num-pixels") {
+		c.NumPixels = *numPixels
+	}
+	if from("frame-delay") {
+		c.FrameDelay = Duration(*frameDelay)
+	}
+	if from("image-frame-queue") {
+		c.ImageFrameQueue = *imageFrameQueue
+	}
+	if from("max-brightness") {
+		c.MaxBrightness = *maxBrightness
+	}
+	if from("audio-dimming") {
+		c.AudioDimming = *audioDimming
+	}
+	if from("listen") {
+		c.Listen = *listenAddr
+	}
+	if from("root-dir") {
+		c.RootDir = *rootDir
+	}
+	if from("schedule") {
+		c.Schedule = *scheduleFile
+	}
+	if from("latitude") {
+		c.Latitude = *latitude
+	}
+	if from("longitude") {
+		c.Longitude = *longitude
+	}
+	if from("default-image") {
+		c.DefaultImage = *defaultImage
+	}
+	if from("default-color") {
+		c.DefaultColor = *defaultColor
+	}
+	if from("layout") {
+		c.Layout = *layoutName
+	}
+	if from("api-token") {
+		c.APIToken = *apiToken
+	}
+	if from("transition") {
+		c.Transition.Type = *transition
+	}
+	if from("transition-duration") {
+		c.Transition.Duration = Duration(*transitionDuration)
+	}
+	if from("image-transition") {
+		c.ImageTransition.Type = *imageTransition
+	}
+	if from("image-transition-duration") {
+		c.ImageTransition.Duration = Duration(*imageTransitionDuration)
+	}
+}
+
+// setFlags returns the names of flags given on the command line.
+func setFlags() map[string]bool {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// LoadConfig builds a Config from flag defaults, then the config file (if
+// any), then flags that were set on the command line, and validates it.
+func LoadConfig(file string, set map[string]bool) (*Config, error) {
+	c := &Config{}
+	configFromFlags(c, nil)
+
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, jsonErrorLine(b, err))
+		}
+	}
+
+	configFromFlags(c, set)
+
+	if c.RootDir != "" && !strings.HasSuffix(c.RootDir, "/") {
+		c.RootDir += "/"
+	}
+	if c.Schedule == "" {
+		c.Schedule = c.RootDir + "schedule.json"
+	}
+
+	if err := c.Validate(); err != nil {
+		if file != "" {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// jsonErrorLine adds the line number to JSON syntax and type errors.
+func jsonErrorLine(b []byte, err error) error {
+	offset := int64(-1)
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	}
+
+	if offset < 0 || offset > int64(len(b)) {
+		return err
+	}
+
+	return fmt.Errorf("line %d: %w", bytes.Count(b[:offset], []byte("\n"))+1, err)
+}
+
+// Validate checks every field, returning ConfigErrors listing all of the
+// problems found.
+func (c *Config) Validate() error {
+	var errs ConfigErrors
+	check := func(ok bool, format string, a ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, a...))
+		}
+	}
+
+	check(c.SerialPort != "", "serial_port must be set")
+	check(c.BaudRate > 0, "baud_rate must be > 0")
+	check(c.RootDir != "", "root_dir must be set")
+	check(c.Listen != "", "listen must be set")
+	check(c.NumPixels > 0 && c.NumPixels <= 10000, "num_pixels %d must be > 0 and <= 10000", c.NumPixels)
+	check(time.Duration(c.FrameDelay) >= time.Second/1000, "frame_delay %v must be >= 0.001s", time.Duration(c.FrameDelay))
+	check(c.ImageFrameQueue > 0, "image_frame_queue must be > 0")
+	check(c.MaxBrightness > 0 && c.MaxBrightness <= 255, "max_brightness %d must be > 0 and <= 255", c.MaxBrightness)
+	check(c.AudioDimming >= 0 && c.AudioDimming <= 255, "audio_dimming %d must be >= 0 and <= 255", c.AudioDimming)
+	check(c.Latitude >= -90 && c.Latitude <= 90, "latitude %g must be >= -90 and <= 90", c.Latitude)
+	check(c.Longitude >= -180 && c.Longitude <= 180, "longitude %g must be >= -180 and <= 180", c.Longitude)
+	check(validPatternName(c.DefaultImage), "default_image %q is not a valid pattern name", c.DefaultImage)
+	check(c.Layout == "" || validPatternName(c.Layout), "layout %q is not a valid layout name", c.Layout)
+	if c.DefaultColor != "" {
+		_, err := parseColor(c.DefaultColor)
+		check(err == nil, "default_color %q must be #rrggbb", c.DefaultColor)
+	}
+
+	if err := c.Transition.Validate(); err != nil {
+		check(false, "transition: %v", err)
+	}
+	if err := c.ImageTransition.Validate(); err != nil {
+		check(false, "image_transition: %v", err)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// restartRequired lists settings that differ between a and b but can't be
+// changed without restarting.
+func restartRequired(a, b *Config) []string {
+	var names []string
+	if a.SerialPort != b.SerialPort {
+		names = append(names, "serial_port")
+	}
+	if a.BaudRate != b.BaudRate {
+		names = append(names, "baud_rate")
+	}
+	if a.ImageFrameQueue != b.ImageFrameQueue {
+		names = append(names, "image_frame_queue")
+	}
+	if a.Listen != b.Listen {
+		names = append(names, "listen")
+	}
+	if a.RootDir != b.RootDir {
+		names = append(names, "root_dir")
+	}
+	return names
+}
+
+// ConfigReloader re-reads the config file on SIGHUP or an API call, and
+// passes the old and new Config to Apply for whatever can change at
+// runtime.
+type ConfigReloader struct {
+	File  string
+	Flags map[string]bool
+	Apply func(old, c *Config)
+
+	mu sync.Mutex
+}
+
+// Reload loads and validates the config file, and if it's OK, applies it.
+// Settings that require a restart keep their old values.
+func (cr *ConfigReloader) Reload() (*Config, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	c, err := LoadConfig(cr.File, cr.Flags)
+	if err != nil {
+		return nil, err
+	}
+
+	old := currentConfig()
+	if names := restartRequired(old, c); len(names) > 0 {
+		log.Println("Config: restart required to change", strings.Join(names, ", "))
+		c.SerialPort = old.SerialPort
+		c.BaudRate = old.BaudRate
+		c.ImageFrameQueue = old.ImageFrameQueue
+		c.Listen = old.Listen
+		c.RootDir = old.RootDir
+	}
+
+	setConfig(c)
+	cr.Apply(old, c)
+	log.Println("Config: reloaded", cr.File)
+
+	return c, nil
+}
+
+// Worker reloads the config whenever we receive SIGHUP.
+func (cr *ConfigReloader) Worker() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		if _, err := cr.Reload(); err != nil {
+			log.Println("Config: not reloaded:", err)
+		}
+	}
+}
+
+// ServeHTTP handles the config API:
+//
+//	GET  /api/config          the active config
+//	POST /api/config/reload   re-read the config file
+//
+// Reloading requires the api_token.
+func (cr *ConfigReloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/config"), "/"); {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(w, currentConfig().redacted())
+	case action == "reload" && r.Method == http.MethodPost:
+		if !authorized(w, r) {
+			return
+		}
+		c, err := cr.Reload()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, c.redacted())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// redacted returns a copy of c that's safe to show to clients.
+func (c *Config) redacted() *Config {
+	r := *c
+	if r.APIToken != "" {
+		r.APIToken = "********"
+	}
+	return &r
+}
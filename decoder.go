@@ -1,21 +1,145 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"image"
 	_ "image/jpeg"
 	_ "image/png"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/die-net/led-controller/anim"
+	"github.com/die-net/led-controller/videoimport"
 )
 
 type Decoder struct {
+	mu      sync.Mutex
+	meta    *PatternMeta
+	reader  *patternReader
+	fit     *fitter
+	dir     string
 	files   []string
 	fileNum int
+	current string
 	image   image.Image
-	y       int
+	pos     float64
+	played  int
+
+	// Playback controls.
+	speed    float64
+	reverse  bool
+	pingpong bool
+	bouncing bool
+	paused   bool
+	delay    time.Duration
+
+	// Transition between images.
+	blender
+	transition TransitionConfig
+	fade       int
+	fadeStart  float64
+	fadeTotal  int
+	next       image.Image
+
+	// The image we expect to need next, decoding in the background.
+	ahead *prefetch
+
+	// Bumped by the Watcher when our directory changes, and the value we
+	// last saw.
+	changes *uint64
+	seen    uint64
+
+	// How long the files take to play at normal speed, or -1 if not yet
+	// known.
+	length time.Duration
+
+	// Buffers reused for every frame.
+	row, nextRow rowBuffer
+	out, fitted  Frame
+}
+
+// rowBuffer holds the Frames used to read an interpolated row.
+type rowBuffer struct {
+	row, below Frame
+}
+
+// prefetchSlots limits how many images are decoded in the background at
+// once, by every Decoder together, to bound memory use.
+var prefetchSlots = make(chan struct{}, 1)
+
+var errPrefetchStopped = errors.New("prefetch stopped")
+
+// prefetch is an image being decoded in the background.
+type prefetch struct {
+	file string
+	done chan struct{}
+	stop chan struct{}
+	img  image.Image
+	err  error
+}
+
+func startPrefetch(file string, r *patternReader) *prefetch {
+	p := &prefetch{file: file, done: make(chan struct{}), stop: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+
+		// Wait for any other prefetch to finish, unless we're stopped
+		// first.
+		select {
+		case prefetchSlots <- struct{}{}:
+		case <-p.stop:
+			p.err = errPrefetchStopped
+			return
+		}
+		defer func() {
+			<-prefetchSlots
+		}()
+
+		select {
+		case <-p.stop:
+			p.err = errPrefetchStopped
+		default:
+			p.img, p.err = timedReadImage(file, r)
+		}
+	}()
+
+	return p
+}
+
+// abandon stops p if it hasn't started decoding yet.  One that has can't
+// be interrupted, but still holds up any other prefetch until it's done,
+// and then the image is closed.
+func (p *prefetch) abandon() {
+	close(p.stop)
+	go func() {
+		<-p.done
+		closeImage(p.img)
+	}()
+}
+
+// closeImage releases anything img holds, like an anim.File's mapping.
+func closeImage(img image.Image) {
+	if c, ok := img.(io.Closer); ok {
+		_ = c.Close()
+	}
+}
+
+// dropAhead abandons any prefetch.
+func (d *Decoder) dropAhead() {
+	if d.ahead != nil {
+		d.ahead.abandon()
+		d.ahead = nil
+	}
 }
 
 func NewDecoder(path string) *Decoder {
@@ -24,16 +148,27 @@ func NewDecoder(path string) *Decoder {
 		return nil
 	}
 
+	meta, err := LoadPatternMeta(path)
+	if err != nil {
+		log.Println("Error reading metadata", err)
+	}
+	files = meta.orderFiles(files)
+
 	start := 0
-	if len(files) > 1 {
+	if len(files) > 1 && len(meta.Order) == 0 {
 		start = rand.Intn(len(files))
 	}
 
 	d := &Decoder{
+		meta:    meta,
+		reader:  &patternReader{sample: loadSampler(path, meta), columns: meta.Columns},
+		fit:     newFitter(meta),
+		dir:     path,
 		files:   files,
 		fileNum: start,
 		image:   nil,
-		y:       0,
+		speed:   1,
+		length:  -1,
 	}
 
 	if d.NextImage() {
@@ -43,6 +178,34 @@ func NewDecoder(path string) *Decoder {
 	return nil
 }
 
+// NewPatternDecoder returns a Decoder for the named pattern directory under
+// images/, or nil if the name is invalid or it contains no valid images.
+func NewPatternDecoder(name string) *Decoder {
+	if !validPatternName(name) {
+		return nil
+	}
+
+	// Note the version first, so we can't miss a change while reading.
+	changes := patternWatcher.version(name)
+	seen := atomic.LoadUint64(changes)
+
+	c := currentConfig()
+	d := NewDecoder(c.RootDir + "images/" + name + "/")
+	if d != nil {
+		d.SetTransition(c.ImageTransition, time.Duration(c.FrameDelay))
+		d.speed = d.meta.speed(time.Duration(c.FrameDelay))
+		d.changes, d.seen = changes, seen
+	}
+
+	return d
+}
+
+// validPatternName returns true if name is safe to use as a single path
+// component under -root-dir.
+func validPatternName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, "/\\")
+}
+
 func getFilenames(path string) ([]string, error) {
 	files, err := ioutil.ReadDir(path)
 	if err != nil {
@@ -62,17 +225,30 @@ func getFilenames(path string) ([]string, error) {
 }
 
 func (d *Decoder) NextImage() bool {
-	d.y = 0
-
-	// If we only have one image and it's already loaded, we're done.
-	if d.image != nil && len(d.files) < 2 {
+	// If we only have one image and it's already loaded, or nothing else
+	// to load, we're done.
+	if d.image != nil && (len(d.files) == 0 || len(d.files) == 1 && d.files[0] == d.current) {
+		d.pos = float64(d.image.Bounds().Min.Y)
 		return true
 	}
 
-	d.image = nil
+	// If every file has gone, keep playing what we have.
+	if img := d.readNextImage(); img != nil {
+		closeImage(d.image)
+		d.image = img
+	} else if d.image == nil {
+		return false
+	}
+
+	d.pos = float64(d.image.Bounds().Min.Y)
+	return true
+}
+
+// readNextImage decodes the next readable file, dropping any that fail.
+func (d *Decoder) readNextImage() image.Image {
 	for {
 		if len(d.files) == 0 {
-			return false
+			return nil
 		}
 
 		if d.fileNum >= len(d.files) {
@@ -80,12 +256,12 @@ func (d *Decoder) NextImage() bool {
 		}
 		file := d.files[d.fileNum]
 
-		img, err := readImage(file)
+		img, err := d.take(file)
 		if err == nil {
-			d.image = img
-			d.y = img.Bounds().Min.Y
+			d.current = d.files[d.fileNum]
 			d.fileNum++
-			return true
+			d.prefetchNext()
+			return img
 		}
 
 		log.Println("Error reading", file, err)
@@ -93,22 +269,479 @@ func (d *Decoder) NextImage() bool {
 	}
 }
 
-func (d *Decoder) NextFrame() Frame {
+// take returns the decoded image for file, from the prefetch if we
+// guessed right.
+func (d *Decoder) take(file string) (image.Image, error) {
+	p := d.ahead
+	if p == nil || p.file != file {
+		d.dropAhead()
+		if d.image != nil {
+			metrics.waited(true, 0)
+		}
+		return timedReadImage(file, d.reader)
+	}
+
+	d.ahead = nil
+	select {
+	case <-p.done:
+	default:
+		start := time.Now()
+		<-p.done
+		metrics.waited(false, time.Since(start))
+	}
+
+	return p.img, p.err
+}
+
+// prefetchNext starts decoding the file that readNextImage will want next,
+// given the current direction, abandoning any other prefetch.  Only one
+// image is decoded ahead, to bound memory use.
+func (d *Decoder) prefetchNext() {
+	if len(d.files) < 2 {
+		return
+	}
+
+	// fileNum points after the current image; see loadImage.
+	n := d.fileNum
+	if d.reverse {
+		n -= 2
+	}
+	n = (n%len(d.files) + len(d.files)) % len(d.files)
+
+	if d.ahead != nil && d.ahead.file == d.files[n] {
+		return
+	}
+	d.dropAhead()
+	d.ahead = startPrefetch(d.files[n], d.reader)
+}
+
+// refresh rereads the list of files after the directory changed, and
+// carries on from the same place.  The current image keeps playing even if
+// its file is gone.
+func (d *Decoder) refresh() {
+	files, err := getFilenames(d.dir)
+	if err != nil {
+		log.Println("Error rereading", d.dir, err)
+	}
+	files = d.meta.orderFiles(files)
+
+	index := make(map[string]int, len(files))
+	for i, file := range files {
+		index[file] = i
+	}
+
+	// Go on to whatever follows the current file, or if that's gone, the
+	// first file still here that we would have played next.
+	fileNum := 0
+	if n := len(d.files); n > 0 {
+		if i, ok := index[d.files[(d.fileNum-1+n)%n]]; ok {
+			fileNum = i + 1
+		} else {
+			for i := 0; i < n; i++ {
+				if j, ok := index[d.files[(d.fileNum+i)%n]]; ok {
+					fileNum = j
+					break
+				}
+			}
+		}
+	}
+	d.files, d.fileNum = files, fileNum
+	d.length = -1
+
+	// Files may have been rewritten in place, so decode them afresh.
+	current := d.current
+	d.current = ""
+	d.dropAhead()
+	d.prefetchNext()
+
+	// Reading a mapped file that was rewritten in place can crash us, so
+	// reopen the current one, or move on if it's gone.
+	if old, ok := d.image.(io.Closer); ok {
+		if img, err := timedReadImage(current, d.reader); err == nil {
+			d.image = img
+			d.current = current
+			d.clampPos()
+		} else {
+			d.image = nil
+			d.NextImage()
+		}
+		_ = old.Close()
+	}
+}
+
+// SetTransition sets how to blend from the end of one image into the start
+// of the next.
+func (d *Decoder) SetTransition(tc TransitionConfig, delay time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.blender = blender{kind: tc.Type}
+	d.transition = tc
+	d.fade = tc.frames(delay)
+	d.delay = delay
+}
+
+// setDelay changes the delay between frames to the Streamer's.  Patterns
+// with an fps keep playing at that rate; the rest play a row per frame.
+func (d *Decoder) setDelay(delay time.Duration) {
+	if d.meta.FPS > 0 && d.delay > 0 {
+		d.speed *= float64(delay) / float64(d.delay)
+	}
+	d.delay = delay
+	d.fade = d.transition.frames(delay)
+	d.length = -1
+}
+
+// canFade returns true if we can blend into the next image when we reach
+// the end of this one.
+func (d *Decoder) canFade() bool {
+	return d.fade > 0 && !d.pingpong && !d.reverse && len(d.files) > 1
+}
+
+func (d *Decoder) Render(fc *FrameContext) Frame {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
 	if d.image == nil {
 		return nil
 	}
+	if fc.Delta > 0 && fc.Delta != d.delay {
+		d.setDelay(fc.Delta)
+	}
 
-	f := ImageRowToFrame(d.image, d.y)
+	// Wait until any transition is over, since it's already committed to
+	// the next file.
+	if d.changes != nil && d.next == nil {
+		if v := atomic.LoadUint64(d.changes); v != d.seen {
+			d.seen = v
+			d.refresh()
+			if d.image == nil {
+				return nil
+			}
+		}
+	}
 
-	// If we're on the last row, we'll have to load the next image.
-	d.y++
-	if d.y >= d.image.Bounds().Max.Y {
-		d.NextImage()
+	pos := d.pos
+	if _, ok := d.timed(); ok {
+		// Animation frames are distinct; don't blur them together.
+		pos = math.Floor(pos)
+	}
+	f := d.row.at(d.image, pos)
+
+	// While transitioning, blend in rows from the start of the next image.
+	if d.next != nil && d.canFade() && d.pos >= d.fadeStart {
+		into := d.pos - d.fadeStart
+		nf := d.nextRow.at(d.next, float64(d.next.Bounds().Min.Y)+into)
+		d.out = d.blend(d.out, f, nf, int(into)+1, d.fadeTotal)
+		f = d.out
+	}
+
+	if fc.Pixels > 0 && d.fit.active() {
+		d.fitted = d.fit.fit(d.fitted, f, fc.Pixels)
+		f = d.fitted
+	}
+
+	if !d.paused {
+		d.advance(d.step(1))
 	}
 
 	return f
 }
 
+// timedImage is an image whose rows each last a set time, like the frames
+// of an animation.
+type timedImage interface {
+	image.Image
+	RowDelay(y int) time.Duration
+}
+
+// timed returns the current image if its rows have their own timing, and
+// the pattern doesn't override it with an fps.
+func (d *Decoder) timed() (timedImage, bool) {
+	t, ok := d.image.(timedImage)
+	if !ok || d.meta.FPS > 0 || d.delay <= 0 {
+		return nil, false
+	}
+	return t, true
+}
+
+// step returns how many rows to move over a number of frame delays.
+// Usually that's speed rows per frame, but the rows of timed images last
+// as long as they say, scaled by speed.
+func (d *Decoder) step(frames float64) float64 {
+	step := d.speed * d.direction() * frames
+	if t, ok := d.timed(); ok {
+		return d.timedStep(t, step*float64(d.delay))
+	}
+
+	return step
+}
+
+// timedStep returns how many rows to move through t to cover dt
+// nanoseconds, forward if positive or backward if negative.  Time left over
+// past either end is converted to rows at the rate of the row playback
+// will continue into: the same one when bouncing, or the one at the other
+// end when looping.
+func (d *Decoder) timedStep(t timedImage, dt float64) float64 {
+	bounds := t.Bounds()
+	rowDelay := func(y int) float64 {
+		if rd := t.RowDelay(y); rd > 0 {
+			return float64(rd)
+		}
+		return float64(d.delay)
+	}
+
+	forward := dt > 0
+	if !forward {
+		dt = -dt
+	}
+	bounce := d.pingpong && !d.bouncing
+
+	pos := d.pos
+	for dt > 0 {
+		y := int(math.Floor(pos))
+		if !forward {
+			y = int(math.Ceil(pos)) - 1
+		}
+
+		if y < bounds.Min.Y || y >= bounds.Max.Y {
+			y = bounds.Min.Y
+			if forward == bounce {
+				y = bounds.Max.Y - 1
+			}
+			if forward {
+				pos += dt / rowDelay(y)
+			} else {
+				pos -= dt / rowDelay(y)
+			}
+			break
+		}
+
+		// How much of row y is left to play, in rows.
+		left := float64(y+1) - pos
+		if !forward {
+			left = pos - float64(y)
+		}
+		if need := left * rowDelay(y); dt < need {
+			left = dt / rowDelay(y)
+			dt = 0
+		} else {
+			dt -= need
+		}
+
+		if forward {
+			pos += left
+		} else {
+			pos -= left
+		}
+	}
+
+	return pos - d.pos
+}
+
+// direction returns 1 if we're currently moving forward through the
+// image, or -1 if backward.
+func (d *Decoder) direction() float64 {
+	if d.reverse != d.bouncing {
+		return -1
+	}
+	return 1
+}
+
+// advance moves delta rows through the image, moving on to another image,
+// bouncing, or blending as needed.
+func (d *Decoder) advance(delta float64) {
+	bounds := d.image.Bounds()
+	first, last := d.span()
+	d.pos += delta
+
+	// Rows are usually points, so there's a whole row between the last
+	// one and the first of the next image.  Timed rows are spans of time
+	// that run straight into each other.
+	gap := 1.0
+	if _, ok := d.timed(); ok {
+		gap = 0
+	}
+
+	// Start loading the next image when we're near enough to the end.
+	if delta > 0 && d.next == nil && d.canFade() {
+		fade := d.fade
+		if h := bounds.Dy() / 2; fade > h {
+			fade = h
+		}
+		if fade > 0 && d.pos >= float64(bounds.Max.Y-fade) {
+			d.next = d.readNextImage()
+			d.fadeStart = float64(bounds.Max.Y - fade)
+			d.fadeTotal = fade
+		}
+	}
+
+	switch {
+	case d.pos > last && d.next != nil && d.canFade():
+		d.played++
+		d.pos = float64(d.next.Bounds().Min.Y) + d.pos - d.fadeStart
+		closeImage(d.image)
+		d.image, d.next = d.next, nil
+	case (d.pos > last || d.pos < first) && d.pingpong && !d.bouncing:
+		d.bouncing = true
+		if d.pos > last {
+			d.pos = 2*last - d.pos
+		} else {
+			d.pos = 2*first - d.pos
+		}
+	case d.pos > last || d.pos < first:
+		d.played++
+		d.bouncing = false
+		if d.pingpong {
+			d.loadImage(d.reverse, 0)
+		} else if d.pos > last {
+			d.loadImage(false, d.pos-last-gap)
+		} else {
+			d.loadImage(true, first-d.pos-gap)
+		}
+	default:
+		return
+	}
+
+	d.clampPos()
+}
+
+// loadImage switches to the next or previous image, starting over rows
+// in from its first or last row.
+func (d *Decoder) loadImage(backward bool, over float64) {
+	if d.next != nil {
+		// We'd already started reading the next image; undo that.
+		closeImage(d.next)
+		d.next = nil
+		d.fileNum--
+	}
+
+	if backward && len(d.files) > 1 {
+		// fileNum points after the current image; go to the one before it.
+		d.fileNum = ((d.fileNum-2)%len(d.files) + len(d.files)) % len(d.files)
+	}
+
+	if !d.NextImage() {
+		return
+	}
+
+	first, last := d.span()
+	if backward {
+		d.pos = last - over
+	} else {
+		d.pos = first + over
+	}
+}
+
+// span returns the first and last positions within the current image.  The
+// last row of a timed image lasts as long as the others, so it ends just
+// before the image does.
+func (d *Decoder) span() (float64, float64) {
+	bounds := d.image.Bounds()
+	first, last := float64(bounds.Min.Y), float64(bounds.Max.Y-1)
+	if _, ok := d.timed(); ok {
+		last = math.Nextafter(float64(bounds.Max.Y), first)
+	}
+
+	return first, last
+}
+
+// clampPos keeps pos within the current image.
+func (d *Decoder) clampPos() {
+	if d.image == nil {
+		return
+	}
+
+	first, last := d.span()
+	if d.pos < first {
+		d.pos = first
+	}
+	if d.pos > last {
+		d.pos = last
+	}
+}
+
+// at returns the row at fractional position pos in img, interpolating
+// between the two nearest rows.  The Frame is reused by the next call.
+func (rb *rowBuffer) at(img image.Image, pos float64) Frame {
+	y := int(math.Floor(pos))
+	rb.row = ImageRowToFrameInto(rb.row, img, y)
+
+	if t := int((pos - float64(y)) * 256); t > 0 && y+1 < img.Bounds().Max.Y {
+		rb.below = ImageRowToFrameInto(rb.below, img, y+1)
+		rb.row = rb.row.LerpInto(rb.row, rb.below, t)
+	}
+
+	return rb.row
+}
+
+// loadSampler returns how to sample a pattern's animated images.
+func loadSampler(path string, meta *PatternMeta) anim.Sampler {
+	if meta.Animation != AnimationTexture {
+		return anim.Flatten
+	}
+
+	file := filepath.Join(path, pathFile)
+	b, err := ioutil.ReadFile(file)
+	if err == nil {
+		var points []image.Point
+		// Points outside an animation are black, so any size will do.
+		points, err = videoimport.ParsePath(b, math.MaxInt32, math.MaxInt32)
+		if err == nil {
+			return anim.PathSampler(points)
+		}
+	}
+
+	log.Println("Error reading", file, err, "- playing animations as rows")
+	return anim.Flatten
+}
+
+// timedReadImage reads an image, recording how long it took.
+func timedReadImage(file string, r *patternReader) (image.Image, error) {
+	start := time.Now()
+	img, err := r.read(file)
+	metrics.decoded(time.Since(start), err)
+
+	return img, err
+}
+
+// patternReader reads a pattern's images the way its metadata asks.
+type patternReader struct {
+	// How to sample each frame of an animated GIF, PNG, or WebP into a
+	// row.
+	sample anim.Sampler
+
+	// Whether to read still images by column instead of by row.
+	columns bool
+}
+
+func (r *patternReader) read(file string) (image.Image, error) {
+	if strings.HasSuffix(file, anim.Ext) {
+		// Map animations rather than reading them into memory.
+		return anim.Open(file)
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := anim.DecodeAnimation(b, r.sample)
+	if errors.Is(err, anim.ErrNotAnimated) {
+		still, err := decodeImage(bytes.NewReader(b))
+		if err != nil || !r.columns {
+			return still, err
+		}
+		return transpose(still), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
+
+// readImage reads a still image, or the first frame of an animation.
 func readImage(file string) (image.Image, error) {
 	reader, err := os.Open(file)
 	if err != nil {
@@ -119,7 +752,12 @@ func readImage(file string) (image.Image, error) {
 		_ = reader.Close()
 	}()
 
-	img, _, err := image.Decode(reader)
+	return decodeImage(reader)
+}
+
+// decodeImage decodes any registered image format.
+func decodeImage(r io.Reader) (image.Image, error) {
+	img, _, err := image.Decode(r)
 	if err != nil {
 		return nil, err
 	}
@@ -127,5 +765,29 @@ func readImage(file string) (image.Image, error) {
 	return img, nil
 }
 
+// Meta returns the pattern's metadata.
+func (d *Decoder) Meta() *PatternMeta {
+	return d.meta
+}
+
+// Loops returns how many times every file in the directory has been played.
+func (d *Decoder) Loops() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.files) == 0 {
+		return 0
+	}
+
+	return d.played / len(d.files)
+}
+
 func (d *Decoder) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.dropAhead()
+	closeImage(d.image)
+	closeImage(d.next)
+	d.image, d.next = nil, nil
 }
@@ -0,0 +1,1034 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A pixel expression is a small program run for every pixel of every
+// frame to work out its color.  For example:
+//
+//	# Hue scrolls along the strip; the audio level sets brightness.
+//	param speed = 0.2 [0, 2]
+//	param tint = "#ff8000"
+//	h = i / n + t * speed
+//	mix(hsv(h, 1, 1), tint, 0.3) * level
+//
+// Each line is a statement: "name = value" sets a variable, and the last
+// line is the pixel's color.  Values are numbers or colors; a number
+// where a color is wanted is a shade of gray from 0 for black to 1 for
+// white, and arithmetic on colors works on each channel.  Comparisons,
+// && and || give 1 for true and 0 for false, and "c ? a : b" chooses.
+//
+// "param name = default [min, max]" declares a number that can be
+// changed while the expression runs, and "param name = "#rrggbb"" a
+// color.
+//
+// Per-pixel variables:
+//
+//	i, n       the pixel's index, and the number of pixels
+//	x, y, z    the pixel's position from the layout, or i, 0, 0
+//	t, dt      seconds since starting, and in this frame
+//	level      audio level from 0 to 1
+//	amplitude  audio amplitude, and volts, the average, in volts
+//	pi
+//
+// Functions:
+//
+//	sin cos tan asin acos atan atan2 sqrt exp log pow abs sign floor
+//	ceil round fract mod min max clamp step smoothstep tri
+//	mix(a, b, f)           from a to b, for numbers or colors
+//	noise(x[, y[, z]])     smooth noise from 0 to 1
+//	rand(x)                a random-looking number from 0 to 1 for each x
+//	rgb(r, g, b), hsv(h, s, v)
+//	palette("name", x)     a color from a palette, which wraps around
+//	                       every 1; or a list of "#rrggbb,#rrggbb..."
+var ErrExpression = errors.New("invalid expression")
+
+// maxExprSource is the longest expression source allowed.
+const maxExprSource = 16 << 10
+
+// Variable slots filled in for each pixel.
+const (
+	slotI = iota
+	slotN
+	slotX
+	slotY
+	slotZ
+	slotT
+	slotDT
+	slotLevel
+	slotAmplitude
+	slotVolts
+	numBuiltins
+)
+
+var exprBuiltins = map[string]int{
+	"i":         slotI,
+	"n":         slotN,
+	"x":         slotX,
+	"y":         slotY,
+	"z":         slotZ,
+	"t":         slotT,
+	"dt":        slotDT,
+	"level":     slotLevel,
+	"amplitude": slotAmplitude,
+	"volts":     slotVolts,
+}
+
+type exprType int
+
+const (
+	numberType exprType = iota
+	colorType
+	stringType
+)
+
+func (t exprType) String() string {
+	return [...]string{"number", "color", "string"}[t]
+}
+
+type rgbColor [3]float64
+
+// exprEnv holds the variables while running an Expr.
+type exprEnv struct {
+	nums   []float64
+	colors []rgbColor
+}
+
+// exprNode is a compiled piece of an expression: a function returning
+// its value, or a constant string.
+type exprNode struct {
+	typ   exprType
+	num   func(e *exprEnv) float64
+	color func(e *exprEnv) rgbColor
+	str   string
+}
+
+func numberNode(f func(e *exprEnv) float64) exprNode {
+	return exprNode{typ: numberType, num: f}
+}
+
+func colorNode(f func(e *exprEnv) rgbColor) exprNode {
+	return exprNode{typ: colorType, color: f}
+}
+
+// asColor returns n as a color, as gray if it's a number.
+func (n exprNode) asColor() func(e *exprEnv) rgbColor {
+	if n.typ == colorType {
+		return n.color
+	}
+
+	f := n.num
+	return func(e *exprEnv) rgbColor {
+		v := f(e)
+		return rgbColor{v, v, v}
+	}
+}
+
+// ExprParam is a param declared by an expression.
+type ExprParam struct {
+	Name     string
+	Color    bool
+	Default  float64
+	Min, Max float64
+	Hex      string
+
+	slot int
+}
+
+// Expr is a compiled pixel expression.
+type Expr struct {
+	Params []ExprParam
+
+	stmts        []func(e *exprEnv)
+	out          func(e *exprEnv) rgbColor
+	nums, colors int
+}
+
+// newEnv returns somewhere to run x.
+func (x *Expr) newEnv() *exprEnv {
+	return &exprEnv{nums: make([]float64, x.nums), colors: make([]rgbColor, x.colors)}
+}
+
+// pixel runs x with the variables in e, and returns the color.
+func (x *Expr) pixel(e *exprEnv) rgbColor {
+	for _, s := range x.stmts {
+		s(e)
+	}
+
+	return x.out(e)
+}
+
+// CompileExpr compiles src, or returns an error saying where it's wrong.
+func CompileExpr(src string) (*Expr, error) {
+	if len(src) > maxExprSource {
+		return nil, fmt.Errorf("longer than %d bytes: %w", maxExprSource, ErrExpression)
+	}
+
+	toks, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{
+		toks: toks,
+		vars: map[string]exprVar{},
+		expr: &Expr{nums: numBuiltins},
+	}
+	if err := p.program(); err != nil {
+		return nil, err
+	}
+
+	return p.expr, nil
+}
+
+// Tokens.
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokEnd           // newline or ;
+	tokNumber
+	tokIdent
+	tokString
+	tokOp
+)
+
+type exprToken struct {
+	kind      tokenKind
+	text      string
+	num       float64
+	line, col int
+}
+
+// exprErrorf returns an error at tok's position.
+func exprErrorf(tok exprToken, format string, args ...interface{}) error {
+	return fmt.Errorf("line %d col %d: %s: %w", tok.line, tok.col, fmt.Sprintf(format, args...), ErrExpression)
+}
+
+// Operators, longest first so they match greedily.
+var exprOps = []string{"==", "!=", "<=", ">=", "&&", "||", "+", "-", "*", "/", "%", "^", "(", ")", ",", "=", "<", ">", "!", "?", ":", "[", "]"}
+
+func lexExpr(src string) ([]exprToken, error) {
+	var toks []exprToken
+	line, col, depth := 1, 1, 0
+
+	// Newlines end statements, except inside brackets or after something
+	// that must be followed by more.
+	continues := func() bool {
+		if depth > 0 || len(toks) == 0 {
+			return true
+		}
+		last := toks[len(toks)-1]
+		return last.kind == tokEnd || last.kind == tokOp && last.text != ")" && last.text != "]"
+	}
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		tok := exprToken{line: line, col: col}
+		start := i
+
+		switch {
+		case c == '\n':
+			if !continues() {
+				tok.kind = tokEnd
+				toks = append(toks, tok)
+			}
+			i++
+			line, col = line+1, 1
+			continue
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#' || strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == ';':
+			tok.kind = tokEnd
+			toks = append(toks, tok)
+			i++
+		case c >= '0' && c <= '9' || c == '.':
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.') {
+				i++
+			}
+			// An exponent, like 1e-3.
+			if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+				j := i + 1
+				if j < len(src) && (src[j] == '-' || src[j] == '+') {
+					j++
+				}
+				if j < len(src) && src[j] >= '0' && src[j] <= '9' {
+					for i = j; i < len(src) && src[i] >= '0' && src[i] <= '9'; i++ {
+					}
+				}
+			}
+			v, err := strconv.ParseFloat(src[start:i], 64)
+			if err != nil {
+				return nil, exprErrorf(tok, "bad number %q", src[start:i])
+			}
+			tok.kind, tok.num, tok.text = tokNumber, v, src[start:i]
+			toks = append(toks, tok)
+		case c == '_' || c < 0x80 && unicode.IsLetter(rune(c)):
+			for i < len(src) && (src[i] == '_' || src[i] < 0x80 && (unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i])))) {
+				i++
+			}
+			tok.kind, tok.text = tokIdent, src[start:i]
+			toks = append(toks, tok)
+		case c == '"':
+			i++
+			for i < len(src) && src[i] != '"' && src[i] != '\n' {
+				i++
+			}
+			if i >= len(src) || src[i] != '"' {
+				return nil, exprErrorf(tok, "unterminated string")
+			}
+			i++
+			tok.kind, tok.text = tokString, src[start+1:i-1]
+			toks = append(toks, tok)
+		default:
+			for _, op := range exprOps {
+				if strings.HasPrefix(src[i:], op) {
+					tok.kind, tok.text = tokOp, op
+					i += len(op)
+					break
+				}
+			}
+			if tok.kind != tokOp {
+				return nil, exprErrorf(tok, "unexpected %q", c)
+			}
+			switch tok.text {
+			case "(", "[":
+				depth++
+			case ")", "]":
+				depth--
+			}
+			toks = append(toks, tok)
+		}
+
+		col += i - start
+	}
+
+	toks = append(toks, exprToken{kind: tokEOF, line: line, col: col})
+
+	return toks, nil
+}
+
+// Parsing and compiling.
+
+type exprVar struct {
+	typ  exprType
+	slot int
+}
+
+type exprParser struct {
+	toks []exprToken
+	pos  int
+	vars map[string]exprVar
+	expr *Expr
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.toks[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	tok := p.toks[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// isOp returns whether the next token is one of ops.
+func (p *exprParser) isOp(ops ...string) bool {
+	tok := p.peek()
+	if tok.kind != tokOp {
+		return false
+	}
+	for _, op := range ops {
+		if tok.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if tok := p.next(); tok.kind != tokOp || tok.text != op {
+		return exprErrorf(tok, "expected %q, found %s", op, describe(tok))
+	}
+	return nil
+}
+
+func describe(tok exprToken) string {
+	switch tok.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokEnd:
+		return "end of line"
+	}
+	return fmt.Sprintf("%q", tok.text)
+}
+
+// program is statements, then the pixel color.
+func (p *exprParser) program() error {
+	for {
+		for p.peek().kind == tokEnd {
+			p.next()
+		}
+
+		tok := p.peek()
+		if tok.kind == tokEOF {
+			if p.expr.out == nil {
+				return exprErrorf(tok, "no color: the last line should be the pixel's color")
+			}
+			return nil
+		}
+		p.expr.out = nil
+
+		if tok.kind == tokIdent && tok.text == "param" {
+			if err := p.param(); err != nil {
+				return err
+			}
+		} else if tok.kind == tokIdent && p.toks[p.pos+1].kind == tokOp && p.toks[p.pos+1].text == "=" {
+			if err := p.assign(); err != nil {
+				return err
+			}
+		} else {
+			n, err := p.ternary()
+			if err != nil {
+				return err
+			}
+			if n.typ == stringType {
+				return exprErrorf(tok, "the pixel's color can't be a string")
+			}
+			p.expr.out = n.asColor()
+		}
+
+		if tok := p.peek(); tok.kind != tokEnd && tok.kind != tokEOF {
+			return exprErrorf(tok, "expected end of line, found %s", describe(tok))
+		}
+	}
+}
+
+// param declares a param: param name = number [min, max], or
+// param name = "#rrggbb".
+func (p *exprParser) param() error {
+	p.next()
+	tok := p.next()
+	if tok.kind != tokIdent {
+		return exprErrorf(tok, "expected param name, found %s", describe(tok))
+	}
+	if err := p.checkName(tok); err != nil {
+		return err
+	}
+	if err := p.expect("="); err != nil {
+		return err
+	}
+
+	ep := ExprParam{Name: tok.text}
+	val := p.next()
+	switch {
+	case val.kind == tokString:
+		if _, err := parseColor(val.text); err != nil {
+			return exprErrorf(val, "param %s: %v", tok.text, err)
+		}
+		ep.Color, ep.Hex = true, val.text
+		ep.slot = p.expr.colors
+		p.expr.colors++
+		p.vars[tok.text] = exprVar{colorType, ep.slot}
+	default:
+		neg := false
+		if val.kind == tokOp && val.text == "-" {
+			neg, val = true, p.next()
+		}
+		if val.kind != tokNumber {
+			return exprErrorf(val, "param %s needs a number or \"#rrggbb\" default", tok.text)
+		}
+		ep.Default = val.num
+		if neg {
+			ep.Default = -ep.Default
+		}
+
+		ep.Min, ep.Max = math.Min(0, ep.Default), math.Max(1, 2*ep.Default)
+		if p.isOp("[") {
+			p.next()
+			var err error
+			if ep.Min, err = p.constant(); err != nil {
+				return err
+			}
+			if err := p.expect(","); err != nil {
+				return err
+			}
+			if ep.Max, err = p.constant(); err != nil {
+				return err
+			}
+			if err := p.expect("]"); err != nil {
+				return err
+			}
+			if ep.Min >= ep.Max || ep.Default < ep.Min || ep.Default > ep.Max {
+				return exprErrorf(val, "param %s's default must be within its range", tok.text)
+			}
+		}
+
+		ep.slot = p.expr.nums
+		p.expr.nums++
+		p.vars[tok.text] = exprVar{numberType, ep.slot}
+	}
+
+	p.expr.Params = append(p.expr.Params, ep)
+
+	return nil
+}
+
+// constant parses a number, which may be negative.
+func (p *exprParser) constant() (float64, error) {
+	tok := p.next()
+	sign := 1.0
+	if tok.kind == tokOp && tok.text == "-" {
+		sign, tok = -1, p.next()
+	}
+	if tok.kind != tokNumber {
+		return 0, exprErrorf(tok, "expected a number, found %s", describe(tok))
+	}
+
+	return sign * tok.num, nil
+}
+
+// checkName returns an error if tok can't name a new variable or param.
+func (p *exprParser) checkName(tok exprToken) error {
+	if _, ok := exprBuiltins[tok.text]; ok || tok.text == "pi" || tok.text == "param" {
+		return exprErrorf(tok, "%s is already built in", tok.text)
+	}
+	if _, ok := exprFuncs[tok.text]; ok {
+		return exprErrorf(tok, "%s is a function", tok.text)
+	}
+	for _, ep := range p.expr.Params {
+		if ep.Name == tok.text {
+			return exprErrorf(tok, "%s is a param", tok.text)
+		}
+	}
+
+	return nil
+}
+
+// assign sets a variable: name = value.
+func (p *exprParser) assign() error {
+	tok := p.next()
+	p.next()
+	if err := p.checkName(tok); err != nil {
+		return err
+	}
+
+	n, err := p.ternary()
+	if err != nil {
+		return err
+	}
+
+	v, ok := p.vars[tok.text]
+	switch {
+	case n.typ == stringType:
+		return exprErrorf(tok, "%s can't be a string", tok.text)
+	case !ok:
+		v = exprVar{typ: n.typ}
+		if n.typ == colorType {
+			v.slot = p.expr.colors
+			p.expr.colors++
+		} else {
+			v.slot = p.expr.nums
+			p.expr.nums++
+		}
+		p.vars[tok.text] = v
+	case v.typ == numberType && n.typ == colorType:
+		return exprErrorf(tok, "%s is a number, so can't be set to a color", tok.text)
+	}
+
+	slot := v.slot
+	if v.typ == colorType {
+		f := n.asColor()
+		p.expr.stmts = append(p.expr.stmts, func(e *exprEnv) { e.colors[slot] = f(e) })
+	} else {
+		f := n.num
+		p.expr.stmts = append(p.expr.stmts, func(e *exprEnv) { e.nums[slot] = f(e) })
+	}
+
+	return nil
+}
+
+// ternary is c ? a : b, or just c.
+func (p *exprParser) ternary() (exprNode, error) {
+	c, err := p.binary(0)
+	if err != nil || !p.isOp("?") {
+		return c, err
+	}
+	tok := p.next()
+	if c.typ != numberType {
+		return c, exprErrorf(tok, "condition must be a number, not a %s", c.typ)
+	}
+
+	a, err := p.ternary()
+	if err != nil {
+		return a, err
+	}
+	if err := p.expect(":"); err != nil {
+		return a, err
+	}
+	b, err := p.ternary()
+	if err != nil {
+		return b, err
+	}
+	if a.typ == stringType || b.typ == stringType {
+		return a, exprErrorf(tok, "can't choose a string")
+	}
+
+	cf := c.num
+	if a.typ == numberType && b.typ == numberType {
+		af, bf := a.num, b.num
+		return numberNode(func(e *exprEnv) float64 {
+			if cf(e) != 0 {
+				return af(e)
+			}
+			return bf(e)
+		}), nil
+	}
+
+	af, bf := a.asColor(), b.asColor()
+	return colorNode(func(e *exprEnv) rgbColor {
+		if cf(e) != 0 {
+			return af(e)
+		}
+		return bf(e)
+	}), nil
+}
+
+// Binary operators by precedence, lowest first.
+var exprPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *exprParser) binary(level int) (exprNode, error) {
+	if level == len(exprPrecedence) {
+		return p.unary()
+	}
+
+	a, err := p.binary(level + 1)
+	if err != nil {
+		return a, err
+	}
+	for p.isOp(exprPrecedence[level]...) {
+		tok := p.next()
+		b, err := p.binary(level + 1)
+		if err != nil {
+			return b, err
+		}
+		if a, err = binaryOp(tok, a, b); err != nil {
+			return a, err
+		}
+	}
+
+	return a, nil
+}
+
+// unary is -a, !a, or a power.
+func (p *exprParser) unary() (exprNode, error) {
+	if !p.isOp("-", "!", "+") {
+		return p.power()
+	}
+
+	tok := p.next()
+	a, err := p.unary()
+	if err != nil {
+		return a, err
+	}
+
+	switch {
+	case tok.text == "+" && a.typ != stringType:
+		return a, nil
+	case tok.text == "-" && a.typ == numberType:
+		f := a.num
+		return numberNode(func(e *exprEnv) float64 { return -f(e) }), nil
+	case tok.text == "-" && a.typ == colorType:
+		f := a.color
+		return colorNode(func(e *exprEnv) rgbColor {
+			c := f(e)
+			return rgbColor{-c[0], -c[1], -c[2]}
+		}), nil
+	case tok.text == "!" && a.typ == numberType:
+		f := a.num
+		return numberNode(func(e *exprEnv) float64 { return truth(f(e) == 0) }), nil
+	}
+
+	return a, exprErrorf(tok, "can't use %s on a %s", tok.text, a.typ)
+}
+
+// power is a ^ b, which binds tighter than unary minus and to the right.
+func (p *exprParser) power() (exprNode, error) {
+	a, err := p.primary()
+	if err != nil || !p.isOp("^") {
+		return a, err
+	}
+
+	tok := p.next()
+	b, err := p.unary()
+	if err != nil {
+		return b, err
+	}
+
+	return binaryOp(tok, a, b)
+}
+
+func (p *exprParser) primary() (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber:
+		v := tok.num
+		return numberNode(func(*exprEnv) float64 { return v }), nil
+	case tokString:
+		return exprNode{typ: stringType, str: tok.text}, nil
+	case tokIdent:
+		if p.isOp("(") {
+			return p.call(tok)
+		}
+		if tok.text == "pi" {
+			return numberNode(func(*exprEnv) float64 { return math.Pi }), nil
+		}
+		if slot, ok := exprBuiltins[tok.text]; ok {
+			return numberNode(func(e *exprEnv) float64 { return e.nums[slot] }), nil
+		}
+		v, ok := p.vars[tok.text]
+		if !ok {
+			return exprNode{}, exprErrorf(tok, "unknown variable %s", tok.text)
+		}
+		slot := v.slot
+		if v.typ == colorType {
+			return colorNode(func(e *exprEnv) rgbColor { return e.colors[slot] }), nil
+		}
+		return numberNode(func(e *exprEnv) float64 { return e.nums[slot] }), nil
+	case tokOp:
+		if tok.text == "(" {
+			n, err := p.ternary()
+			if err != nil {
+				return n, err
+			}
+			return n, p.expect(")")
+		}
+	}
+
+	return exprNode{}, exprErrorf(tok, "unexpected %s", describe(tok))
+}
+
+// call parses a function's arguments and compiles the call.
+func (p *exprParser) call(name exprToken) (exprNode, error) {
+	p.next()
+
+	var args []exprNode
+	for !p.isOp(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return exprNode{}, err
+			}
+		}
+		n, err := p.ternary()
+		if err != nil {
+			return n, err
+		}
+		args = append(args, n)
+	}
+	p.next()
+
+	fn, ok := exprFuncs[name.text]
+	if !ok {
+		return exprNode{}, exprErrorf(name, "unknown function %s", name.text)
+	}
+	n, err := fn(args)
+	if err != nil {
+		return n, exprErrorf(name, "%s: %v", name.text, err)
+	}
+
+	return n, nil
+}
+
+func truth(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// binaryOp compiles a op b.
+func binaryOp(tok exprToken, a, b exprNode) (exprNode, error) {
+	if a.typ == stringType || b.typ == stringType {
+		return a, exprErrorf(tok, "can't use %s on a string", tok.text)
+	}
+
+	op := numberOps[tok.text]
+	if a.typ == numberType && b.typ == numberType {
+		af, bf := a.num, b.num
+		return numberNode(func(e *exprEnv) float64 { return op(af(e), bf(e)) }), nil
+	}
+
+	switch tok.text {
+	case "+", "-", "*", "/", "%", "^":
+	default:
+		return a, exprErrorf(tok, "can't use %s on a color", tok.text)
+	}
+
+	af, bf := a.asColor(), b.asColor()
+	return colorNode(func(e *exprEnv) rgbColor {
+		x, y := af(e), bf(e)
+		return rgbColor{op(x[0], y[0]), op(x[1], y[1]), op(x[2], y[2])}
+	}), nil
+}
+
+var numberOps = map[string]func(a, b float64) float64{
+	"+":  func(a, b float64) float64 { return a + b },
+	"-":  func(a, b float64) float64 { return a - b },
+	"*":  func(a, b float64) float64 { return a * b },
+	"/":  func(a, b float64) float64 { return a / b },
+	"%":  mod,
+	"^":  math.Pow,
+	"==": func(a, b float64) float64 { return truth(a == b) },
+	"!=": func(a, b float64) float64 { return truth(a != b) },
+	"<":  func(a, b float64) float64 { return truth(a < b) },
+	"<=": func(a, b float64) float64 { return truth(a <= b) },
+	">":  func(a, b float64) float64 { return truth(a > b) },
+	">=": func(a, b float64) float64 { return truth(a >= b) },
+	"&&": func(a, b float64) float64 { return truth(a != 0 && b != 0) },
+	"||": func(a, b float64) float64 { return truth(a != 0 || b != 0) },
+}
+
+// Functions.
+
+var (
+	errArgs   = errors.New("wrong number of arguments")
+	errNumber = errors.New("arguments must be numbers")
+)
+
+// mathFuncs take and return numbers.
+var mathFuncs = map[string]interface{}{
+	"sin":        math.Sin,
+	"cos":        math.Cos,
+	"tan":        math.Tan,
+	"asin":       math.Asin,
+	"acos":       math.Acos,
+	"atan":       math.Atan,
+	"sqrt":       math.Sqrt,
+	"exp":        math.Exp,
+	"log":        math.Log,
+	"abs":        math.Abs,
+	"floor":      math.Floor,
+	"ceil":       math.Ceil,
+	"round":      math.Round,
+	"fract":      func(x float64) float64 { return x - math.Floor(x) },
+	"tri":        triangle,
+	"rand":       func(x float64) float64 { return hash2(int64(math.Float64bits(x)), 0) },
+	"sign":       sign,
+	"atan2":      math.Atan2,
+	"pow":        math.Pow,
+	"mod":        mod,
+	"min":        math.Min,
+	"max":        math.Max,
+	"step":       func(edge, x float64) float64 { return truth(x >= edge) },
+	"clamp":      func(x, lo, hi float64) float64 { return math.Max(lo, math.Min(hi, x)) },
+	"smoothstep": func(a, b, x float64) float64 { return smooth(math.Max(0, math.Min(1, (x-a)/(b-a)))) },
+}
+
+var exprFuncs = map[string]func(args []exprNode) (exprNode, error){}
+
+func init() {
+	for name, f := range mathFuncs {
+		exprFuncs[name] = mathFunc(f)
+	}
+	exprFuncs["mix"] = mixFunc
+	exprFuncs["noise"] = noiseFunc
+	exprFuncs["rgb"] = rgbFunc
+	exprFuncs["hsv"] = hsvFunc
+	exprFuncs["palette"] = paletteFunc
+}
+
+// numbers returns the functions for args, if they're all numbers.
+func numbers(args []exprNode, n ...int) ([]func(e *exprEnv) float64, error) {
+	ok := false
+	for _, want := range n {
+		ok = ok || len(args) == want
+	}
+	if !ok {
+		return nil, errArgs
+	}
+
+	fs := make([]func(e *exprEnv) float64, len(args))
+	for i, a := range args {
+		if a.typ != numberType {
+			return nil, errNumber
+		}
+		fs[i] = a.num
+	}
+
+	return fs, nil
+}
+
+func mathFunc(f interface{}) func(args []exprNode) (exprNode, error) {
+	return func(args []exprNode) (exprNode, error) {
+		switch f := f.(type) {
+		case func(float64) float64:
+			a, err := numbers(args, 1)
+			if err != nil {
+				return exprNode{}, err
+			}
+			return numberNode(func(e *exprEnv) float64 { return f(a[0](e)) }), nil
+		case func(float64, float64) float64:
+			a, err := numbers(args, 2)
+			if err != nil {
+				return exprNode{}, err
+			}
+			return numberNode(func(e *exprEnv) float64 { return f(a[0](e), a[1](e)) }), nil
+		case func(float64, float64, float64) float64:
+			a, err := numbers(args, 3)
+			if err != nil {
+				return exprNode{}, err
+			}
+			return numberNode(func(e *exprEnv) float64 { return f(a[0](e), a[1](e), a[2](e)) }), nil
+		}
+		panic("unsupported math function")
+	}
+}
+
+// mixFunc blends numbers or colors: mix(a, b, f).
+func mixFunc(args []exprNode) (exprNode, error) {
+	if len(args) != 3 {
+		return exprNode{}, errArgs
+	}
+	if args[2].typ != numberType {
+		return exprNode{}, errors.New("the amount must be a number")
+	}
+	ff := args[2].num
+
+	switch {
+	case args[0].typ == stringType || args[1].typ == stringType:
+		return exprNode{}, errors.New("can't mix strings")
+	case args[0].typ == numberType && args[1].typ == numberType:
+		af, bf := args[0].num, args[1].num
+		return numberNode(func(e *exprEnv) float64 { return lerp(af(e), bf(e), ff(e)) }), nil
+	}
+
+	af, bf := args[0].asColor(), args[1].asColor()
+	return colorNode(func(e *exprEnv) rgbColor {
+		a, b, f := af(e), bf(e), ff(e)
+		return rgbColor{lerp(a[0], b[0], f), lerp(a[1], b[1], f), lerp(a[2], b[2], f)}
+	}), nil
+}
+
+func noiseFunc(args []exprNode) (exprNode, error) {
+	a, err := numbers(args, 1, 2, 3)
+	if err != nil {
+		return exprNode{}, err
+	}
+
+	switch len(a) {
+	case 1:
+		return numberNode(func(e *exprEnv) float64 { return noise2(a[0](e), 0) }), nil
+	case 2:
+		return numberNode(func(e *exprEnv) float64 { return noise2(a[0](e), a[1](e)) }), nil
+	}
+	return numberNode(func(e *exprEnv) float64 { return noise3(a[0](e), a[1](e), a[2](e)) }), nil
+}
+
+func rgbFunc(args []exprNode) (exprNode, error) {
+	a, err := numbers(args, 3)
+	if err != nil {
+		return exprNode{}, err
+	}
+
+	return colorNode(func(e *exprEnv) rgbColor { return rgbColor{a[0](e), a[1](e), a[2](e)} }), nil
+}
+
+func hsvFunc(args []exprNode) (exprNode, error) {
+	a, err := numbers(args, 3)
+	if err != nil {
+		return exprNode{}, err
+	}
+
+	return colorNode(func(e *exprEnv) rgbColor { return hsv(a[0](e), a[1](e), a[2](e)) }), nil
+}
+
+// paletteFunc looks up a color: palette("name", x).
+func paletteFunc(args []exprNode) (exprNode, error) {
+	if len(args) != 2 || args[0].typ != stringType || args[1].typ != numberType {
+		return exprNode{}, errors.New(`use palette("name", x)`)
+	}
+	pal, err := ParsePalette(args[0].str)
+	if err != nil {
+		return exprNode{}, err
+	}
+
+	xf := args[1].num
+	return colorNode(func(e *exprEnv) rgbColor {
+		x := xf(e)
+		c := &pal.loop[int(math.Floor(x*256))&0xff]
+		return rgbColor{float64(c[0]) / 255, float64(c[1]) / 255, float64(c[2]) / 255}
+	}), nil
+}
+
+func mod(a, b float64) float64 {
+	return a - b*math.Floor(a/b)
+}
+
+func sign(x float64) float64 {
+	switch {
+	case x > 0:
+		return 1
+	case x < 0:
+		return -1
+	}
+	return 0
+}
+
+// hsv converts a hue in turns, saturation and value from 0 to 1, to rgb.
+func hsv(h, s, v float64) rgbColor {
+	h = (h - math.Floor(h)) * 6
+	i := int(h) % 6
+	f := h - math.Floor(h)
+	p, q, t := v*(1-s), v*(1-s*f), v*(1-s*(1-f))
+
+	switch i {
+	case 0:
+		return rgbColor{v, t, p}
+	case 1:
+		return rgbColor{q, v, p}
+	case 2:
+		return rgbColor{p, v, t}
+	case 3:
+		return rgbColor{p, q, v}
+	case 4:
+		return rgbColor{t, p, v}
+	}
+	return rgbColor{v, p, q}
+}
+
+// noise3 returns smooth value noise from 0 to 1 at x, y, z.
+func noise3(x, y, z float64) float64 {
+	x0, y0, z0 := math.Floor(x), math.Floor(y), math.Floor(z)
+	fx, fy, fz := smooth(x-x0), smooth(y-y0), smooth(z-z0)
+	ix, iy, iz := int64(x0), int64(y0), int64(z0)
+
+	var plane [2]float64
+	for dz := range plane {
+		// Fold z into y for the hash, so each z has its own 2D noise.
+		y0 := (iz + int64(dz)) * 0x27d4eb2f165667c5
+		a := lerp(hash2(ix, iy^y0), hash2(ix+1, iy^y0), fx)
+		b := lerp(hash2(ix, (iy+1)^y0), hash2(ix+1, (iy+1)^y0), fx)
+		plane[dz] = lerp(a, b, fy)
+	}
+
+	return lerp(plane[0], plane[1], fz)
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrNoExpression = errors.New("current pattern isn't an expression")
+
+// ExpressionCommand runs a pixel expression, with an optional layout file
+// giving each pixel's x, y and z instead of the one in use, and any params
+// to change from their defaults.
+type ExpressionCommand struct {
+	Source string `json:"source"`
+	Layout string `json:"layout,omitempty"`
+	Params Params `json:"params,omitempty"`
+}
+
+// ExpressionState describes the expression that's playing.
+type ExpressionState struct {
+	Source string `json:"source"`
+	Layout string `json:"layout,omitempty"`
+	Params Params `json:"params"`
+}
+
+// Expression is a Renderer that colors each pixel with a compiled pixel
+// expression.
+type Expression struct {
+	mu     sync.Mutex
+	source string
+	expr   *Expr
+	layout string
+	points [][3]float64
+	env    *exprEnv
+	t      float64
+
+	// Current values of the expression's params.
+	values []float64
+	colors []rgbColor
+
+	out Frame
+}
+
+// NewExpression compiles ec's source and loads its layout.
+func NewExpression(ec *ExpressionCommand) (*Expression, error) {
+	expr, err := CompileExpr(ec.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	x := &Expression{
+		source: ec.Source,
+		expr:   expr,
+		layout: ec.Layout,
+		env:    expr.newEnv(),
+		values: make([]float64, len(expr.Params)),
+		colors: make([]rgbColor, len(expr.Params)),
+	}
+	if ec.Layout != "" {
+		l, err := layouts.Load(ec.Layout)
+		if err != nil {
+			return nil, err
+		}
+		x.points = l.Points
+	}
+
+	for i, ep := range expr.Params {
+		x.values[i] = ep.Default
+		if ep.Color {
+			x.colors[i], _ = hexColor(ep.Hex)
+		}
+	}
+	if err := x.SetParams(ec.Params); err != nil {
+		return nil, err
+	}
+
+	return x, nil
+}
+
+// hexColor parses a #rrggbb color into channels from 0 to 1.
+func hexColor(s string) (rgbColor, error) {
+	b, err := parseColor(s)
+	if err != nil {
+		return rgbColor{}, err
+	}
+
+	return rgbColor{float64(b[0]) / 255, float64(b[1]) / 255, float64(b[2]) / 255}, nil
+}
+
+// State returns the expression's source, layout and params.
+func (x *Expression) State() ExpressionState {
+	return ExpressionState{Source: x.source, Layout: x.layout, Params: x.Params()}
+}
+
+// follow carries on from old where the two have something in common: the
+// time, and the values of params with the same name and type.
+func (x *Expression) follow(old *Expression) {
+	old.mu.Lock()
+	defer old.mu.Unlock()
+
+	x.t = old.t
+	for i, ep := range x.expr.Params {
+		for j, op := range old.expr.Params {
+			if ep.Name == op.Name && ep.Color == op.Color {
+				x.values[i] = math.Max(ep.Min, math.Min(ep.Max, old.values[j]))
+				x.colors[i] = old.colors[j]
+			}
+		}
+	}
+}
+
+func (x *Expression) Render(fc *FrameContext) Frame {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	dt := fc.Delta.Seconds()
+	x.t += dt
+
+	e := x.env
+	e.nums[slotN] = float64(fc.Pixels)
+	e.nums[slotT] = x.t
+	e.nums[slotDT] = dt
+	e.nums[slotLevel] = fc.Audio.Level
+	e.nums[slotAmplitude] = fc.Audio.Amplitude
+	e.nums[slotVolts] = fc.Audio.Volts
+	for i, ep := range x.expr.Params {
+		if ep.Color {
+			e.colors[ep.slot] = x.colors[i]
+		} else {
+			e.nums[ep.slot] = x.values[i]
+		}
+	}
+
+	points := x.points
+	if x.layout == "" && fc.Layout != nil {
+		points = fc.Layout.Points
+	}
+
+	x.out = grow(x.out, fc.Pixels*3)
+	for i := 0; i < fc.Pixels; i++ {
+		e.nums[slotI] = float64(i)
+		if i < len(points) {
+			p := &points[i]
+			e.nums[slotX], e.nums[slotY], e.nums[slotZ] = p[0], p[1], p[2]
+		} else {
+			e.nums[slotX], e.nums[slotY], e.nums[slotZ] = float64(i), 0, 0
+		}
+
+		c := x.expr.pixel(e)
+		x.out[i*3], x.out[i*3+1], x.out[i*3+2] = channel(c[0]), channel(c[1]), channel(c[2])
+	}
+
+	return x.out
+}
+
+// channel converts v from 0 to 1 to a byte, clamping it.
+func channel(v float64) byte {
+	switch {
+	case v >= 1:
+		return 255
+	case v > 0:
+		return byte(v*255 + 0.5)
+	}
+	return 0 // Including NaN.
+}
+
+// Schema describes the params the expression declares.
+func (x *Expression) Schema() []ParamSpec {
+	schema := make([]ParamSpec, 0, len(x.expr.Params))
+	for _, ep := range x.expr.Params {
+		if ep.Color {
+			schema = append(schema, ParamSpec{Name: ep.Name, Type: ParamColor, Default: ep.Hex})
+		} else {
+			schema = append(schema, ParamSpec{Name: ep.Name, Type: ParamNumber, Default: ep.Default, Min: ep.Min, Max: ep.Max})
+		}
+	}
+
+	return schema
+}
+
+// Params returns the current values of the expression's params.
+func (x *Expression) Params() Params {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	p := Params{}
+	for i, ep := range x.expr.Params {
+		if ep.Color {
+			c := x.colors[i]
+			p[ep.Name] = fmt.Sprintf("#%02x%02x%02x", channel(c[0]), channel(c[1]), channel(c[2]))
+		} else {
+			p[ep.Name] = x.values[i]
+		}
+	}
+
+	return p
+}
+
+// SetParams changes any of the expression's params.
+func (x *Expression) SetParams(p Params) error {
+	names := make([]string, len(x.expr.Params))
+	for i, ep := range x.expr.Params {
+		names[i] = ep.Name
+	}
+	if err := p.only(names...); err != nil {
+		return err
+	}
+
+	// Check them all before changing any.
+	values := make([]*float64, len(x.expr.Params))
+	colors := make([]*rgbColor, len(x.expr.Params))
+	for i, ep := range x.expr.Params {
+		if ep.Color {
+			s, err := p.string(ep.Name)
+			if err != nil {
+				return err
+			}
+			if s == nil {
+				continue
+			}
+			c, err := hexColor(*s)
+			if err != nil {
+				return fmt.Errorf("%s %q: %w", ep.Name, *s, err)
+			}
+			colors[i] = &c
+			continue
+		}
+
+		v, err := p.float(ep.Name)
+		if err != nil {
+			return err
+		}
+		if v != nil && (*v < ep.Min || *v > ep.Max) {
+			return fmt.Errorf("%s %g must be >= %g and <= %g: %w", ep.Name, *v, ep.Min, ep.Max, ErrInvalidValue)
+		}
+		values[i] = v
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for i := range x.expr.Params {
+		if values[i] != nil {
+			x.values[i] = *values[i]
+		}
+		if colors[i] != nil {
+			x.colors[i] = *colors[i]
+		}
+	}
+
+	return nil
+}
+
+// Reset starts the expression over from time zero.
+func (x *Expression) Reset() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.t = 0
+}
+
+// Duration returns false, since expressions go on forever.
+func (x *Expression) Duration() (time.Duration, bool) {
+	return 0, false
+}
+
+func (x *Expression) Close() {
+}
+
+// expressionOf returns the Expression that r is playing, if any.
+func expressionOf(r Renderer) (*Expression, bool) {
+	switch f := r.(type) {
+	case *Transition:
+		return expressionOf(f.to)
+	case *Expression:
+		return f, true
+	}
+
+	return nil, false
+}
+
+// ExpressionHandler runs pixel expressions sent over the API or websocket,
+// and tells websocket clients whether they compiled.
+//
+//	GET  /api/expression   the playing expression's ExpressionState
+//	POST /api/expression   run an ExpressionCommand
+type ExpressionHandler struct {
+	Streamer *Streamer
+	Outgoing chan<- []byte
+}
+
+// Do compiles and plays ec, carrying on from the current expression if
+// there is one.
+func (h *ExpressionHandler) Do(ec *ExpressionCommand) (ExpressionState, error) {
+	x, err := h.start(ec)
+	h.report(err)
+	if err != nil {
+		return ExpressionState{}, err
+	}
+
+	return x.State(), nil
+}
+
+func (h *ExpressionHandler) start(ec *ExpressionCommand) (*Expression, error) {
+	x, err := NewExpression(ec)
+	if err != nil {
+		return nil, err
+	}
+
+	if old, ok := expressionOf(h.Streamer.Current()); ok {
+		x.follow(old)
+		if err := x.SetParams(ec.Params); err != nil {
+			return nil, err
+		}
+	}
+	h.Streamer.SetRenderer(x)
+
+	return x, nil
+}
+
+// report sends err, or an empty string if it's nil, to websocket clients.
+func (h *ExpressionHandler) report(err error) {
+	if h.Outgoing == nil {
+		return
+	}
+
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+	b, err := json.Marshal(struct {
+		Error string `json:"expression_error"`
+	}{msg})
+	if err != nil {
+		log.Println("Expression:", err)
+		return
+	}
+
+	h.Outgoing <- b
+}
+
+func (h *ExpressionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		x, ok := expressionOf(h.Streamer.Current())
+		if !ok {
+			http.Error(w, ErrNoExpression.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, x.State())
+	case http.MethodPost:
+		ec := &ExpressionCommand{}
+		if err := readJSON(r, ec); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		state, err := h.Do(ec)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, state)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
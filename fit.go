@@ -0,0 +1,233 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// How a pattern's rows are fitted to the strip when their widths differ.
+const (
+	FitTile    = "tile"
+	FitStretch = "stretch"
+	FitCenter  = "center"
+	FitMirror  = "mirror"
+	FitPlace   = "place"
+)
+
+// fitter maps image rows of any width onto the strip, as a pattern's
+// metadata asks.
+type fitter struct {
+	mode   string
+	offset int
+	span   []int
+
+	// Resampling table for stretch, for the last widths seen.
+	from, to int
+	starts   []int
+	taps     []tap
+}
+
+// tap is a source pixel and its weight out of 65536.
+type tap struct {
+	src, weight int
+}
+
+func newFitter(meta *PatternMeta) *fitter {
+	return &fitter{mode: meta.Fit, offset: meta.Offset, span: meta.Range}
+}
+
+// active returns true if the fitter does anything beyond the Sender's
+// usual tiling.
+func (ft *fitter) active() bool {
+	return (ft.mode != "" && ft.mode != FitTile) || len(ft.span) == 2
+}
+
+// fit writes src fitted to a strip of pixels into dst, and returns it.
+func (ft *fitter) fit(dst, src Frame, pixels int) Frame {
+	dst = grow(dst, pixels*3)
+
+	start, end := 0, pixels
+	if len(ft.span) == 2 {
+		start, end = clampInt(ft.span[0], 0, pixels), clampInt(ft.span[1], 0, pixels)
+	}
+	for i := range dst[:start*3] {
+		dst[i] = 0
+	}
+	for i := range dst[end*3:] {
+		dst[end*3+i] = 0
+	}
+
+	out := dst[start*3 : end*3]
+	w, n := len(src)/3, len(out)/3
+	if w == 0 || n == 0 {
+		for i := range out {
+			out[i] = 0
+		}
+		return dst
+	}
+	src = src[:w*3]
+
+	switch ft.mode {
+	case FitStretch:
+		ft.stretch(out, src, w, n)
+	case FitCenter:
+		place(out, src, (n-w)/2)
+	case FitPlace:
+		place(out, src, ft.offset)
+	case FitMirror:
+		for i := 0; i < n; i++ {
+			j := i % (2 * w)
+			if j >= w {
+				j = 2*w - 1 - j
+			}
+			copy(out[i*3:i*3+3], src[j*3:])
+		}
+	default:
+		for l := copy(out, src); l < len(out); {
+			l += copy(out[l:], out[:l])
+		}
+	}
+
+	return dst
+}
+
+// place copies src into out starting at pixel off, which may be negative
+// to crop src, and blacks out the rest.
+func place(out, src Frame, off int) {
+	for i := range out {
+		out[i] = 0
+	}
+	if off < 0 {
+		src = src[clampInt(-off*3, 0, len(src)):]
+		off = 0
+	}
+	if off*3 < len(out) {
+		copy(out[off*3:], src)
+	}
+}
+
+// stretch resamples a row of w pixels to n, interpolating when enlarging
+// and averaging when shrinking.
+func (ft *fitter) stretch(out, src Frame, w, n int) {
+	if ft.from != w || ft.to != n {
+		ft.buildTable(w, n)
+	}
+
+	for i := 0; i < n; i++ {
+		var r, g, b int
+		for _, t := range ft.taps[ft.starts[i]:ft.starts[i+1]] {
+			p := src[t.src*3:]
+			r += int(p[0]) * t.weight
+			g += int(p[1]) * t.weight
+			b += int(p[2]) * t.weight
+		}
+		out[i*3] = byte((r + 1<<15) >> 16)
+		out[i*3+1] = byte((g + 1<<15) >> 16)
+		out[i*3+2] = byte((b + 1<<15) >> 16)
+	}
+}
+
+// buildTable works out which source pixels, and how much of each, make up
+// each of n output pixels.
+func (ft *fitter) buildTable(w, n int) {
+	ft.from, ft.to = w, n
+	ft.starts = ft.starts[:0]
+	ft.taps = ft.taps[:0]
+
+	scale := float64(w) / float64(n)
+	for i := 0; i < n; i++ {
+		ft.starts = append(ft.starts, len(ft.taps))
+		first := len(ft.taps)
+
+		if w <= n {
+			// Linear interpolation between the two nearest pixels.
+			x := (float64(i)+0.5)*scale - 0.5
+			x0 := math.Floor(x)
+			t := int((x - x0) * 65536)
+			a := clampInt(int(x0), 0, w-1)
+			b := clampInt(int(x0)+1, 0, w-1)
+			ft.taps = append(ft.taps, tap{a, 65536 - t}, tap{b, t})
+		} else {
+			// Average of every pixel overlapping this one.
+			lo, hi := float64(i)*scale, float64(i+1)*scale
+			for j := int(lo); j < w && float64(j) < hi; j++ {
+				overlap := math.Min(hi, float64(j+1)) - math.Max(lo, float64(j))
+				ft.taps = append(ft.taps, tap{j, int(overlap / scale * 65536)})
+			}
+		}
+
+		// Make the weights sum to exactly one, so flat colors stay flat.
+		sum := 0
+		for _, t := range ft.taps[first:] {
+			sum += t.weight
+		}
+		ft.taps[len(ft.taps)-1].weight += 65536 - sum
+	}
+	ft.starts = append(ft.starts, len(ft.taps))
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// columnImage is an image transposed, so each of its rows is a column of
+// the original, for content authored in portrait.
+type columnImage struct {
+	pixels, rows int
+	pix          []byte
+}
+
+// transpose converts img to RGB, with its columns as rows.
+func transpose(img image.Image) *columnImage {
+	bounds := img.Bounds()
+	c := &columnImage{pixels: bounds.Dy(), rows: bounds.Dx()}
+	c.pix = make([]byte, c.pixels*c.rows*3)
+
+	var row Frame
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row = ImageRowToFrameInto(row, img, y)
+		o := (y - bounds.Min.Y) * 3
+		for x := 0; x < c.rows; x++ {
+			copy(c.pix[o:o+3], row[x*3:])
+			o += c.pixels * 3
+		}
+	}
+
+	return c
+}
+
+// Frame copies row n into dst, reusing its storage if possible.
+func (c *columnImage) Frame(dst []byte, n int) ([]byte, error) {
+	size := c.pixels * 3
+	if cap(dst) < size {
+		dst = make([]byte, size)
+	}
+	dst = dst[:size]
+	copy(dst, c.pix[n*size:])
+
+	return dst, nil
+}
+
+func (c *columnImage) ColorModel() color.Model {
+	return color.RGBAModel
+}
+
+func (c *columnImage) Bounds() image.Rectangle {
+	return image.Rect(0, 0, c.pixels, c.rows)
+}
+
+func (c *columnImage) At(x, y int) color.Color {
+	if x < 0 || x >= c.pixels || y < 0 || y >= c.rows {
+		return color.RGBA{}
+	}
+
+	p := c.pix[(y*c.pixels+x)*3:]
+	return color.RGBA{R: p[0], G: p[1], B: p[2], A: 0xff}
+}
@@ -5,6 +5,7 @@ import (
 	"image"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -12,29 +13,190 @@ var (
 	ErrInvalidOffset = errors.New("invalid pixel offset")
 )
 
+// Frame is a row of RGB pixels.
+//
+// Operations come in two forms: methods like Scale return a new Frame,
+// while methods like ScaleInto write their result to dst and return it,
+// reusing dst's storage if it has enough capacity.  dst may be the same
+// slice as either input.  Operations on two Frames repeat the shorter one
+// to the other's length, except that the Into forms, which must not
+// allocate, need them the same length already; sameSizeInto makes them so.
 type Frame []byte
 
+// grow returns f resized to n bytes, reusing its storage if possible.  The
+// contents are undefined.
+func grow(f Frame, n int) Frame {
+	if cap(f) >= n {
+		return f[:n]
+	}
+	return make(Frame, n)
+}
+
 // ImageRowToFrame copies an image.Image row to a Frame
 func ImageRowToFrame(img image.Image, y int) Frame {
+	return ImageRowToFrameInto(nil, img, y)
+}
+
+// ImageRowToFrameInto copies an image.Image row to dst.
+func ImageRowToFrameInto(dst Frame, img image.Image, y int) Frame {
 	bounds := img.Bounds()
 
 	width := bounds.Max.X - bounds.Min.X
-	f := make([]byte, width*3)
-
-	if y >= bounds.Min.Y && y < bounds.Max.Y {
-		o := 0
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, _ := img.At(x, y).RGBA()
-			f[o] = byte(r >> 8)
-			f[o+1] = byte(g >> 8)
-			f[o+2] = byte(b >> 8)
-			o += 3
+	f := grow(dst, width*3)
+
+	if y < bounds.Min.Y || y >= bounds.Max.Y {
+		for i := range f {
+			f[i] = 0
+		}
+		return f
+	}
+
+	// Going through img.At() allocates a color per pixel, so handle the
+	// types our decoders actually return directly.
+	switch img := img.(type) {
+	case *image.YCbCr:
+		if bounds.Min.X < 0 {
+			genericRow(f, img, y)
+		} else {
+			ycbcrRow(f, img, y)
 		}
+	case *image.RGBA:
+		rgbaRow(f, img.Pix[img.PixOffset(bounds.Min.X, y):])
+	case *image.NRGBA:
+		nrgbaRow(f, img.Pix[img.PixOffset(bounds.Min.X, y):])
+	case *image.Gray:
+		grayRow(f, img.Pix[img.PixOffset(bounds.Min.X, y):])
+	case *image.Paletted:
+		palettedRow(f, img, y)
+	case frameReader:
+		if _, err := img.Frame(f, y-bounds.Min.Y); err != nil {
+			genericRow(f, img, y)
+		}
+	default:
+		genericRow(f, img, y)
 	}
 
 	return f
 }
 
+// frameReader is an image that can decode a whole row at once, like an
+// anim.File.
+type frameReader interface {
+	image.Image
+	Frame(dst []byte, n int) ([]byte, error)
+}
+
+func genericRow(f Frame, img image.Image, y int) {
+	bounds := img.Bounds()
+	o := 0
+	for x := bounds.Min.X; x < bounds.Max.X; x++ {
+		r, g, b, _ := img.At(x, y).RGBA()
+		f[o] = byte(r >> 8)
+		f[o+1] = byte(g >> 8)
+		f[o+2] = byte(b >> 8)
+		o += 3
+	}
+}
+
+// ycbcrRow converts a row of YCbCr pixels the same way color.YCbCr.RGBA()
+// does.  It requires a non-negative Rect.Min.X.
+func ycbcrRow(f Frame, img *image.YCbCr, y int) {
+	// Log2 of how many pixels share each chroma sample horizontally.
+	shift := 0
+	switch img.SubsampleRatio {
+	case image.YCbCrSubsampleRatio422, image.YCbCrSubsampleRatio420:
+		shift = 1
+	case image.YCbCrSubsampleRatio411, image.YCbCrSubsampleRatio410:
+		shift = 2
+	}
+
+	minX := img.Rect.Min.X
+	width := img.Rect.Max.X - minX
+	ys := img.Y[img.YOffset(minX, y):][:width]
+	ci := img.COffset(minX, y)
+	cbs := img.Cb[ci:]
+	crs := img.Cr[ci:]
+
+	o := 0
+	for i, yv := range ys {
+		c := (minX+i)>>shift - minX>>shift
+		yy := int32(yv) * 0x10101
+		cb := int32(cbs[c]) - 128
+		cr := int32(crs[c]) - 128
+
+		f[o] = clampYCbCr(yy + 91881*cr)
+		f[o+1] = clampYCbCr(yy - 22554*cb - 46802*cr)
+		f[o+2] = clampYCbCr(yy + 116130*cb)
+		o += 3
+	}
+}
+
+// clampYCbCr returns the top byte of a 16.8 fixed point color channel,
+// clamped to 0-255.
+func clampYCbCr(v int32) byte {
+	if uint32(v)&0xff000000 == 0 {
+		return byte(v >> 16)
+	}
+	return byte(^(v >> 31))
+}
+
+// rgbaRow copies the color channels of premultiplied RGBA pixels.
+func rgbaRow(f Frame, pix []byte) {
+	for o, i := 0, 0; o < len(f); o, i = o+3, i+4 {
+		f[o] = pix[i]
+		f[o+1] = pix[i+1]
+		f[o+2] = pix[i+2]
+	}
+}
+
+// nrgbaRow premultiplies non-premultiplied RGBA pixels the same way
+// color.NRGBA.RGBA() does.
+func nrgbaRow(f Frame, pix []byte) {
+	for o, i := 0, 0; o < len(f); o, i = o+3, i+4 {
+		a := uint32(pix[i+3])
+		switch a {
+		case 0xff:
+			f[o] = pix[i]
+			f[o+1] = pix[i+1]
+			f[o+2] = pix[i+2]
+		case 0:
+			f[o], f[o+1], f[o+2] = 0, 0, 0
+		default:
+			a |= a << 8
+			for c := 0; c < 3; c++ {
+				v := uint32(pix[i+c])
+				v |= v << 8
+				f[o+c] = byte(v * a / 0xffff >> 8)
+			}
+		}
+	}
+}
+
+func grayRow(f Frame, pix []byte) {
+	for o, i := 0, 0; o < len(f); o, i = o+3, i+1 {
+		f[o] = pix[i]
+		f[o+1] = pix[i]
+		f[o+2] = pix[i]
+	}
+}
+
+// palettedRow looks up each pixel in a palette converted once per row.
+func palettedRow(f Frame, img *image.Paletted, y int) {
+	var palette [256][3]byte
+	for i, c := range img.Palette {
+		r, g, b, _ := c.RGBA()
+		palette[i] = [3]byte{byte(r >> 8), byte(g >> 8), byte(b >> 8)}
+	}
+
+	pix := img.Pix[img.PixOffset(img.Rect.Min.X, y):]
+	for o, i := 0, 0; o < len(f); o, i = o+3, i+1 {
+		p := &palette[pix[i]]
+		f[o] = p[0]
+		f[o+1] = p[1]
+		f[o+2] = p[2]
+	}
+}
+
 func PixelListToFrame(px int, pl string) (Frame, error) {
 	f := make([]byte, px*3)
 	o := 0
@@ -58,25 +220,34 @@ func PixelListToFrame(px int, pl string) (Frame, error) {
 // Resize makes sure we have exactly num pixels.  If not, repeat existing or
 // truncate.
 func (a Frame) Resize(num int) (Frame, error) {
+	if len(a) >= num {
+		return a.ResizeInto(a, num)
+	}
+	return a.ResizeInto(nil, num)
+}
+
+// ResizeInto copies a to dst, repeating or truncating it to num bytes.
+func (a Frame) ResizeInto(dst Frame, num int) (Frame, error) {
 	if len(a) == 0 {
 		return nil, ErrNoData
 	}
 
-	for {
-		l := num - len(a)
-		switch {
-		case l == 0:
-			return a, nil
-		case l < 0:
-			a = a[:num]
-			return a, nil
-		case l >= len(a):
-			l = len(a)
-		}
-		a = append(a, a[:l]...)
+	l := len(a)
+	if l > num {
+		l = num
+	}
+
+	dst = grow(dst, num)
+	copy(dst, a[:l])
+	for l < num {
+		l += copy(dst[l:], dst[:l])
 	}
+
+	return dst, nil
 }
 
+// SameSize repeats the shorter of a and b to the length of the other,
+// allocating if they differ.
 func SameSize(a, b Frame) (Frame, Frame, error) {
 	l := len(a)
 	if l < len(b) {
@@ -93,86 +264,248 @@ func SameSize(a, b Frame) (Frame, Frame, error) {
 	return a, b, nil
 }
 
+// sameSizeInto is SameSize, but repeats the shorter of a and b into buf,
+// which it returns too, possibly reallocated.
+func sameSizeInto(buf, a, b Frame) (Frame, Frame, Frame) {
+	switch {
+	case len(a) == len(b) || len(a) == 0 || len(b) == 0:
+	case len(a) < len(b):
+		buf, _ = a.ResizeInto(buf, len(b))
+		a = buf
+	default:
+		buf, _ = b.ResizeInto(buf, len(a))
+		b = buf
+	}
+
+	return buf, a, b
+}
+
 // Scale multiplies each byte by (mult/256)
 func (a Frame) Scale(mult int) Frame {
-	l := len(a)
-	f := make(Frame, l)
-	for i := 0; i < l; i++ {
-		p := (int(a[i])*mult + 128) / 256
+	return a.ScaleInto(nil, mult)
+}
+
+// scaleLUTs[mult][v] is v scaled by (mult/256), for the usual mults.
+var scaleLUTs = func() *[257][256]byte {
+	luts := &[257][256]byte{}
+	for mult := range luts {
+		luts[mult] = scaleLUT(mult)
+	}
+	return luts
+}()
+
+// scaleLUT returns a table of each byte scaled by (mult/256).
+func scaleLUT(mult int) [256]byte {
+	var lut [256]byte
+	for i := range lut {
+		p := (i*mult + 128) / 256
 		if p > 255 {
 			p = 255
 		}
-		f[i] = byte(p)
+		lut[i] = byte(p)
+	}
+	return lut
+}
+
+// ScaleInto multiplies each byte of a by (mult/256) into dst.
+func (a Frame) ScaleInto(dst Frame, mult int) Frame {
+	var lut *[256]byte
+	if mult >= 0 && mult < len(scaleLUTs) {
+		lut = &scaleLUTs[mult]
+	} else {
+		l := scaleLUT(mult)
+		lut = &l
 	}
 
-	return f
+	dst = grow(dst, len(a))
+	for i, v := range a {
+		dst[i] = lut[v]
+	}
+
+	return dst
 }
 
 // Add the RGB values of a and b
 func (a Frame) Add(b Frame) Frame {
-	a, b, err := SameSize(a, b)
-	if err != nil {
+	a, b, _ = SameSize(a, b)
+	return a.AddInto(nil, b)
+}
+
+// AddInto adds the RGB values of a and b, which must be the same length,
+// into dst.
+func (a Frame) AddInto(dst, b Frame) Frame {
+	if len(a) != len(b) || len(a) == 0 {
 		return nil
 	}
 
-	l := len(a)
-	f := make(Frame, l)
-	for i := 0; i < l; i++ {
+	dst = grow(dst, len(a))
+	for i := range dst {
 		p := int(a[i]) + int(b[i])
 		if p > 255 {
 			p = 255
 		}
-		f[i] = byte(p)
+		dst[i] = byte(p)
 	}
 
-	return f
+	return dst
 }
 
 // Merge keeps the brighter of each RGB pixel from a or b
 func (a Frame) Merge(b Frame) Frame {
-	a, b, err := SameSize(a, b)
-	if err != nil {
+	a, b, _ = SameSize(a, b)
+	return a.MergeInto(nil, b)
+}
+
+// MergeInto keeps the brighter of each RGB pixel from a or b, which must be
+// the same length, in dst.
+func (a Frame) MergeInto(dst, b Frame) Frame {
+	if len(a) != len(b) || len(a) == 0 {
 		return nil
 	}
 
-	l := len(a)
-	f := make(Frame, l)
-	for i := 0; i+2 < l; i += 3 {
+	dst = grow(dst, len(a))
+	for i := 0; i+2 < len(dst); i += 3 {
 		av := int(a[i]) + int(a[i+1]) + int(a[i+2])
 		bv := int(b[i]) + int(b[i+1]) + int(b[i+2])
 		if av > bv {
-			f[i] = a[i]
-			f[i+1] = a[i+1]
-			f[i+2] = a[i+2]
+			dst[i], dst[i+1], dst[i+2] = a[i], a[i+1], a[i+2]
 		} else {
-			f[i] = b[i]
-			f[i+1] = b[i+1]
-			f[i+2] = b[i+2]
+			dst[i], dst[i+1], dst[i+2] = b[i], b[i+1], b[i+2]
+		}
+	}
+	if n := len(dst) % 3; n > 0 {
+		// Merge never set the trailing partial pixel.
+		for i := len(dst) - n; i < len(dst); i++ {
+			dst[i] = 0
 		}
 	}
 
-	return f
+	return dst
 }
 
+// multLUT[a][b] is a*b/255.
+var multLUT = func() *[256][256]byte {
+	lut := &[256][256]byte{}
+	for a := range lut {
+		for b := range lut[a] {
+			lut[a][b] = byte(a * b / 255)
+		}
+	}
+	return lut
+}()
+
 // Mult multiplies each pixel of a with b
 func (a Frame) Mult(b Frame) Frame {
-	a, b, err := SameSize(a, b)
-	if err != nil {
+	a, b, _ = SameSize(a, b)
+	return a.MultInto(nil, b)
+}
+
+// MultInto multiplies each pixel of a with b, which must be the same
+// length, into dst.
+func (a Frame) MultInto(dst, b Frame) Frame {
+	if len(a) != len(b) || len(a) == 0 {
 		return nil
 	}
 
-	l := len(a)
-	f := make(Frame, l)
-	for i := 0; i < l; i++ {
-		f[i] = byte((int(a[i]) * int(b[i])) / 255)
+	dst = grow(dst, len(a))
+	for i := range dst {
+		dst[i] = multLUT[a[i]][b[i]]
 	}
 
-	return f
+	return dst
+}
+
+// Screen inverts a and b, multiplies them, and inverts the result, which
+// brightens like Add without clipping.
+func (a Frame) Screen(b Frame) Frame {
+	a, b, _ = SameSize(a, b)
+	return a.ScreenInto(nil, b)
+}
+
+// ScreenInto screens a and b, which must be the same length, into dst.
+func (a Frame) ScreenInto(dst, b Frame) Frame {
+	if len(a) != len(b) || len(a) == 0 {
+		return nil
+	}
+
+	dst = grow(dst, len(a))
+	for i := range dst {
+		dst[i] = 255 - multLUT[255-a[i]][255-b[i]]
+	}
+
+	return dst
+}
+
+// Lerp moves each byte of a towards b by (t/256)
+func (a Frame) Lerp(b Frame, t int) Frame {
+	a, b, _ = SameSize(a, b)
+	return a.LerpInto(nil, b, t)
+}
+
+// LerpInto moves each byte of a towards b, which must be the same length,
+// by (t/256), into dst.
+func (a Frame) LerpInto(dst, b Frame, t int) Frame {
+	if len(a) != len(b) || len(a) == 0 {
+		return nil
+	}
+
+	dst = grow(dst, len(a))
+	for i := range dst {
+		dst[i] = byte((int(a[i])*(256-t) + int(b[i])*t + 128) / 256)
+	}
+
+	return dst
 }
 
-func (a Frame) NextFrame() Frame {
+// FramePool recycles Frame buffers.  A nil FramePool just allocates.
+type FramePool chan Frame
+
+// NewFramePool returns a FramePool that keeps up to size spare Frames.
+func NewFramePool(size int) FramePool {
+	return make(FramePool, size)
+}
+
+// Get returns a Frame of n bytes, with undefined contents.
+func (p FramePool) Get(n int) Frame {
+	select {
+	case f := <-p:
+		return grow(f, n)
+	default:
+		return make(Frame, n)
+	}
+}
+
+// Put returns a Frame to the pool.  The caller must not use it afterwards.
+func (p FramePool) Put(f Frame) {
+	select {
+	case p <- f:
+	default:
+	}
+}
+
+// Render returns the Frame itself, so a fixed Frame can be played.
+func (a Frame) Render(*FrameContext) Frame {
 	return a
 }
 
+func (a Frame) Schema() []ParamSpec {
+	return nil
+}
+
+func (a Frame) Params() Params {
+	return Params{}
+}
+
+func (a Frame) SetParams(p Params) error {
+	return noParams(p)
+}
+
+func (a Frame) Reset() {
+}
+
+func (a Frame) Duration() (time.Duration, bool) {
+	return 0, false
+}
+
 func (a Frame) Close() {
 }
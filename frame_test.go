@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"io/ioutil"
+	"testing"
+)
+
+// benchWidth is a typical pattern width.
+const benchWidth = 2448
+
+// genericImage hides an image's type, so ImageRowToFrame takes the generic
+// path.
+type genericImage struct {
+	image.Image
+}
+
+type benchImage struct {
+	name string
+	img  image.Image
+}
+
+func benchImages() []benchImage {
+	r := image.Rect(0, 0, benchWidth, 2)
+
+	ycbcr := image.NewYCbCr(r, image.YCbCrSubsampleRatio420)
+	for i := range ycbcr.Y {
+		ycbcr.Y[i] = byte(i)
+	}
+	for i := range ycbcr.Cb {
+		ycbcr.Cb[i] = byte(i * 3)
+		ycbcr.Cr[i] = byte(i * 7)
+	}
+
+	rgba := image.NewRGBA(r)
+	nrgba := image.NewNRGBA(r)
+	for i := range rgba.Pix {
+		rgba.Pix[i] = byte(i)
+		nrgba.Pix[i] = byte(i * 5)
+	}
+
+	paletted := image.NewPaletted(r, color.Palette(palette.Plan9))
+	for i := range paletted.Pix {
+		paletted.Pix[i] = byte(i)
+	}
+
+	return []benchImage{
+		{"YCbCr", ycbcr},
+		{"RGBA", rgba},
+		{"NRGBA", nrgba},
+		{"Paletted", paletted},
+	}
+}
+
+// testImages returns images of each type ImageRowToFrame has a fast path
+// for, filled with varied pixels, with their bounds starting at min.
+func testImages(min image.Point) []benchImage {
+	r := image.Rectangle{min, min.Add(image.Pt(13, 5))}
+
+	imgs := []benchImage{}
+	for _, ratio := range []struct {
+		name  string
+		ratio image.YCbCrSubsampleRatio
+	}{
+		{"YCbCr444", image.YCbCrSubsampleRatio444},
+		{"YCbCr422", image.YCbCrSubsampleRatio422},
+		{"YCbCr420", image.YCbCrSubsampleRatio420},
+	} {
+		img := image.NewYCbCr(r, ratio.ratio)
+		for i := range img.Y {
+			img.Y[i] = byte(i * 37)
+		}
+		for i := range img.Cb {
+			img.Cb[i] = byte(i * 53)
+			img.Cr[i] = byte(255 - i*29)
+		}
+		imgs = append(imgs, benchImage{ratio.name, img})
+	}
+
+	rgba := image.NewRGBA(r)
+	nrgba := image.NewNRGBA(r)
+	gray := image.NewGray(r)
+	paletted := image.NewPaletted(r, color.Palette(palette.Plan9))
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			v := x*31 + y*17
+			rgba.Set(x, y, color.RGBA{byte(v), byte(v * 3), byte(v * 7), 255})
+			// Alpha runs through 0, 255, and partial values.
+			nrgba.Set(x, y, color.NRGBA{byte(v * 5), byte(v * 11), byte(v * 13), byte(v * 41)})
+			gray.Set(x, y, color.Gray{byte(v)})
+			paletted.SetColorIndex(x, y, byte(v))
+		}
+	}
+
+	return append(imgs,
+		benchImage{"RGBA", rgba},
+		benchImage{"NRGBA", nrgba},
+		benchImage{"Gray", gray},
+		benchImage{"Paletted", paletted},
+	)
+}
+
+func TestImageRowToFrame(t *testing.T) {
+	for _, min := range []image.Point{{0, 0}, {3, 2}, {-5, -1}} {
+		for _, ti := range testImages(min) {
+			bounds := ti.img.Bounds()
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				want := make(Frame, bounds.Dx()*3)
+				genericRow(want, ti.img, y)
+
+				if got := ImageRowToFrame(ti.img, y); !bytes.Equal(got, want) {
+					t.Errorf("%s at %v, row %d: got %v, want %v", ti.name, min, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkImageRowToFrame(b *testing.B) {
+	for _, bi := range benchImages() {
+		for _, path := range []benchImage{
+			{"fast", bi.img},
+			{"generic", genericImage{bi.img}},
+		} {
+			path := path
+			b.Run(bi.name+"/"+path.name, func(b *testing.B) {
+				f := make(Frame, benchWidth*3)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					f = ImageRowToFrameInto(f, path.img, 1)
+				}
+			})
+		}
+	}
+}
+
+func benchFrame(n int) Frame {
+	f := make(Frame, n)
+	for i := range f {
+		f[i] = byte(i * 7)
+	}
+	return f
+}
+
+func BenchmarkScaleInto(b *testing.B) {
+	a := benchFrame(benchWidth * 3)
+	dst := make(Frame, len(a))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dst = a.ScaleInto(dst, 100)
+	}
+}
+
+func BenchmarkMergeInto(b *testing.B) {
+	a, c := benchFrame(benchWidth*3), benchFrame(benchWidth*3)
+	c.ScaleInto(c, 200)
+	dst := make(Frame, len(a))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dst = a.MergeInto(dst, c)
+	}
+}
+
+func BenchmarkSendFrame(b *testing.B) {
+	s := &Sender{NumPixels: benchWidth * 3, ColorFilter: benchFrame(benchWidth * 3)}
+	f := benchFrame(benchWidth * 3)
+	_ = s.sendFrame(ioutil.Discard, f)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := s.sendFrame(ioutil.Discard, f); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkCompositor blends a single color layer, which has to be
+// repeated to the strip's length, onto a pattern.
+func BenchmarkCompositor(b *testing.B) {
+	c := &Compositor{}
+	opacity := 128
+	c.layers = []*layer{
+		{LayerSpec: LayerSpec{ID: "pattern"}, renderer: benchFrame(benchWidth * 3)},
+		{LayerSpec: LayerSpec{ID: "color", Blend: BlendMultiply, Opacity: &opacity}, renderer: Frame{255, 128, 0}},
+	}
+	fc := &FrameContext{Pixels: benchWidth}
+	c.Render(fc)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Render(fc)
+	}
+}
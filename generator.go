@@ -0,0 +1,574 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Generator names.
+const (
+	GenRainbow = "rainbow"
+	GenPlasma  = "plasma"
+	GenFire    = "fire"
+	GenTwinkle = "twinkle"
+	GenComet   = "comet"
+	GenBreathe = "breathe"
+	GenNoise   = "noise"
+	GenWaves   = "waves"
+	GenRipple  = "ripple"
+	GenSweep   = "sweep"
+)
+
+var (
+	ErrUnknownGenerator = errors.New("no such generator")
+	ErrNoGenerator      = errors.New("current pattern isn't a generator")
+)
+
+// GeneratorParams adjust how a Generator looks.  Speed and Scale are
+// multipliers of the generator's natural pace and feature size.  Density
+// is from 0 to 1: how much of the strip is lit, or for sparks, twinkles
+// and comets, how many there are.
+type GeneratorParams struct {
+	Speed   float64 `json:"speed"`
+	Palette string  `json:"palette"`
+	Density float64 `json:"density"`
+	Scale   float64 `json:"scale"`
+}
+
+// generator is a built-in generator's defaults and renderer.
+type generator struct {
+	defaults GeneratorParams
+	render   func(g *Generator, out Frame)
+}
+
+var generators = map[string]generator{
+	GenRainbow: {GeneratorParams{1, "rainbow", 1, 1}, renderRainbow},
+	GenPlasma:  {GeneratorParams{1, "party", 1, 1}, renderPlasma},
+	GenFire:    {GeneratorParams{1, "heat", 0.5, 1}, renderFire},
+	GenTwinkle: {GeneratorParams{1, "party", 0.3, 1}, renderTwinkle},
+	GenComet:   {GeneratorParams{1, "rainbow", 0.2, 1}, renderComet},
+	GenBreathe: {GeneratorParams{1, "ocean", 0.8, 1}, renderBreathe},
+	GenNoise:   {GeneratorParams{1, "lava", 1, 1}, renderNoise},
+	GenWaves:   {GeneratorParams{1, "ocean", 1, 1}, renderWaves},
+	GenRipple:  {GeneratorParams{1, "ocean", 0.8, 1}, renderRipple},
+	GenSweep:   {GeneratorParams{1, "forest", 0.3, 1}, renderSweep},
+}
+
+// GeneratorNames returns the names of the built-in generators, sorted.
+func GeneratorNames() []string {
+	names := make([]string, 0, len(generators))
+	for name := range generators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// GeneratorCommand selects a generator, or changes the running one's
+// params.  Unset fields are left alone, or take the generator's defaults
+// when starting a new one.
+type GeneratorCommand struct {
+	Name    string   `json:"name,omitempty"`
+	Speed   *float64 `json:"speed,omitempty"`
+	Palette *string  `json:"palette,omitempty"`
+	Density *float64 `json:"density,omitempty"`
+	Scale   *float64 `json:"scale,omitempty"`
+}
+
+func (gc *GeneratorCommand) Validate() error {
+	if _, ok := generators[gc.Name]; gc.Name != "" && !ok {
+		return fmt.Errorf("%q: %w", gc.Name, ErrUnknownGenerator)
+	}
+	if gc.Speed != nil && (*gc.Speed <= 0 || *gc.Speed > 100) {
+		return fmt.Errorf("speed %g must be > 0 and <= 100: %w", *gc.Speed, ErrInvalidValue)
+	}
+	if gc.Palette != nil {
+		if _, err := ParsePalette(*gc.Palette); err != nil {
+			return err
+		}
+	}
+	if gc.Density != nil && (*gc.Density < 0 || *gc.Density > 1) {
+		return fmt.Errorf("density %g must be >= 0 and <= 1: %w", *gc.Density, ErrInvalidValue)
+	}
+	if gc.Scale != nil && (*gc.Scale < 0.01 || *gc.Scale > 100) {
+		return fmt.Errorf("scale %g must be >= 0.01 and <= 100: %w", *gc.Scale, ErrInvalidValue)
+	}
+
+	return nil
+}
+
+// Generator is a Renderer that draws a pattern in real time, rather than
+// playing images.
+type Generator struct {
+	mu      sync.Mutex
+	name    string
+	params  GeneratorParams
+	palette *Palette
+	render  func(g *Generator, out Frame)
+	rng     *rand.Rand
+
+	// Where each pixel is, for generators drawn in space rather than
+	// along the strip.
+	layout *Layout
+
+	// Seconds of pattern time so far, and in this frame, both scaled by
+	// speed.
+	t, dt float64
+
+	// State kept between frames by some generators.
+	level, hue []float64
+	comets     []comet
+	steps      float64
+
+	out Frame
+}
+
+// comet is a bright head with a fading tail, chasing along the strip.
+type comet struct {
+	pos, speed, hue float64
+}
+
+// NewGenerator starts the named generator with gc's params.
+func NewGenerator(gc *GeneratorCommand) (*Generator, error) {
+	if err := gc.Validate(); err != nil {
+		return nil, err
+	}
+	gen, ok := generators[gc.Name]
+	if !ok {
+		return nil, fmt.Errorf("%q: %w", gc.Name, ErrUnknownGenerator)
+	}
+
+	g := &Generator{
+		name:   gc.Name,
+		params: gen.defaults,
+		render: gen.render,
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	g.palette, _ = ParsePalette(g.params.Palette)
+	g.set(gc)
+
+	return g, nil
+}
+
+// Set changes the generator's params, leaving any unset ones alone.
+func (g *Generator) Set(gc *GeneratorCommand) (GeneratorParams, error) {
+	if err := gc.Validate(); err != nil {
+		return GeneratorParams{}, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.set(gc)
+
+	return g.params, nil
+}
+
+func (g *Generator) set(gc *GeneratorCommand) {
+	if gc.Speed != nil {
+		g.params.Speed = *gc.Speed
+	}
+	if gc.Palette != nil {
+		g.params.Palette = *gc.Palette
+		g.palette, _ = ParsePalette(*gc.Palette)
+	}
+	if gc.Density != nil {
+		g.params.Density = *gc.Density
+	}
+	if gc.Scale != nil {
+		g.params.Scale = *gc.Scale
+	}
+}
+
+// Name returns which generator this is.
+func (g *Generator) Name() string {
+	return g.name
+}
+
+func (g *Generator) Render(fc *FrameContext) Frame {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.dt = fc.Delta.Seconds() * g.params.Speed
+	g.t += g.dt
+	g.layout = fc.Layout
+	g.out = grow(g.out, fc.Pixels*3)
+	g.render(g, g.out)
+
+	return g.out
+}
+
+// Schema describes the generator's params.
+func (g *Generator) Schema() []ParamSpec {
+	def := generators[g.name].defaults
+
+	return []ParamSpec{
+		speedSpec(def.Speed),
+		{Name: "palette", Type: ParamEnum, Default: def.Palette, Enum: PaletteNames()},
+		{Name: "density", Type: ParamNumber, Default: def.Density, Min: 0, Max: 1, Step: 0.01},
+		{Name: "scale", Type: ParamNumber, Default: def.Scale, Min: 0.01, Max: 100, Log: true, Units: "x"},
+	}
+}
+
+// Params returns the generator's params.
+func (g *Generator) Params() Params {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return Params{
+		"speed":   g.params.Speed,
+		"palette": g.params.Palette,
+		"density": g.params.Density,
+		"scale":   g.params.Scale,
+	}
+}
+
+// SetParams changes any of the generator's params.
+func (g *Generator) SetParams(p Params) error {
+	if err := p.only("speed", "palette", "density", "scale"); err != nil {
+		return err
+	}
+
+	gc := &GeneratorCommand{}
+	var err error
+	if gc.Speed, err = p.float("speed"); err != nil {
+		return err
+	}
+	if gc.Palette, err = p.string("palette"); err != nil {
+		return err
+	}
+	if gc.Density, err = p.float("density"); err != nil {
+		return err
+	}
+	if gc.Scale, err = p.float("scale"); err != nil {
+		return err
+	}
+
+	_, err = g.Set(gc)
+	return err
+}
+
+// Reset starts the generator over from time zero, with no sparks, twinkles
+// or comets.
+func (g *Generator) Reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.t, g.steps = 0, 0
+	g.level, g.hue, g.comets = g.level[:0], g.hue[:0], g.comets[:0]
+}
+
+// Duration returns false, since generators go on forever.
+func (g *Generator) Duration() (time.Duration, bool) {
+	return 0, false
+}
+
+func (g *Generator) Close() {
+}
+
+// size is the generator's feature size in pixels.
+func (g *Generator) size() float64 {
+	return 64 * g.params.Scale
+}
+
+// lit returns how brightly, out of 256, to show a point whose value v is
+// from 0 to 1, so that more of the strip is lit as density goes up.
+func lit(v, density float64) int {
+	b := (v-(1-density))/0.15 + 1
+	switch {
+	case b <= 0:
+		return 0
+	case b >= 1:
+		return 256
+	}
+
+	return int(b * 256)
+}
+
+// triangle maps x to a wave going from 0 up to 1 and back every 1.
+func triangle(x float64) float64 {
+	return 1 - math.Abs(2*(x-math.Floor(x))-1)
+}
+
+// renderRainbow scrolls the palette along the strip, in bands separated
+// by gaps as density goes down.
+func renderRainbow(g *Generator, out Frame) {
+	size := g.size()
+	for i := 0; i < len(out)/3; i++ {
+		x := float64(i) / size
+		v := lit(triangle(x/4-g.t*0.125), g.params.Density)
+		out[i*3], out[i*3+1], out[i*3+2] = g.palette.at(x/4-g.t*0.25, v)
+	}
+}
+
+// renderPlasma mixes several moving sine waves.
+func renderPlasma(g *Generator, out Frame) {
+	size, t := g.size(), g.t
+	for i := 0; i < len(out)/3; i++ {
+		x := float64(i) / size
+		v := math.Sin(x*1.3+t) + math.Sin(x*0.7-t*1.3) + math.Sin(x*2.1+t*0.7+math.Sin(x*0.4+t))
+		v = (v/3 + 1) / 2
+		out[i*3], out[i*3+1], out[i*3+2] = g.palette.at(v+t*0.05, lit(v, g.params.Density))
+	}
+}
+
+// renderFire runs a classic 1D fire simulation in flames of size pixels:
+// sparks at the base of each heat up, rise, and cool.  Density is how
+// often sparks fly.
+func renderFire(g *Generator, out Frame) {
+	n := len(out) / 3
+	g.level = resize(g.level, n)
+	flame := clampInt(int(g.size()), 8, n)
+
+	// The simulation runs at 60 steps a second, whatever the frame rate.
+	g.steps += g.dt * 60
+	cool := (550/float64(flame) + 2) / 255
+	for ; g.steps >= 1; g.steps-- {
+		for base := 0; base < n; base += flame {
+			heat := g.level[base:clampInt(base+flame, 0, n)]
+			for i := range heat {
+				heat[i] = math.Max(0, heat[i]-g.rng.Float64()*cool)
+			}
+			for i := len(heat) - 1; i >= 2; i-- {
+				heat[i] = (heat[i-1] + 2*heat[i-2]) / 3
+			}
+			if g.rng.Float64() < g.params.Density {
+				i := g.rng.Intn(clampInt(len(heat)/8, 1, len(heat)))
+				heat[i] = math.Min(1, heat[i]+0.6+g.rng.Float64()*0.4)
+			}
+		}
+	}
+
+	for i, h := range g.level {
+		out[i*3], out[i*3+1], out[i*3+2] = g.palette.heat(h, 256)
+	}
+}
+
+// renderTwinkle lights random spots of scale pixels that fade up and back
+// down, each in a random palette color.
+func renderTwinkle(g *Generator, out Frame) {
+	n := len(out) / 3
+	width := clampInt(int(math.Round(g.params.Scale)), 1, n)
+	cells := (n + width - 1) / width
+	g.level = resize(g.level, cells)
+	g.hue = resize(g.hue, cells)
+
+	// Each twinkle lasts a second; start enough of them that about
+	// density of the strip is lit.
+	d := g.params.Density
+	start := g.dt * d / math.Max(1-d, 0.01)
+	for i, l := range g.level {
+		switch {
+		case l > 0:
+			l += g.dt
+			if l >= 1 {
+				l = 0
+			}
+		case g.rng.Float64() < start:
+			l = math.SmallestNonzeroFloat64
+			g.hue[i] = g.rng.Float64()
+		}
+		g.level[i] = l
+	}
+
+	for i := 0; i < n; i++ {
+		c := i / width
+		v := int(math.Sin(g.level[c]*math.Pi) * 256)
+		out[i*3], out[i*3+1], out[i*3+2] = g.palette.at(g.hue[c], v)
+	}
+}
+
+// renderComet chases comets along the strip, with tails of 16 * scale
+// pixels.  Density is how many there are.
+func renderComet(g *Generator, out Frame) {
+	n := len(out) / 3
+	if n == 0 {
+		return
+	}
+	want := clampInt(int(g.params.Density*float64(n)/40+0.5), 1, n)
+	for len(g.comets) < want {
+		g.comets = append(g.comets, comet{
+			pos:   g.rng.Float64() * float64(n),
+			speed: 60 + g.rng.Float64()*60,
+			hue:   g.rng.Float64(),
+		})
+	}
+	g.comets = g.comets[:want]
+
+	for i := range out {
+		out[i] = 0
+	}
+
+	tail := math.Max(1, 16*g.params.Scale)
+	for i := range g.comets {
+		c := &g.comets[i]
+		c.pos = math.Mod(c.pos+c.speed*g.dt, float64(n))
+		for k := 0; float64(k) < tail; k++ {
+			f := 1 - float64(k)/tail
+			p := (int(c.pos) - k + n) % n
+			r, gr, b := g.palette.at(c.hue+float64(k)/tail*0.1, int(f*f*256))
+			o := out[p*3 : p*3+3]
+			o[0], o[1], o[2] = maxByte(o[0], r), maxByte(o[1], gr), maxByte(o[2], b)
+		}
+	}
+}
+
+// renderBreathe slowly fades the whole strip up and down, dimming further
+// as density goes up.
+func renderBreathe(g *Generator, out Frame) {
+	// A breath every four seconds, lingering at the bottom.
+	breath := (math.Exp(math.Sin(g.t*math.Pi/2)) - 1/math.E) / (math.E - 1/math.E)
+	v := int((1 - g.params.Density*(1-breath)) * 256)
+
+	size := g.size()
+	for i := 0; i < len(out)/3; i++ {
+		out[i*3], out[i*3+1], out[i*3+2] = g.palette.at(float64(i)/(size*8)+g.t*0.02, v)
+	}
+}
+
+// renderNoise drifts through smooth random noise.
+func renderNoise(g *Generator, out Frame) {
+	size, t := g.size(), g.t*0.5
+	for i := 0; i < len(out)/3; i++ {
+		x := float64(i) / size
+		v := noise2(x, t)*0.6 + noise2(x*2+17, t*1.7)*0.3 + noise2(x*4+41, t*2.9)*0.1
+		out[i*3], out[i*3+1], out[i*3+2] = g.palette.at(v, lit(v, g.params.Density))
+	}
+}
+
+// renderWaves rolls waves of brightness through a slowly shifting palette.
+func renderWaves(g *Generator, out Frame) {
+	size, t := g.size(), g.t
+	for i := 0; i < len(out)/3; i++ {
+		x := float64(i) / size
+		hue := x*0.25 + t*0.05 + 0.2*math.Sin(x*0.5+t*0.3)
+		v := 0.5 + 0.5*math.Sin((x-t*0.5)*math.Pi)
+		v *= 0.5 + 0.5*math.Sin((x*0.37+t*0.23)*math.Pi)
+		out[i*3], out[i*3+1], out[i*3+2] = g.palette.at(hue, lit(math.Sqrt(v), g.params.Density))
+	}
+}
+
+// renderRipple sends rings out from the middle of the layout, eight across
+// it at scale 1.
+func renderRipple(g *Generator, out Frame) {
+	for i := 0; i < len(out)/3; i++ {
+		p := g.layout.Unit(i)
+		d := math.Sqrt((p[0]-0.5)*(p[0]-0.5) + (p[1]-0.5)*(p[1]-0.5) + (p[2]-0.5)*(p[2]-0.5))
+		x := d * 16 / g.params.Scale
+		v := 0.5 + 0.5*math.Cos((x-g.t)*math.Pi)
+		out[i*3], out[i*3+1], out[i*3+2] = g.palette.at(x/16-g.t*0.05, lit(v, g.params.Density))
+	}
+}
+
+// renderSweep turns round beams about the middle of the layout, like
+// radar, each trailing off over density of a turn.  Scale is how many
+// beams there are.
+func renderSweep(g *Generator, out Frame) {
+	beams := math.Max(1, math.Round(g.params.Scale))
+	trail := math.Max(g.params.Density, 0.01)
+	for i := 0; i < len(out)/3; i++ {
+		p := g.layout.Unit(i)
+		turn := math.Atan2(p[1]-0.5, p[0]-0.5) / (2 * math.Pi)
+		behind := (g.t*0.25 - turn) * beams
+		behind -= math.Floor(behind)
+
+		v := 0.0
+		if behind < trail {
+			v = 1 - behind/trail
+		}
+		d := math.Hypot(p[0]-0.5, p[1]-0.5)
+		out[i*3], out[i*3+1], out[i*3+2] = g.palette.at(d+g.t*0.05, int(v*v*256))
+	}
+}
+
+// noise2 returns smooth value noise from 0 to 1 at x, y.
+func noise2(x, y float64) float64 {
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := smooth(x-x0), smooth(y-y0)
+	ix, iy := int64(x0), int64(y0)
+
+	a := lerp(hash2(ix, iy), hash2(ix+1, iy), fx)
+	b := lerp(hash2(ix, iy+1), hash2(ix+1, iy+1), fx)
+
+	return lerp(a, b, fy)
+}
+
+// hash2 returns a random-looking number from 0 to 1 for each x, y.
+func hash2(x, y int64) float64 {
+	h := uint64(x)*0x9e3779b97f4a7c15 ^ uint64(y)*0xc2b2ae3d27d4eb4f
+	h ^= h >> 29
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 32
+
+	return float64(h>>11) / (1 << 53)
+}
+
+func smooth(t float64) float64 {
+	return t * t * (3 - 2*t)
+}
+
+func lerp(a, b, t float64) float64 {
+	return a + (b-a)*t
+}
+
+func maxByte(a, b byte) byte {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// resize returns s with length n, keeping what it can and zeroing the
+// rest.
+func resize(s []float64, n int) []float64 {
+	if cap(s) < n {
+		t := make([]float64, n)
+		copy(t, s)
+		return t
+	}
+
+	old := len(s)
+	s = s[:n]
+	for i := old; i < n; i++ {
+		s[i] = 0
+	}
+
+	return s
+}
+
+// generatorOf returns the Generator that r is playing, if any.
+func generatorOf(r Renderer) (*Generator, bool) {
+	switch f := r.(type) {
+	case *Transition:
+		return generatorOf(f.to)
+	case *Generator:
+		return f, true
+	}
+
+	return nil, false
+}
+
+// Generate starts the generator named in gc, or if it's already playing
+// or gc doesn't name one, changes the current generator's params.
+func (t *Streamer) Generate(gc *GeneratorCommand) (GeneratorParams, error) {
+	if g, ok := generatorOf(t.Current()); ok && (gc.Name == "" || gc.Name == g.Name()) {
+		return g.Set(gc)
+	}
+	if gc.Name == "" {
+		return GeneratorParams{}, ErrNoGenerator
+	}
+
+	g, err := NewGenerator(gc)
+	if err != nil {
+		return GeneratorParams{}, err
+	}
+	t.SetRenderer(g)
+
+	return g.params, nil
+}
@@ -1,9 +1,14 @@
 module github.com/die-net/led-controller
 
-go 1.15
+go 1.18
 
 require (
+	github.com/golang/snappy v1.0.0
 	github.com/gorilla/websocket v1.5.0
 	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
-	golang.org/x/sys v0.0.0-20220627191245-f75cf1eec38b // indirect
+	github.com/tetratelabs/wazero v1.1.0
+	github.com/yuin/gopher-lua v1.1.1
+	golang.org/x/image v0.18.0
 )
+
+require golang.org/x/sys v0.0.0-20220627191245-f75cf1eec38b // indirect
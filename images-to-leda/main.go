@@ -0,0 +1,215 @@
+// images-to-leda converts a pattern directory of images, where each row is
+// one frame, into a single .leda animation.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/die-net/led-controller/anim"
+)
+
+var (
+	dir    = flag.String("dir", "", "Pattern directory of images to convert")
+	out    = flag.String("out", "", "Output file, outside -dir (default <dir>-leda/<name>.leda)")
+	fps    = flag.Float64("fps", 0, "Frames per second (default the pattern's fps, if any)")
+	pixels = flag.Int("pixels", 0, "Pixels per frame; rows are repeated or truncated to fit (default the first image's width)")
+	layout = flag.String("layout", "rgb", "Channel layout to store: rgb, grb, or bgr")
+	codec  = flag.String("codec", "snappy", "Frame compression: snappy or none")
+)
+
+// meta is the part of a pattern's _meta.json we care about.
+type meta struct {
+	FPS   float64  `json:"fps"`
+	Order []string `json:"order"`
+}
+
+func main() {
+	flag.Parse()
+
+	if *dir == "" {
+		log.Fatal("-dir must be set.")
+	}
+	// A .leda alongside the images would play as well as them.
+	src := filepath.Clean(*dir)
+	if *out == "" {
+		d := src + "-leda"
+		if err := os.MkdirAll(d, 0755); err != nil {
+			log.Fatal(err)
+		}
+		*out = filepath.Join(d, filepath.Base(src)+anim.Ext)
+	}
+	if sameDir(filepath.Dir(*out), src) {
+		log.Fatal("-out must not be in the -dir pattern.")
+	}
+
+	h := anim.Header{Pixels: *pixels, FPS: *fps}
+	switch *layout {
+	case "rgb":
+		h.Layout = anim.LayoutRGB
+	case "grb":
+		h.Layout = anim.LayoutGRB
+	case "bgr":
+		h.Layout = anim.LayoutBGR
+	default:
+		log.Fatal("-layout must be rgb, grb, or bgr.")
+	}
+	switch *codec {
+	case "snappy":
+		h.Codec = anim.CodecSnappy
+	case "none":
+		h.Codec = anim.CodecNone
+	default:
+		log.Fatal("-codec must be snappy or none.")
+	}
+
+	m, files, err := readPattern(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(files) == 0 {
+		log.Fatal(*dir, " contains no images")
+	}
+	if h.FPS == 0 {
+		h.FPS = m.FPS
+	}
+
+	if err := convert(files, *out, h); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// sameDir returns whether a and b are the same directory.
+func sameDir(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(ai, bi)
+}
+
+// readPattern returns a pattern's metadata and its image files in play
+// order.
+func readPattern(dir string) (*meta, []string, error) {
+	m := &meta{}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "_meta.json")); err == nil {
+		if err := json.Unmarshal(b, m); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	listed := map[string]bool{}
+	files := []string{}
+	for _, name := range m.Order {
+		listed[name] = true
+		files = append(files, filepath.Join(dir, name))
+	}
+	for _, e := range entries {
+		n := e.Name()
+		if strings.HasPrefix(n, ".") || strings.HasPrefix(n, "_") || e.IsDir() || listed[n] || strings.HasSuffix(n, anim.Ext) {
+			continue
+		}
+		files = append(files, filepath.Join(dir, n))
+	}
+
+	return m, files, nil
+}
+
+// convert writes every row of files as frames of an animation.  It writes
+// to a temporary file first, so a player that has the old file mapped
+// doesn't see it change underneath it.
+func convert(files []string, out string, h anim.Header) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(out), ".images-to-leda-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	var w *anim.Writer
+	var row []byte
+	for _, file := range files {
+		img, err := readImage(file)
+		if err != nil {
+			return err
+		}
+
+		bounds := img.Bounds()
+		if w == nil {
+			if h.Pixels == 0 {
+				h.Pixels = bounds.Dx()
+			}
+			if w, err = anim.NewWriter(tmp, h); err != nil {
+				return err
+			}
+			row = make([]byte, h.Pixels*3)
+		}
+
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			imageRow(row, img, y)
+			if err := w.WriteFrame(row); err != nil {
+				return err
+			}
+		}
+		log.Println("Converted", file)
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), out)
+}
+
+func readImage(file string) (image.Image, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+// imageRow copies row y of img into row as RGB, repeating or truncating
+// it to fit.
+func imageRow(row []byte, img image.Image, y int) {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	for i := 0; i < len(row)/3; i++ {
+		r, g, b, _ := img.At(bounds.Min.X+i%width, y).RGBA()
+		row[i*3] = byte(r >> 8)
+		row[i*3+1] = byte(g >> 8)
+		row[i*3+2] = byte(b >> 8)
+	}
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrInvalidLayout = errors.New("layout must be lines of x,y or x,y,z numbers, or a JSON list of them or of shapes")
+	ErrInvalidShape  = errors.New("invalid layout shape")
+	ErrLayoutTooBig  = errors.New("layout has more than 10000 points")
+)
+
+// maxLayoutPoints is the most pixels a layout can place, the same as the
+// most num_pixels can be.
+const maxLayoutPoints = 10000
+
+// Layout is where each pixel physically is, in whatever units its file
+// uses, with x to the right and y down, like an image.  Points are in
+// strip order; pixels past the end have no position.
+type Layout struct {
+	Points [][3]float64 `json:"points"`
+
+	// The corners of the box that the points fit in.
+	Min [3]float64 `json:"min"`
+	Max [3]float64 `json:"max"`
+
+	// Points scaled to fit in a unit cube, centered on 0.5.
+	unit [][3]float64
+}
+
+// newLayout builds a Layout of points, working out its bounds.
+func newLayout(points [][3]float64) *Layout {
+	l := &Layout{Points: points}
+	if len(points) == 0 {
+		return l
+	}
+
+	l.Min, l.Max = points[0], points[0]
+	for _, p := range points[1:] {
+		for k := range p {
+			l.Min[k] = math.Min(l.Min[k], p[k])
+			l.Max[k] = math.Max(l.Max[k], p[k])
+		}
+	}
+
+	size := 0.0
+	for k := range l.Min {
+		size = math.Max(size, l.Max[k]-l.Min[k])
+	}
+	if size == 0 {
+		size = 1
+	}
+	l.unit = make([][3]float64, len(points))
+	for i, p := range points {
+		for k := range p {
+			l.unit[i][k] = 0.5 + (p[k]-(l.Min[k]+l.Max[k])/2)/size
+		}
+	}
+
+	return l
+}
+
+// LineLayout places n pixels one unit apart along the x axis, which is
+// what a strip with no layout looks like.
+func LineLayout(n int) *Layout {
+	points := make([][3]float64, n)
+	for i := range points {
+		points[i][0] = float64(i)
+	}
+
+	return newLayout(points)
+}
+
+// Unit returns pixel i's position scaled so the whole layout fits in a
+// unit cube centered on 0.5, keeping its proportions.  Pixels past the end
+// of the layout, or of a nil one, are in the middle.
+func (l *Layout) Unit(i int) [3]float64 {
+	if l != nil && i < len(l.unit) {
+		return l.unit[i]
+	}
+
+	return [3]float64{0.5, 0.5, 0.5}
+}
+
+// Fit returns each point's x and y scaled and centered to fit within a
+// width x height rectangle, keeping the layout's proportions.
+func (l *Layout) Fit(width, height float64) [][2]float64 {
+	scale, ox, oy := l.fitting(width, height)
+	fit := make([][2]float64, len(l.Points))
+	for i, p := range l.Points {
+		fit[i] = [2]float64{ox + p[0]*scale, oy + p[1]*scale}
+	}
+
+	return fit
+}
+
+// fitting returns how Fit scales and offsets points.
+func (l *Layout) fitting(width, height float64) (scale, ox, oy float64) {
+	w, h := l.Max[0]-l.Min[0], l.Max[1]-l.Min[1]
+	scale = math.Inf(1)
+	if w > 0 {
+		scale = width / w
+	}
+	if h > 0 {
+		scale = math.Min(scale, height/h)
+	}
+	if math.IsInf(scale, 1) {
+		scale = 0
+	}
+
+	ox = width/2 - (l.Min[0]+l.Max[0])/2*scale
+	oy = height/2 - (l.Min[1]+l.Max[1])/2*scale
+
+	return scale, ox, oy
+}
+
+// Spacing returns the usual distance in x and y between pixels next to
+// each other on the strip, or 1 if they're all in the same place.
+func (l *Layout) Spacing() float64 {
+	d := make([]float64, 0, len(l.Points))
+	for i := 1; i < len(l.Points); i++ {
+		a, b := l.Points[i-1], l.Points[i]
+		if v := math.Hypot(b[0]-a[0], b[1]-a[1]); v > 0 {
+			d = append(d, v)
+		}
+	}
+	if len(d) == 0 {
+		return 1
+	}
+	sort.Float64s(d)
+
+	return d[len(d)/2]
+}
+
+// ParseLayout reads CSV-like lines of x,y or x,y,z points separated by
+// commas or spaces, skipping blank lines and lines starting with #; a JSON
+// list of [x, y] or [x, y, z] points; or a JSON object listing Shapes that
+// generate points, in order:
+//
+//	{"shapes": [
+//		{"type": "line", "from": [0, 0], "to": [99, 0], "count": 100},
+//		{"type": "ring", "center": [50, 50], "radius": 20, "count": 60},
+//		{"type": "box", "center": [50, 50], "width": 40, "height": 30},
+//		{"type": "matrix", "from": [0, 60], "columns": 16, "rows": 16, "serpentine": true}
+//	]}
+func ParseLayout(b []byte) (*Layout, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && b[0] == '[' {
+		var points [][]float64
+		if err := json.Unmarshal(b, &points); err != nil {
+			return nil, ErrInvalidLayout
+		}
+		if len(points) > maxLayoutPoints {
+			return nil, ErrLayoutTooBig
+		}
+
+		l := make([][3]float64, len(points))
+		for i, p := range points {
+			if len(p) < 2 || len(p) > 3 {
+				return nil, fmt.Errorf("point %d: %w", i, ErrInvalidLayout)
+			}
+			copy(l[i][:], p)
+		}
+
+		return newLayout(l), nil
+	}
+
+	if len(b) > 0 && b[0] == '{' {
+		var spec struct {
+			Shapes []Shape `json:"shapes"`
+		}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&spec); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidLayout, jsonErrorLine(b, err))
+		}
+
+		var points [][3]float64
+		for i := range spec.Shapes {
+			var err error
+			if points, err = spec.Shapes[i].append(points); err != nil {
+				return nil, fmt.Errorf("shape %d: %w", i, err)
+			}
+		}
+
+		return newLayout(points), nil
+	}
+
+	var points [][3]float64
+	for n, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: %w", n+1, ErrInvalidLayout)
+		}
+
+		var p [3]float64
+		for i, f := range fields {
+			v, err := strconv.ParseFloat(f, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n+1, ErrInvalidLayout)
+			}
+			p[i] = v
+		}
+		if len(points) == maxLayoutPoints {
+			return nil, ErrLayoutTooBig
+		}
+		points = append(points, p)
+	}
+
+	return newLayout(points), nil
+}
+
+// Shape generates a run of points in a layout:
+//
+//	line     count points evenly spaced from from to to, inclusive
+//	ring     count points around a circle of radius about center,
+//	         clockwise from start degrees, 0 being to the right
+//	box      a width x height rectangle about center, with points spacing
+//	         apart, going up its left side from the bottom left corner,
+//	         then along the top, down the right, and back along the bottom,
+//	         like video-to-jpg's -pixelBoxes
+//	matrix   columns x rows points spacing apart, starting at from and
+//	         going along each row, or down each column if vertical; with
+//	         serpentine, every other row or column runs backwards
+//
+// Rings, boxes and matrices lie flat in the z plane of their center or
+// from.  Any shape's points can be reversed.
+type Shape struct {
+	Type string `json:"type"`
+
+	From   [3]float64 `json:"from"`
+	To     [3]float64 `json:"to"`
+	Center [3]float64 `json:"center"`
+	Radius float64    `json:"radius"`
+	Start  float64    `json:"start"`
+	Width  float64    `json:"width"`
+	Height float64    `json:"height"`
+
+	Columns    int  `json:"columns"`
+	Rows       int  `json:"rows"`
+	Vertical   bool `json:"vertical"`
+	Serpentine bool `json:"serpentine"`
+
+	Count   int     `json:"count"`
+	Spacing float64 `json:"spacing"` // Defaults to 1.
+	Reverse bool    `json:"reverse"`
+}
+
+// append adds the shape's points to points.
+func (s *Shape) append(points [][3]float64) ([][3]float64, error) {
+	spacing := s.Spacing
+	if spacing == 0 {
+		spacing = 1
+	}
+	if spacing < 0 {
+		return nil, fmt.Errorf("spacing %g must be > 0: %w", spacing, ErrInvalidShape)
+	}
+
+	// Check how many points there'll be before making any.
+	n := 0
+	switch s.Type {
+	case "line", "ring":
+		n = s.Count
+	case "box":
+		if s.Width <= 0 || s.Height <= 0 {
+			return nil, fmt.Errorf("box width and height must be > 0: %w", ErrInvalidShape)
+		}
+		n = 2*int(s.Width/spacing+1) + 2*int(s.Height/spacing+1)
+	case "matrix":
+		if s.Columns <= 0 || s.Rows <= 0 {
+			return nil, fmt.Errorf("matrix columns and rows must be > 0: %w", ErrInvalidShape)
+		}
+		if s.Columns > maxLayoutPoints || s.Rows > maxLayoutPoints {
+			return nil, ErrLayoutTooBig
+		}
+		n = s.Columns * s.Rows
+	default:
+		return nil, fmt.Errorf("type %q must be line, ring, box or matrix: %w", s.Type, ErrInvalidShape)
+	}
+	if n <= 0 {
+		return nil, fmt.Errorf("%s count must be > 0: %w", s.Type, ErrInvalidShape)
+	}
+	if len(points)+n > maxLayoutPoints {
+		return nil, ErrLayoutTooBig
+	}
+	start := len(points)
+
+	switch s.Type {
+	case "line":
+		for i := 0; i < s.Count; i++ {
+			f := 0.0
+			if s.Count > 1 {
+				f = float64(i) / float64(s.Count-1)
+			}
+			var p [3]float64
+			for k := range p {
+				p[k] = s.From[k] + (s.To[k]-s.From[k])*f
+			}
+			points = append(points, p)
+		}
+	case "ring":
+		if s.Radius <= 0 {
+			return nil, fmt.Errorf("ring radius must be > 0: %w", ErrInvalidShape)
+		}
+		for i := 0; i < s.Count; i++ {
+			a := (s.Start + 360*float64(i)/float64(s.Count)) * math.Pi / 180
+			c := s.Center
+			points = append(points, [3]float64{c[0] + s.Radius*math.Cos(a), c[1] + s.Radius*math.Sin(a), c[2]})
+		}
+	case "box":
+		x0, y0 := s.Center[0]-s.Width/2, s.Center[1]-s.Height/2
+		x1, y1 := x0+s.Width, y0+s.Height
+		side := func(fx, fy, tx, ty, length float64) {
+			steps := int(length / spacing)
+			for i := 0; i <= steps; i++ {
+				f := float64(i) * spacing / length
+				points = append(points, [3]float64{fx + (tx-fx)*f, fy + (ty-fy)*f, s.Center[2]})
+			}
+		}
+		side(x0, y1, x0, y0, s.Height)
+		side(x0, y0, x1, y0, s.Width)
+		side(x1, y0, x1, y1, s.Height)
+		side(x1, y1, x0, y1, s.Width)
+	case "matrix":
+		outer, inner := s.Rows, s.Columns
+		if s.Vertical {
+			outer, inner = s.Columns, s.Rows
+		}
+		for o := 0; o < outer; o++ {
+			for in := 0; in < inner; in++ {
+				j := in
+				if s.Serpentine && o%2 == 1 {
+					j = inner - 1 - in
+				}
+				col, row := j, o
+				if s.Vertical {
+					col, row = o, j
+				}
+				points = append(points, [3]float64{s.From[0] + float64(col)*spacing, s.From[1] + float64(row)*spacing, s.From[2]})
+			}
+		}
+	}
+
+	if s.Reverse {
+		run := points[start:]
+		for i, j := 0, len(run)-1; i < j; i, j = i+1, j-1 {
+			run[i], run[j] = run[j], run[i]
+		}
+	}
+
+	return points, nil
+}
+
+// Layouts loads pixel layouts from the root dir's layouts/, and keeps
+// track of the one in use, which Renderers are given in their
+// FrameContext.
+type Layouts struct {
+	Dir string
+
+	mu      sync.Mutex
+	name    string
+	current *Layout
+
+	// A straight line, for when no layout is in use.
+	line *Layout
+}
+
+var layouts = &Layouts{}
+
+func (ls *Layouts) path(name string) string {
+	return ls.Dir + name
+}
+
+// List returns the names of the layout files.
+func (ls *Layouts) List() ([]string, error) {
+	files, err := ioutil.ReadDir(ls.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	names := []string{}
+	for _, f := range files {
+		if !f.IsDir() && validPatternName(f.Name()) {
+			names = append(names, f.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// Load reads and parses the named layout file.
+func (ls *Layouts) Load(name string) (*Layout, error) {
+	if !validPatternName(name) {
+		return nil, fmt.Errorf("%q: %w", name, ErrInvalidName)
+	}
+
+	b, err := ioutil.ReadFile(ls.path(name))
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := ParseLayout(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return l, nil
+}
+
+// Save checks that b is a valid layout, and writes it as the named layout
+// file, reloading it if it's in use.
+func (ls *Layouts) Save(name string, b []byte) error {
+	if !validPatternName(name) {
+		return fmt.Errorf("%q: %w", name, ErrInvalidName)
+	}
+	if _, err := ParseLayout(b); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	if err := os.MkdirAll(ls.Dir, 0o755); err != nil {
+		return err
+	}
+	tmp := ls.path("." + name + ".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0o644); err != nil { //nolint:gosec // Served publicly anyway.
+		return err
+	}
+	if err := os.Rename(tmp, ls.path(name)); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	if ls.Name() == name {
+		return ls.Use(name)
+	}
+
+	return nil
+}
+
+// Delete removes the named layout file.  The layout stays in use until
+// another one is chosen.
+func (ls *Layouts) Delete(name string) error {
+	if !validPatternName(name) {
+		return fmt.Errorf("%q: %w", name, ErrInvalidName)
+	}
+
+	return os.Remove(ls.path(name))
+}
+
+// Use loads the named layout and starts using it, or goes back to a
+// straight line if name is empty.
+func (ls *Layouts) Use(name string) error {
+	var l *Layout
+	if name != "" {
+		var err error
+		if l, err = ls.Load(name); err != nil {
+			return err
+		}
+	}
+
+	ls.mu.Lock()
+	ls.name, ls.current = name, l
+	ls.mu.Unlock()
+
+	return nil
+}
+
+// Name returns the name of the layout in use, or "" if there isn't one.
+func (ls *Layouts) Name() string {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	return ls.name
+}
+
+// Current returns the layout in use, or if there isn't one, a straight
+// line of n pixels.
+func (ls *Layouts) Current(n int) *Layout {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if ls.current != nil {
+		return ls.current
+	}
+	if ls.line == nil || len(ls.line.Points) != n {
+		ls.line = LineLayout(n)
+	}
+
+	return ls.line
+}
+
+// LayoutsState lists the layout files, and which is in use.
+type LayoutsState struct {
+	Layouts []string `json:"layouts"`
+	Current string   `json:"current"`
+}
+
+// ServeHTTP handles the layout API.  Saving and deleting layouts requires
+// the api_token.
+//
+//	GET    /api/layouts/            LayoutsState
+//	GET    /api/layouts/-           the Layout in use
+//	POST   /api/layouts/-/clear     go back to a straight line
+//	GET    /api/layouts/<name>      a Layout
+//	PUT    /api/layouts/<name>      create or replace a layout file
+//	DELETE /api/layouts/<name>      delete a layout file
+//	POST   /api/layouts/<name>/use  use a layout until the config is reloaded
+func (ls *Layouts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, action := splitTwo(strings.TrimPrefix(r.URL.Path, "/api/layouts/"), "/")
+
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		names, err := ls.List()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, LayoutsState{Layouts: names, Current: ls.Name()})
+	case name == "-" && action == "" && r.Method == http.MethodGet:
+		writeJSON(w, ls.Current(currentConfig().NumPixels))
+	case name == "-" && action == "clear" && r.Method == http.MethodPost:
+		_ = ls.Use("")
+		log.Println("Layout: cleared")
+		w.WriteHeader(http.StatusNoContent)
+	case action == "use" && r.Method == http.MethodPost:
+		if err := ls.Use(name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Println("Layout: using", name)
+		w.WriteHeader(http.StatusNoContent)
+	case action != "" || name == "-":
+		http.NotFound(w, r)
+	case r.Method == http.MethodGet:
+		l, err := ls.Load(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, l)
+	case r.Method == http.MethodPut:
+		if !authorized(w, r) {
+			return
+		}
+		b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadFile))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err := ls.Save(name, b); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		if !authorized(w, r) {
+			return
+		}
+		if err := ls.Delete(name); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
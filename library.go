@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"image"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/die-net/led-controller/anim"
+)
+
+// Name of the thumbnail image in each pattern directory.
+const thumbFile = "_thumb.jpg"
+
+// PatternInfo describes a pattern directory under images/.
+type PatternInfo struct {
+	Name      string       `json:"name"`
+	Title     string       `json:"title"`
+	Thumbnail string       `json:"thumbnail,omitempty"`
+	Meta      *PatternMeta `json:"meta,omitempty"`
+	Files     int          `json:"files"`
+	Frames    int          `json:"frames"`
+	Duration  Duration     `json:"duration"`
+
+	modTime time.Time
+}
+
+// Library keeps track of the pattern directories under images/,
+// rescanning any that have changed on disk.
+type Library struct {
+	Dir string
+
+	mu       sync.Mutex
+	patterns map[string]*PatternInfo
+}
+
+// Patterns returns every pattern with at least one image, sorted by name.
+func (l *Library) Patterns() []PatternInfo {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	dirs, err := ioutil.ReadDir(l.Dir)
+	if err != nil {
+		log.Println("Library:", err)
+		return []PatternInfo{}
+	}
+
+	if l.patterns == nil {
+		l.patterns = map[string]*PatternInfo{}
+	}
+
+	seen := map[string]bool{}
+	for _, dir := range dirs {
+		name := dir.Name()
+		if !dir.IsDir() || !validPatternName(name) {
+			continue
+		}
+		seen[name] = true
+
+		modTime := l.modTime(name, dir.ModTime())
+		if p, ok := l.patterns[name]; ok && p.modTime.Equal(modTime) {
+			continue
+		}
+		l.patterns[name] = l.scan(name, modTime)
+	}
+
+	o := []PatternInfo{}
+	for name, p := range l.patterns {
+		if !seen[name] {
+			delete(l.patterns, name)
+			continue
+		}
+		if p.Files > 0 {
+			o = append(o, *p)
+		}
+	}
+	sort.Slice(o, func(i, j int) bool { return o[i].Name < o[j].Name })
+
+	return o
+}
+
+// Invalidate forces the named pattern to be rescanned next time.
+func (l *Library) Invalidate(name string) {
+	l.mu.Lock()
+	delete(l.patterns, name)
+	l.mu.Unlock()
+}
+
+// modTime returns the latest modification time of a pattern directory and
+// its metadata, since editing a file in place doesn't touch the directory.
+func (l *Library) modTime(name string, t time.Time) time.Time {
+	if fi, err := os.Stat(filepath.Join(l.Dir, name, metaFile)); err == nil && fi.ModTime().After(t) {
+		t = fi.ModTime()
+	}
+	return t
+}
+
+// scan reads a pattern directory's metadata and image headers.
+func (l *Library) scan(name string, modTime time.Time) *PatternInfo {
+	dir := filepath.Join(l.Dir, name)
+	p := &PatternInfo{Name: name, Title: name, modTime: modTime}
+
+	meta, err := LoadPatternMeta(dir)
+	if err != nil {
+		log.Println("Library:", err)
+	}
+	p.Meta = meta
+	if meta.Name != "" {
+		p.Title = meta.Name
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, thumbFile)); err == nil {
+		p.Thumbnail = "/images/" + name + "/" + thumbFile
+	}
+
+	files, err := getFilenames(dir)
+	if err != nil {
+		return p
+	}
+	var rows int
+	var timed time.Duration
+	p.Files, p.Frames, rows, timed = measure(files, meta)
+
+	delay := time.Second / 30
+	if c := currentConfig(); c != nil {
+		delay = time.Duration(c.FrameDelay)
+	}
+	length := time.Duration((float64(rows)*float64(delay) + float64(timed)) / meta.speed(delay))
+	p.Duration = Duration(length.Truncate(time.Second))
+
+	return p
+}
+
+// measure counts the readable files, and the rows in them.  It returns
+// how many rows play at the frame rate, and how long the rest play for
+// by their own timing.
+func measure(files []string, meta *PatternMeta) (n, frames, rows int, timed time.Duration) {
+	for _, file := range files {
+		r, length, err := imageRows(file, meta.Columns)
+		if err != nil {
+			continue
+		}
+		n++
+		frames += r
+		if length > 0 && meta.FPS == 0 {
+			timed += length
+		} else {
+			rows += r
+		}
+	}
+
+	return n, frames, rows, timed
+}
+
+// imageRows returns the number of rows in an image, or columns if it's
+// played by column, and, if it's an animation with its own timing, how long
+// they play for.  Only animations are decoded beyond their header.
+func imageRows(file string, columns bool) (int, time.Duration, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	c, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	rows := c.Height
+	if columns {
+		rows = c.Width
+	}
+
+	var img timedImage
+	switch format {
+	case "leda":
+		a, err := anim.Open(file)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer func() {
+			_ = a.Close()
+		}()
+		img = a
+	case "gif", "png", "webp":
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return 0, 0, err
+		}
+		s, err := anim.DecodeAnimation(b, countFrames)
+		if errors.Is(err, anim.ErrNotAnimated) {
+			return rows, 0, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		img = s
+	default:
+		return rows, 0, nil
+	}
+
+	bounds := img.Bounds()
+	var length time.Duration
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		length += img.RowDelay(y)
+	}
+
+	return bounds.Dy(), length, nil
+}
+
+// countFrames is a Sampler for when only an animation's timing matters.
+func countFrames(dst []byte, _ *image.RGBA) []byte {
+	return append(dst, 0, 0, 0)
+}
+
+// ServeHTTP handles GET /api/library, listing every pattern.
+func (l *Library) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, l.Patterns())
+}
+
+// IndexHandler renders index.html under -root-dir as a template listing
+// the patterns, playlists, generators, plugins, textures, scripts and
+// layouts that actually exist, and serves everything else as static files.
+type IndexHandler struct {
+	RootDir   string
+	Library   *Library
+	Playlists *Playlists
+	Scripts   *Scripts
+}
+
+func (h *IndexHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.FileServer(http.Dir(h.RootDir)).ServeHTTP(w, r)
+		return
+	}
+
+	t, err := template.ParseFiles(filepath.Join(h.RootDir, "index.html"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	playlists, err := h.Playlists.List()
+	if err != nil {
+		log.Println("Index:", err)
+	}
+
+	scripts, err := h.Scripts.List()
+	if err != nil {
+		log.Println("Index:", err)
+	}
+
+	layoutNames, err := layouts.List()
+	if err != nil {
+		log.Println("Index:", err)
+	}
+
+	data := struct {
+		Patterns   []PatternInfo
+		Playlists  []string
+		Generators []string
+		Plugins    []string
+		Textures   []string
+		Scripts    []string
+		Layouts    []string
+	}{
+		Patterns:   h.Library.Patterns(),
+		Playlists:  playlists,
+		Generators: GeneratorNames(),
+		Plugins:    PluginNames(h.RootDir + "plugins/"),
+		Textures:   TextureNames(h.RootDir + "textures/"),
+		Scripts:    scripts,
+		Layouts:    layoutNames,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := t.Execute(w, data); err != nil {
+		log.Println("Index:", err)
+	}
+}
@@ -12,6 +12,7 @@ import (
 )
 
 var (
+	configFile      = flag.String("config", "", "JSON config file; flags that are set override it")
 	listenAddr      = flag.String("listen", ":5309", "[IP]:port to listen for incoming connections")
 	imageFrameQueue = flag.Int("image-frame-queue", 5, "Image frame queue depth")
 	baudRate        = flag.Int("baud-rate", 115200, "Baud rate of serial port")
@@ -21,6 +22,18 @@ var (
 	audioDimming    = flag.Int("audio-dimming", 0, "Maximum amount we can dim based on audio amplitude (0 = disable, max 255)")
 	maxBrightness   = flag.Int("max-brightness", 255, "Brightness value of LEDs (max 255)")
 	rootDir         = flag.String("root-dir", "", "Base directory for http serving and video files")
+	scheduleFile    = flag.String("schedule", "", "Schedule file (default <root-dir>/schedule.json)")
+	latitude        = flag.Float64("latitude", 40.7864, "Latitude in degrees, for scheduling at sunrise and sunset")
+	longitude       = flag.Float64("longitude", -119.2065, "Longitude in degrees, for scheduling at sunrise and sunset")
+	defaultImage    = flag.String("default-image", "default", "Pattern directory under <root-dir>/images/ to play at startup")
+	defaultColor    = flag.String("default-color", "", "Color filter to apply at startup, as #rrggbb")
+	layoutName      = flag.String("layout", "", "Layout file under <root-dir>/layouts/ giving each pixel's position (empty = a straight line)")
+	apiToken        = flag.String("api-token", "", "Token required to upload, rename, or delete patterns (empty = disabled)")
+
+	transition              = flag.String("transition", "cut", "Transition when switching patterns: cut, crossfade, fadeblack, wipe, or dissolve")
+	transitionDuration      = flag.Duration("transition-duration", time.Second, "How long switching patterns takes")
+	imageTransition         = flag.String("image-transition", "cut", "Transition between images within a pattern: cut, crossfade, fadeblack, wipe, or dissolve")
+	imageTransitionDuration = flag.Duration("image-transition-duration", time.Second, "How long switching images within a pattern takes")
 )
 
 func main() {
@@ -28,60 +41,168 @@ func main() {
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	if *serialPort == "" {
-		log.Fatal("-serial-port must be set")
+	set := setFlags()
+	cfg, err := LoadConfig(*configFile, set)
+	if err != nil {
+		log.Fatal(err)
 	}
-
-	if *rootDir == "" {
-		log.Fatal("-root-dir must be set")
-	}
-
-	if *numPixels <= 0 || *numPixels > 10000 {
-		log.Fatal("-num-pixels must be > 0 and <= 10000")
-	}
-
-	if *frameDelay < time.Second/1000 {
-		log.Fatal("-frameDelay must be > 0.001s")
-	}
-
-	if *maxBrightness <= 0 || *maxBrightness > 255 {
-		log.Fatal("-max-brightness must be > 0 and <= 255")
-	}
-
-	if *audioDimming < 0 || *audioDimming > 255 {
-		log.Fatal("-audio-dimming must be >= 0 and <= 255")
-	}
-
-	http.Handle("/", http.FileServer(http.Dir(*rootDir)))
+	setConfig(cfg)
 
 	router := ws.NewRouter()
-	go router.Worker()
 
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		router.ServeWs(w, r)
 	})
 
+	pool := NewFramePool(cfg.ImageFrameQueue + 2)
 	sender := Sender{
-		SerialPort:    *serialPort,
-		BaudRate:      *baudRate,
-		NumPixels:     *numPixels * 3,
-		AudioDimming:  *audioDimming,
-		MaxBrightness: *maxBrightness,
+		SerialPort:    cfg.SerialPort,
+		BaudRate:      cfg.BaudRate,
+		NumPixels:     cfg.NumPixels * 3,
+		AudioDimming:  cfg.AudioDimming,
+		MaxBrightness: cfg.MaxBrightness,
 		StatusChan:    router.Outgoing,
+		Pool:          pool,
+	}
+	if cfg.DefaultColor != "" {
+		color, _ := parseColor(cfg.DefaultColor)
+		sender.SetColorFilter(color)
 	}
 	streamer := NewStreamer()
-	sc := make(chan Frame, *imageFrameQueue)
+	streamer.Pool = pool
+
+	params := NewParamsPublisher(streamer, &sender, router.Outgoing)
+	streamer.Changed = func() {
+		sender.SetPattern(effectsOf(streamer.Current()))
+		params.Changed()
+	}
+	router.Greet = params.Message
+	go router.Worker()
+	go params.Worker()
+	http.Handle("/api/params", params)
+
+	sc := make(chan Frame, cfg.ImageFrameQueue)
 	go sender.Worker(sc)
-	go streamer.Worker(sc, *frameDelay)
+	streamer.SetTransition(cfg.Transition)
+	go streamer.Worker(sc, time.Duration(cfg.FrameDelay))
+
+	patternWatcher.Dir = cfg.RootDir + "images/"
+	go patternWatcher.Worker()
+	pluginWatcher.Dir = cfg.RootDir + "plugins/"
+	go pluginWatcher.Worker()
+
+	layouts.Dir = cfg.RootDir + "layouts/"
+	if err := layouts.Use(cfg.Layout); err != nil {
+		log.Println("Layout:", err)
+	}
+	http.Handle("/api/layouts/", layouts)
 
-	imagePath := *rootDir + "images/default/"
-	decoder := NewDecoder(imagePath)
+	decoder := NewPatternDecoder(cfg.DefaultImage)
 	if decoder == nil {
-		log.Fatal(imagePath, "contains no valid images")
+		log.Fatal(cfg.RootDir+"images/"+cfg.DefaultImage, " contains no valid images")
+	}
+	streamer.SetRenderer(decoder)
+
+	playlists := &Playlists{
+		Dir:      cfg.RootDir + "playlists/",
+		Streamer: streamer,
+		Sender:   &sender,
+	}
+	http.Handle("/api/playlists/", playlists)
+
+	library := &Library{Dir: cfg.RootDir + "images/"}
+	http.Handle("/api/library", library)
+	store := &PatternStore{Dir: cfg.RootDir + "images/", Library: library}
+	http.Handle("/api/patterns/", store)
+	importer := &VideoImporter{Store: store, Outgoing: router.Outgoing}
+	http.Handle("/api/videos", importer)
+	http.Handle("/api/videos/", importer)
+
+	scheduler := &Scheduler{
+		File:      cfg.Schedule,
+		Latitude:  cfg.Latitude,
+		Longitude: cfg.Longitude,
+		Streamer:  streamer,
+		Sender:    &sender,
+		Playlists: playlists,
+	}
+	if err := scheduler.Load(); err != nil {
+		log.Fatal(err)
+	}
+	http.Handle("/api/schedule", scheduler)
+	http.Handle("/api/schedule/", scheduler)
+	go scheduler.Worker()
+
+	reloader := &ConfigReloader{
+		File:  *configFile,
+		Flags: set,
+		Apply: func(old, c *Config) {
+			if c.NumPixels != old.NumPixels {
+				sender.SetNumPixels(c.NumPixels * 3)
+			}
+			if c.FrameDelay != old.FrameDelay {
+				streamer.SetDelay(time.Duration(c.FrameDelay))
+			}
+			if c.Transition != old.Transition {
+				streamer.SetTransition(c.Transition)
+			}
+			if c.MaxBrightness != old.MaxBrightness {
+				sender.SetMaxBrightness(c.MaxBrightness)
+			}
+			if c.AudioDimming != old.AudioDimming {
+				sender.SetAudioDimming(c.AudioDimming)
+			}
+			if c.DefaultColor != old.DefaultColor && c.DefaultColor != "" {
+				color, _ := parseColor(c.DefaultColor)
+				sender.SetColorFilter(color)
+			}
+			if c.Layout != old.Layout {
+				if err := layouts.Use(c.Layout); err != nil {
+					log.Println("Layout:", err)
+				}
+			}
+			if c.DefaultImage != old.DefaultImage {
+				if decoder := NewPatternDecoder(c.DefaultImage); decoder != nil {
+					streamer.SetRenderer(decoder)
+				}
+			}
+			if c.Schedule != old.Schedule || c.Latitude != old.Latitude || c.Longitude != old.Longitude {
+				if err := scheduler.Reconfigure(c.Schedule, c.Latitude, c.Longitude); err != nil {
+					log.Println("Config: schedule not reloaded:", err)
+				}
+			}
+			params.Changed()
+		},
+	}
+	http.Handle("/api/config", reloader)
+	http.Handle("/api/config/", reloader)
+	go reloader.Worker()
+
+	http.Handle("/api/playback", &PlaybackHandler{Streamer: streamer})
+	http.Handle("/api/metrics", metrics)
+
+	compositor := &Compositor{}
+	http.Handle("/api/compositor", &CompositorHandler{Compositor: compositor, Streamer: streamer})
+	http.Handle("/api/compositor/", &CompositorHandler{Compositor: compositor, Streamer: streamer})
+
+	expressions := &ExpressionHandler{Streamer: streamer, Outgoing: router.Outgoing}
+	http.Handle("/api/expression", expressions)
+	http.Handle("/api/plugins", &PluginHandler{Streamer: streamer, Dir: cfg.RootDir + "plugins/"})
+	http.Handle("/api/textures", &TextureHandler{Streamer: streamer, Dir: cfg.RootDir + "textures/"})
+
+	scripts := &Scripts{
+		Dir:         cfg.RootDir + "scripts/",
+		Streamer:    streamer,
+		Sender:      &sender,
+		Playlists:   playlists,
+		Params:      params,
+		Expressions: expressions,
+		Outgoing:    router.Outgoing,
 	}
-	streamer.SetFramer(decoder)
+	http.Handle("/api/scripts/", scripts)
+	http.Handle("/", &IndexHandler{RootDir: cfg.RootDir, Library: library, Playlists: playlists, Scripts: scripts})
 
-	go Receiver(router.Incoming, streamer, &sender)
+	go Receiver(router.Incoming, streamer, &sender, playlists, compositor, params, expressions, scripts)
 
-	log.Fatal(http.ListenAndServe(*listenAddr, nil))
+	log.Fatal(http.ListenAndServe(cfg.Listen, nil))
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Name of the metadata sidecar in each pattern directory.  It starts with
+// "_" so getFilenames() skips it.
+const metaFile = "_meta.json"
+
+// Name of the pixel path sidecar used to sample animations as textures:
+// a JSON array of [x, y] points, in LED order.
+const pathFile = "_path.json"
+
+// How animated images play: each frame as a strip of pixels, or as a 2D
+// texture sampled along the pattern's pixel path.
+const (
+	AnimationRows    = "rows"
+	AnimationTexture = "texture"
+)
+
+// PatternMeta is optional per-pattern metadata, used to make each pattern
+// look right when it's selected.
+type PatternMeta struct {
+	Name       string   `json:"name,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+	Speed      float64  `json:"speed,omitempty"`
+	FPS        float64  `json:"fps,omitempty"`
+	Brightness int      `json:"brightness,omitempty"`
+	Color      string   `json:"color,omitempty"`
+	Loops      int      `json:"loops,omitempty"`
+	Order      []string `json:"order,omitempty"`
+	Animation  string   `json:"animation,omitempty"`
+	Fit        string   `json:"fit,omitempty"`
+	Range      []int    `json:"range,omitempty"`
+	Offset     int      `json:"offset,omitempty"`
+	Columns    bool     `json:"columns,omitempty"`
+}
+
+// LoadPatternMeta reads the metadata sidecar from a pattern directory.  A
+// missing sidecar is empty metadata.
+func LoadPatternMeta(dir string) (*PatternMeta, error) {
+	meta := &PatternMeta{}
+
+	file := filepath.Join(dir, metaFile)
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return meta, nil
+		}
+		return meta, err
+	}
+
+	if err := json.Unmarshal(b, meta); err != nil {
+		return &PatternMeta{}, fmt.Errorf("%s: %w", file, jsonErrorLine(b, err))
+	}
+	if err := meta.Validate(); err != nil {
+		return &PatternMeta{}, fmt.Errorf("%s: %w", file, err)
+	}
+
+	return meta, nil
+}
+
+func (m *PatternMeta) Validate() error {
+	if m.Speed < 0 || m.Speed > 100 {
+		return fmt.Errorf("speed %g must be >= 0 and <= 100: %w", m.Speed, ErrInvalidValue)
+	}
+	if m.FPS < 0 || m.FPS > 1000 {
+		return fmt.Errorf("fps %g must be >= 0 and <= 1000: %w", m.FPS, ErrInvalidValue)
+	}
+	if m.Brightness < 0 || m.Brightness > 255 {
+		return fmt.Errorf("brightness %d must be >= 0 and <= 255: %w", m.Brightness, ErrInvalidValue)
+	}
+	if m.Color != "" {
+		if _, err := parseColor(m.Color); err != nil {
+			return fmt.Errorf("color %q: %w", m.Color, err)
+		}
+	}
+	if m.Loops < 0 {
+		return fmt.Errorf("loops %d must be >= 0: %w", m.Loops, ErrInvalidValue)
+	}
+	switch m.Animation {
+	case "", AnimationRows, AnimationTexture:
+	default:
+		return fmt.Errorf("animation %q must be rows or texture: %w", m.Animation, ErrInvalidValue)
+	}
+	switch m.Fit {
+	case "", FitTile, FitStretch, FitCenter, FitMirror, FitPlace:
+	default:
+		return fmt.Errorf("fit %q must be tile, stretch, center, mirror, or place: %w", m.Fit, ErrInvalidValue)
+	}
+	if len(m.Range) != 0 && (len(m.Range) != 2 || m.Range[0] < 0 || m.Range[1] <= m.Range[0]) {
+		return fmt.Errorf("range %v must be [first, end) pixels: %w", m.Range, ErrInvalidValue)
+	}
+	if m.Offset < 0 {
+		return fmt.Errorf("offset %d must be >= 0: %w", m.Offset, ErrInvalidValue)
+	}
+	for _, n := range m.Order {
+		if !validPatternName(n) {
+			return fmt.Errorf("order: %q: %w", n, ErrInvalidName)
+		}
+	}
+
+	return nil
+}
+
+// speed returns how many image rows to advance per frame, given the delay
+// between frames.  Content authored at a specific fps plays at that rate
+// regardless of -frame-delay.  For animations with their own timing, it's
+// instead a multiplier on that; see Decoder.step().
+func (m *PatternMeta) speed(delay time.Duration) float64 {
+	speed := 1.0
+	if m.FPS > 0 && delay > 0 {
+		speed = m.FPS * delay.Seconds()
+	}
+	if m.Speed > 0 {
+		speed *= m.Speed
+	}
+
+	return speed
+}
+
+// orderFiles puts files listed in Order first, in that order, followed by
+// the rest in their original order.
+func (m *PatternMeta) orderFiles(files []string) []string {
+	if len(m.Order) == 0 {
+		return files
+	}
+
+	byName := make(map[string]string, len(files))
+	for _, f := range files {
+		byName[filepath.Base(f)] = f
+	}
+
+	o := make([]string, 0, len(files))
+	for _, n := range m.Order {
+		if f, ok := byName[n]; ok {
+			o = append(o, f)
+			delete(byName, n)
+		}
+	}
+	for _, f := range files {
+		if _, ok := byName[filepath.Base(f)]; ok {
+			o = append(o, f)
+		}
+	}
+
+	return o
+}
+
+// effects returns the brightness and color filter the metadata asks for,
+// or 0 and nil if it doesn't.
+func (m *PatternMeta) effects() (int, Frame) {
+	var color Frame
+	if m.Color != "" {
+		color, _ = parseColor(m.Color)
+	}
+
+	return m.Brightness, color
+}
+
+// effectsRenderer is implemented by Renderers that ask for their own
+// brightness or color filter while they play.
+type effectsRenderer interface {
+	Effects() (brightness int, color Frame)
+}
+
+// Effects returns the brightness and color filter the pattern's metadata
+// asks for.
+func (d *Decoder) Effects() (int, Frame) {
+	return d.meta.effects()
+}
+
+// effectsOf returns the brightness and color filter r asks for, if any.
+func effectsOf(r Renderer) (int, Frame) {
+	switch f := r.(type) {
+	case *Transition:
+		return effectsOf(f.to)
+	case effectsRenderer:
+		return f.Effects()
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Metrics counts things worth watching on a running controller.
+type Metrics struct {
+	mu sync.Mutex
+
+	// Image decoding, in the background or on the frame goroutine.
+	Decodes        int64    `json:"decodes"`
+	DecodeErrors   int64    `json:"decode_errors"`
+	LastDecodeTime Duration `json:"last_decode_time"`
+	MaxDecodeTime  Duration `json:"max_decode_time"`
+	TotalDecode    Duration `json:"total_decode_time"`
+
+	// Images decoded on the frame goroutine because no prefetched image
+	// was available, and times it had to wait for a prefetch to finish.
+	SyncDecodes   int64    `json:"sync_decodes"`
+	PrefetchWaits int64    `json:"prefetch_waits"`
+	PrefetchWait  Duration `json:"prefetch_wait_time"`
+
+	// Frame ticks, and ticks missed because a frame took too long.
+	Ticks        int64    `json:"ticks"`
+	MissedTicks  int64    `json:"missed_ticks"`
+	MaxFrameTime Duration `json:"max_frame_time"`
+}
+
+var metrics = &Metrics{}
+
+// decoded records how long decoding an image took.
+func (m *Metrics) decoded(d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		m.DecodeErrors++
+		return
+	}
+
+	m.Decodes++
+	m.LastDecodeTime = Duration(d)
+	m.TotalDecode += Duration(d)
+	if Duration(d) > m.MaxDecodeTime {
+		m.MaxDecodeTime = Duration(d)
+	}
+}
+
+// waited records an image handoff that either decoded synchronously or
+// waited for a prefetch.
+func (m *Metrics) waited(sync bool, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if sync {
+		m.SyncDecodes++
+		return
+	}
+
+	m.PrefetchWaits++
+	m.PrefetchWait += Duration(d)
+}
+
+// ticked records a frame tick, how many ticks were skipped before it, and
+// how long producing the frame took.
+func (m *Metrics) ticked(missed int64, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Ticks++
+	m.MissedTicks += missed
+	if Duration(d) > m.MaxFrameTime {
+		m.MaxFrameTime = Duration(d)
+	}
+}
+
+// ServeHTTP handles GET /api/metrics.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeJSON(w, m)
+}
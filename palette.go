@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+var ErrInvalidPalette = errors.New("palette must be a known name or a list of #rrggbb colors")
+
+// palettes are the named color gradients generators can use.  Each wraps
+// around from its last color to its first.
+var palettes = map[string][]string{
+	"rainbow": {"#ff0000", "#ffff00", "#00ff00", "#00ffff", "#0000ff", "#ff00ff"},
+	"party":   {"#5500ab", "#84007c", "#b5004b", "#e5001b", "#e81700", "#b84700", "#ab7700", "#abab00", "#ab5500", "#dd2200", "#f2000e", "#c2003e", "#8f0071", "#5f00a1", "#2f00d0", "#0007f9"},
+	"heat":    {"#000000", "#330000", "#990000", "#ff3300", "#ff9900", "#ffff33", "#ffffff"},
+	"lava":    {"#000000", "#480000", "#a00000", "#ff2000", "#ff8000", "#ff2000", "#a00000", "#480000"},
+	"ocean":   {"#000050", "#00007f", "#0000ff", "#006080", "#00a0a0", "#2080ff", "#00ffff", "#000080"},
+	"forest":  {"#006400", "#005500", "#556b2f", "#008000", "#228b22", "#6b8e23", "#32cd32", "#9acd32"},
+	"cloud":   {"#0000ff", "#00008b", "#000080", "#0000ff", "#87ceeb", "#ffffff", "#add8e6", "#87ceeb"},
+	"ice":     {"#000020", "#000060", "#0040c0", "#40a0ff", "#c0e0ff", "#ffffff", "#40a0ff", "#0040c0"},
+	"white":   {"#ffffff"},
+}
+
+// PaletteNames returns the names of the built-in palettes, sorted.
+func PaletteNames() []string {
+	names := make([]string, 0, len(palettes))
+	for name := range palettes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Palette is a gradient of colors, looked up either as a loop that wraps
+// around from the last color to the first, or as a ramp from the first to
+// the last.
+type Palette struct {
+	loop, ramp [256][3]byte
+}
+
+// ParsePalette returns a built-in palette by name, or one blended from a
+// comma-separated list of #rrggbb colors.
+func ParsePalette(s string) (*Palette, error) {
+	stops, ok := palettes[s]
+	if !ok {
+		stops = strings.Split(s, ",")
+	}
+
+	colors := make([]Frame, 0, len(stops))
+	for _, stop := range stops {
+		c, err := parseColor(strings.TrimSpace(stop))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", s, ErrInvalidPalette)
+		}
+		colors = append(colors, c)
+	}
+
+	p := &Palette{}
+	n := len(colors)
+	for i := 0; i < 256; i++ {
+		// Spread the stops evenly, blending from each to the next.
+		pos := i * n
+		blend(&p.loop[i], colors[pos/256], colors[(pos/256+1)%n], pos%256)
+
+		pos = i * (n - 1)
+		blend(&p.ramp[i], colors[pos/255], colors[(pos/255+1)%n], pos%255*256/255)
+	}
+
+	return p, nil
+}
+
+// blend sets dst to t/256 of the way from a to b.
+func blend(dst *[3]byte, a, b Frame, t int) {
+	for c := range dst {
+		dst[c] = byte((int(a[c])*(256-t) + int(b[c])*t) >> 8)
+	}
+}
+
+// at returns the color at position x, where 1 is the whole way around the
+// palette, scaled by brightness v out of 256.
+func (p *Palette) at(x float64, v int) (byte, byte, byte) {
+	return scaled(&p.loop[int(math.Floor(x*256))&0xff], v)
+}
+
+// heat returns the color at position x along the ramp, from 0 for its
+// first color to 1 for its last, scaled by brightness v out of 256.
+func (p *Palette) heat(x float64, v int) (byte, byte, byte) {
+	return scaled(&p.ramp[clampInt(int(x*255), 0, 255)], v)
+}
+
+func scaled(c *[3]byte, v int) (byte, byte, byte) {
+	return byte(int(c[0]) * v >> 8), byte(int(c[1]) * v >> 8), byte(int(c[2]) * v >> 8)
+}
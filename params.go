@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+var ErrNoPattern = errors.New("nothing is playing")
+
+// Param types.
+const (
+	ParamNumber = "number"
+	ParamBool   = "bool"
+	ParamEnum   = "enum"
+	ParamColor  = "color"
+	ParamString = "string"
+)
+
+// ParamSpec describes one of a Renderer's or the Sender's params, so a UI
+// can offer a control for it.
+type ParamSpec struct {
+	Name    string      `json:"name"`
+	Type    string      `json:"type"`
+	Default interface{} `json:"default"`
+
+	// For numbers: the range allowed, the step between values, and
+	// whether a control should move along a log scale.  Zeros are left
+	// out of the JSON.
+	Min  float64 `json:"min,omitempty"`
+	Max  float64 `json:"max,omitempty"`
+	Step float64 `json:"step,omitempty"`
+	Log  bool    `json:"log,omitempty"`
+
+	Units string `json:"units,omitempty"`
+
+	// For enums, the values to choose from.
+	Enum []string `json:"enum,omitempty"`
+}
+
+// check returns an error if v isn't a valid value for s.
+func (s ParamSpec) check(v interface{}) error {
+	p := Params{s.Name: v}
+	switch s.Type {
+	case ParamNumber:
+		f, err := p.float(s.Name)
+		if err != nil {
+			return err
+		}
+		if s.Max > s.Min && (*f < s.Min || *f > s.Max) {
+			return fmt.Errorf("%s %g must be >= %g and <= %g: %w", s.Name, *f, s.Min, s.Max, ErrInvalidValue)
+		}
+	case ParamBool:
+		if _, err := p.bool(s.Name); err != nil {
+			return err
+		}
+	case ParamEnum:
+		e, err := p.string(s.Name)
+		if err != nil {
+			return err
+		}
+		for _, value := range s.Enum {
+			if *e == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s %q: %w", s.Name, *e, ErrInvalidValue)
+	case ParamColor:
+		c, err := p.string(s.Name)
+		if err != nil {
+			return err
+		}
+		if _, err := parseColor(*c); err != nil {
+			return fmt.Errorf("%s %q: %w", s.Name, *c, err)
+		}
+	case ParamString:
+		if _, err := p.string(s.Name); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%s has unknown type %q: %w", s.Name, s.Type, ErrParamType)
+	}
+
+	return nil
+}
+
+// speedSpec describes a speed multiplier param.
+func speedSpec(def float64) ParamSpec {
+	return ParamSpec{Name: "speed", Type: ParamNumber, Default: def, Min: 0.01, Max: 100, Log: true, Units: "x"}
+}
+
+// ParamGroup is a schema and the current values for it.
+type ParamGroup struct {
+	Schema []ParamSpec `json:"schema"`
+	Values Params      `json:"values"`
+}
+
+// ParamsState describes the params of the playing Renderer, which the
+// Pattern group is about, and of the Sender's effects.
+type ParamsState struct {
+	Pattern  ParamGroup `json:"pattern"`
+	Duration *Duration  `json:"duration,omitempty"`
+	Effects  ParamGroup `json:"effects"`
+}
+
+// ParamsCommand changes the params of the playing Renderer or the
+// Sender's effects, or starts the Renderer over.
+type ParamsCommand struct {
+	Pattern Params `json:"pattern,omitempty"`
+	Effects Params `json:"effects,omitempty"`
+	Reset   bool   `json:"reset,omitempty"`
+}
+
+// ParamsPublisher reports the params of whatever is playing, over the API
+// and to websocket clients whenever they change.
+type ParamsPublisher struct {
+	Streamer *Streamer
+	Sender   *Sender
+	Outgoing chan<- []byte
+
+	changed chan struct{}
+}
+
+func NewParamsPublisher(t *Streamer, s *Sender, outgoing chan<- []byte) *ParamsPublisher {
+	return &ParamsPublisher{
+		Streamer: t,
+		Sender:   s,
+		Outgoing: outgoing,
+		changed:  make(chan struct{}, 1),
+	}
+}
+
+// State returns the current params.
+func (pp *ParamsPublisher) State() ParamsState {
+	r := pp.Streamer.Current()
+	state := ParamsState{
+		Effects: ParamGroup{Schema: pp.Sender.Schema(), Values: pp.Sender.Params()},
+	}
+	if r != nil {
+		state.Pattern = ParamGroup{Schema: r.Schema(), Values: r.Params()}
+		if d, ok := r.Duration(); ok {
+			d = d.Round(time.Millisecond)
+			state.Duration = (*Duration)(&d)
+		}
+	}
+	if state.Pattern.Schema == nil {
+		state.Pattern.Schema = []ParamSpec{}
+	}
+	if state.Pattern.Values == nil {
+		state.Pattern.Values = Params{}
+	}
+
+	return state
+}
+
+// Do applies pc and returns the resulting state.  It changes nothing if
+// any of the params are invalid.
+func (pp *ParamsPublisher) Do(pc *ParamsCommand) (ParamsState, error) {
+	// The Renderer checks its params as it sets them, so check the
+	// effects first.
+	e, err := parseEffects(pc.Effects)
+	if err != nil {
+		return ParamsState{}, fmt.Errorf("effects: %w", err)
+	}
+
+	if len(pc.Pattern) > 0 || pc.Reset {
+		r := pp.Streamer.Current()
+		if r == nil {
+			return ParamsState{}, ErrNoPattern
+		}
+		if err := r.SetParams(pc.Pattern); err != nil {
+			return ParamsState{}, fmt.Errorf("pattern: %w", err)
+		}
+		if pc.Reset {
+			r.Reset()
+		}
+	}
+	pp.Sender.setEffects(e)
+
+	pp.Changed()
+
+	return pp.State(), nil
+}
+
+// Changed notes that the params may have changed, to be sent to websocket
+// clients soon.  It never blocks.
+func (pp *ParamsPublisher) Changed() {
+	select {
+	case pp.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Message returns the current params as a websocket message.
+func (pp *ParamsPublisher) Message() []byte {
+	b, err := json.Marshal(struct {
+		Params ParamsState `json:"params"`
+	}{pp.State()})
+	if err != nil {
+		log.Println("Params:", err)
+		return nil
+	}
+
+	return b
+}
+
+// Worker sends the params to websocket clients each time they change,
+// after a short wait so a burst of changes is sent once.
+func (pp *ParamsPublisher) Worker() {
+	for range pp.changed {
+		time.Sleep(50 * time.Millisecond)
+		if b := pp.Message(); b != nil {
+			pp.Outgoing <- b
+		}
+	}
+}
+
+// ServeHTTP serves the params API:
+//
+//	GET  /api/params   the schema and values of the pattern and effects
+//	POST /api/params   apply a ParamsCommand
+func (pp *ParamsPublisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, pp.State())
+	case http.MethodPost:
+		pc := &ParamsCommand{}
+		if err := readJSON(r, pc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		state, err := pp.Do(pc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, state)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
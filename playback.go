@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var ErrNotPlayable = errors.New("current pattern doesn't support playback controls")
+
+// PlaybackCommand changes how a Player moves through its content.  Unset
+// fields are left alone.
+type PlaybackCommand struct {
+	Speed    *float64  `json:"speed,omitempty"`
+	Reverse  *bool     `json:"reverse,omitempty"`
+	PingPong *bool     `json:"pingpong,omitempty"`
+	Pause    *bool     `json:"pause,omitempty"`
+	Step     int       `json:"step,omitempty"`
+	SeekRow  *int      `json:"seek_row,omitempty"`
+	SeekTime *Duration `json:"seek_time,omitempty"`
+}
+
+func (pc *PlaybackCommand) Validate() error {
+	if pc.Speed != nil && (*pc.Speed <= 0 || *pc.Speed > 100) {
+		return fmt.Errorf("speed %g must be > 0 and <= 100: %w", *pc.Speed, ErrInvalidValue)
+	}
+	if pc.SeekRow != nil && *pc.SeekRow < 0 {
+		return fmt.Errorf("seek_row %d must be >= 0: %w", *pc.SeekRow, ErrInvalidValue)
+	}
+	if pc.SeekTime != nil && *pc.SeekTime < 0 {
+		return fmt.Errorf("seek_time must be >= 0: %w", ErrInvalidValue)
+	}
+
+	return nil
+}
+
+// PlaybackState describes where a Player is and how it's moving.
+type PlaybackState struct {
+	Speed    float64 `json:"speed"`
+	Reverse  bool    `json:"reverse"`
+	PingPong bool    `json:"pingpong"`
+	Paused   bool    `json:"paused"`
+	Row      int     `json:"row"`
+	Rows     int     `json:"rows"`
+	File     string  `json:"file,omitempty"`
+}
+
+// Player is implemented by Renderers whose playback can be controlled.
+type Player interface {
+	Playback(pc *PlaybackCommand) (PlaybackState, error)
+}
+
+// Playback applies pc and returns the resulting state.
+func (d *Decoder) Playback(pc *PlaybackCommand) (PlaybackState, error) {
+	if err := pc.Validate(); err != nil {
+		return PlaybackState{}, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if pc.Speed != nil {
+		d.speed = *pc.Speed
+	}
+	if pc.Reverse != nil {
+		d.reverse = *pc.Reverse
+	}
+	if pc.PingPong != nil {
+		d.pingpong = *pc.PingPong
+		d.bouncing = false
+	}
+	if pc.Pause != nil {
+		d.paused = *pc.Pause
+	}
+	if pc.Reverse != nil || pc.PingPong != nil {
+		d.prefetchNext()
+	}
+
+	if d.image != nil {
+		bounds := d.image.Bounds()
+		switch {
+		case pc.SeekRow != nil:
+			d.pos = float64(bounds.Min.Y + *pc.SeekRow)
+			d.clampPos()
+		case pc.SeekTime != nil:
+			d.pos = float64(bounds.Min.Y) + d.seekRows(time.Duration(*pc.SeekTime))
+			d.clampPos()
+		}
+
+		if pc.Step != 0 {
+			d.advance(float64(pc.Step) * d.direction())
+		}
+	}
+
+	return d.state(), nil
+}
+
+// seekRows returns how many rows into the current image the pattern gets
+// in t, playing at the current speed.
+func (d *Decoder) seekRows(t time.Duration) float64 {
+	if d.delay <= 0 {
+		return 0
+	}
+
+	if ti, ok := d.timed(); ok {
+		t = time.Duration(float64(t) * d.speed)
+		bounds := ti.Bounds()
+		rows := 0.0
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			rd := ti.RowDelay(y)
+			if rd <= 0 {
+				rd = d.delay
+			}
+			if t < rd {
+				return rows + float64(t)/float64(rd)
+			}
+			t -= rd
+			rows++
+		}
+		return rows
+	}
+
+	return float64(t) / float64(d.delay) * d.speed
+}
+
+// Schema describes the Decoder's playback controls.
+func (d *Decoder) Schema() []ParamSpec {
+	d.mu.Lock()
+	delay := d.delay
+	d.mu.Unlock()
+
+	return []ParamSpec{
+		speedSpec(d.meta.speed(delay)),
+		{Name: "reverse", Type: ParamBool, Default: false},
+		{Name: "pingpong", Type: ParamBool, Default: false},
+		{Name: "paused", Type: ParamBool, Default: false},
+	}
+}
+
+// Params returns the Decoder's playback controls.
+func (d *Decoder) Params() Params {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return Params{
+		"speed":    d.speed,
+		"reverse":  d.reverse,
+		"pingpong": d.pingpong,
+		"paused":   d.paused,
+	}
+}
+
+// SetParams changes the Decoder's playback controls.
+func (d *Decoder) SetParams(p Params) error {
+	if err := p.only("speed", "reverse", "pingpong", "paused"); err != nil {
+		return err
+	}
+
+	pc := &PlaybackCommand{}
+	var err error
+	if pc.Speed, err = p.float("speed"); err != nil {
+		return err
+	}
+	if pc.Reverse, err = p.bool("reverse"); err != nil {
+		return err
+	}
+	if pc.PingPong, err = p.bool("pingpong"); err != nil {
+		return err
+	}
+	if pc.Pause, err = p.bool("paused"); err != nil {
+		return err
+	}
+
+	_, err = d.Playback(pc)
+	return err
+}
+
+// Reset goes back to the start of the first file, or the end if playing
+// in reverse.
+func (d *Decoder) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.next = nil
+	d.fileNum = 0
+	d.played = 0
+	d.bouncing = false
+	if !d.NextImage() {
+		return
+	}
+	if d.reverse {
+		_, d.pos = d.span()
+	}
+	d.prefetchNext()
+}
+
+// Duration returns how long it takes to play every file once at the
+// current speed.  The first call reads every file's header.
+func (d *Decoder) Duration() (time.Duration, bool) {
+	d.mu.Lock()
+	files, delay, seen, length := d.files, d.delay, d.seen, d.length
+	d.mu.Unlock()
+
+	// Measure without holding the lock, so as not to hold up frames.
+	if length < 0 {
+		_, _, rows, timed := measure(files, d.meta)
+		length = time.Duration(float64(rows)*float64(delay)) + timed
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.seen == seen && d.delay == delay {
+		d.length = length
+	}
+
+	return time.Duration(float64(length) / d.speed), true
+}
+
+func (d *Decoder) state() PlaybackState {
+	s := PlaybackState{
+		Speed:    d.speed,
+		Reverse:  d.reverse,
+		PingPong: d.pingpong,
+		Paused:   d.paused,
+	}
+
+	if d.image != nil {
+		bounds := d.image.Bounds()
+		s.Row = int(d.pos) - bounds.Min.Y
+		s.Rows = bounds.Dy()
+	}
+	if n := d.fileNum - 1; n >= 0 && n < len(d.files) {
+		s.File = d.files[n]
+	}
+
+	return s
+}
+
+// playerOf returns the Player that controls r's playback, if any.
+func playerOf(r Renderer) (Player, bool) {
+	switch f := r.(type) {
+	case *Transition:
+		return playerOf(f.to)
+	case Player:
+		return f, true
+	}
+
+	return nil, false
+}
+
+// Playback sends pc to the current Renderer.
+func (t *Streamer) Playback(pc *PlaybackCommand) (PlaybackState, error) {
+	p, ok := playerOf(t.Current())
+	if !ok {
+		return PlaybackState{}, ErrNotPlayable
+	}
+
+	return p.Playback(pc)
+}
+
+// PlaybackHandler serves the playback API:
+//
+//	GET  /api/playback   the current pattern's playback state
+//	POST /api/playback   apply a PlaybackCommand
+type PlaybackHandler struct {
+	Streamer *Streamer
+}
+
+func (h *PlaybackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pc := &PlaybackCommand{}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := readJSON(r, pc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	state, err := h.Streamer.Playback(pc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, state)
+}
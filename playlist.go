@@ -0,0 +1,699 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoPlaylist      = errors.New("no playlist is playing")
+	ErrInvalidName     = errors.New("invalid name")
+	ErrInvalidOrder    = errors.New("order must be sequential, shuffle, or weighted")
+	ErrNoEntries       = errors.New("playlist has no entries")
+	ErrInvalidColor    = errors.New("color must be #rrggbb")
+	ErrInvalidValue    = errors.New("value out of range")
+	ErrUnknownControl  = errors.New("control must be next, previous, hold, or resume")
+	ErrNoPlayableEntry = errors.New("playlist has no playable entries")
+	ErrInvalidDuration = errors.New("duration must be a string like \"1m30s\" or a number of seconds")
+)
+
+const (
+	OrderSequential = "sequential"
+	OrderShuffle    = "shuffle"
+	OrderWeighted   = "weighted"
+
+	// How many entries "previous" can step back through.
+	maxPlaylistHistory = 100
+)
+
+// Duration is a time.Duration that is written to JSON as a string like
+// "1m30s", and can be read from either that or a number of seconds.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case float64:
+		*d = Duration(v * float64(time.Second))
+	case string:
+		t, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(t)
+	default:
+		return ErrInvalidDuration
+	}
+
+	return nil
+}
+
+// PlaylistEntry is one pattern directory in a Playlist, along with how
+// long to play it and what to set brightness and color filter to.
+type PlaylistEntry struct {
+	Image      string   `json:"image"`
+	Brightness int      `json:"brightness,omitempty"`
+	Color      string   `json:"color,omitempty"`
+	Duration   Duration `json:"duration,omitempty"`
+	Loops      int      `json:"loops,omitempty"`
+	Weight     int      `json:"weight,omitempty"`
+}
+
+// Playlist is an ordered list of pattern directories to step through.
+type Playlist struct {
+	Name    string          `json:"name"`
+	Order   string          `json:"order,omitempty"`
+	Entries []PlaylistEntry `json:"entries"`
+}
+
+// Validate checks a Playlist for errors, returning a description of the
+// first one found.
+func (pl *Playlist) Validate() error {
+	if !validPatternName(pl.Name) {
+		return fmt.Errorf("name %q: %w", pl.Name, ErrInvalidName)
+	}
+
+	switch pl.Order {
+	case "", OrderSequential, OrderShuffle, OrderWeighted:
+	default:
+		return fmt.Errorf("order %q: %w", pl.Order, ErrInvalidOrder)
+	}
+
+	if len(pl.Entries) == 0 {
+		return ErrNoEntries
+	}
+
+	for i := range pl.Entries {
+		e := &pl.Entries[i]
+		if !validPatternName(e.Image) {
+			return fmt.Errorf("entry %d: image %q: %w", i, e.Image, ErrInvalidName)
+		}
+		if e.Brightness < 0 || e.Brightness > 255 {
+			return fmt.Errorf("entry %d: brightness %d must be >= 0 and <= 255: %w", i, e.Brightness, ErrInvalidValue)
+		}
+		if e.Color != "" {
+			if _, err := parseColor(e.Color); err != nil {
+				return fmt.Errorf("entry %d: color %q: %w", i, e.Color, err)
+			}
+		}
+		if e.Duration < 0 || e.Loops < 0 || e.Weight < 0 {
+			return fmt.Errorf("entry %d: duration, loops, and weight must be >= 0: %w", i, ErrInvalidValue)
+		}
+	}
+
+	return nil
+}
+
+// parseColor converts "#rrggbb" to a 3-byte Frame.
+func parseColor(s string) (Frame, error) {
+	if len(s) != 7 || s[0] != '#' {
+		return nil, ErrInvalidColor
+	}
+
+	b, err := hex.DecodeString(s[1:])
+	if err != nil {
+		return nil, ErrInvalidColor
+	}
+
+	return b, nil
+}
+
+// PlaylistPlayer is a Renderer that plays each entry of a Playlist in turn.
+type PlaylistPlayer struct {
+	mu       sync.Mutex
+	playlist *Playlist
+	sender   *Sender
+	order    []int
+	pos      int
+	history  []int
+	entry    int
+	decoder  *Decoder
+	renderer Renderer
+	started  time.Time
+	held     bool
+	closed   bool
+}
+
+// NewPlaylistPlayer starts playing the first playable entry of pl.
+func NewPlaylistPlayer(pl *Playlist, s *Sender) (*PlaylistPlayer, error) {
+	p := &PlaylistPlayer{
+		playlist: pl,
+		sender:   s,
+		pos:      -1,
+		entry:    -1,
+	}
+
+	if !p.advance() {
+		return nil, ErrNoPlayableEntry
+	}
+
+	return p, nil
+}
+
+// nextEntry picks the index of the entry to play after the current one.
+func (p *PlaylistPlayer) nextEntry() int {
+	entries := p.playlist.Entries
+
+	if p.playlist.Order == OrderWeighted {
+		total := 0
+		for _, e := range entries {
+			total += entryWeight(e)
+		}
+		n := rand.Intn(total)
+		for i, e := range entries {
+			n -= entryWeight(e)
+			if n < 0 {
+				return i
+			}
+		}
+	}
+
+	p.pos++
+	if p.pos >= len(p.order) {
+		p.pos = 0
+		if p.playlist.Order == OrderShuffle {
+			p.order = rand.Perm(len(entries))
+		} else if len(p.order) != len(entries) {
+			p.order = make([]int, len(entries))
+			for i := range p.order {
+				p.order[i] = i
+			}
+		}
+	}
+
+	return p.order[p.pos]
+}
+
+func entryWeight(e PlaylistEntry) int {
+	if e.Weight <= 0 {
+		return 1
+	}
+	return e.Weight
+}
+
+// advance starts the next playable entry, returning false if none of them
+// can be played.
+func (p *PlaylistPlayer) advance() bool {
+	for tries := 0; tries < len(p.playlist.Entries)*2; tries++ {
+		if p.start(p.nextEntry()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// start switches to entry i, recording the previous entry in history.
+func (p *PlaylistPlayer) start(i int) bool {
+	e := p.playlist.Entries[i]
+
+	decoder := NewPatternDecoder(e.Image)
+	if decoder == nil {
+		log.Println("Playlist", p.playlist.Name, "skipping", e.Image)
+		return false
+	}
+
+	c := currentConfig()
+	p.renderer = NewTransition(p.renderer, decoder, c.Transition, time.Duration(c.FrameDelay))
+	if p.entry >= 0 {
+		p.history = append(p.history, p.entry)
+		if len(p.history) > maxPlaylistHistory {
+			p.history = p.history[1:]
+		}
+	}
+
+	playing := p.entry >= 0
+	p.entry = i
+	p.decoder = decoder
+	p.started = time.Now()
+
+	// The Streamer asks for the first entry's effects when it starts
+	// playing us.
+	if playing {
+		p.sender.SetPattern(p.effects())
+	}
+
+	return true
+}
+
+// effects returns the brightness and color filter the current entry asks
+// for, or failing that its pattern.
+func (p *PlaylistPlayer) effects() (int, Frame) {
+	e := p.playlist.Entries[p.entry]
+	brightness, color := p.decoder.Effects()
+	if e.Brightness > 0 {
+		brightness = e.Brightness
+	}
+	if e.Color != "" {
+		if c, err := parseColor(e.Color); err == nil {
+			color = c
+		}
+	}
+
+	return brightness, color
+}
+
+// Effects returns the brightness and color filter the current entry asks
+// for.
+func (p *PlaylistPlayer) Effects() (int, Frame) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.effects()
+}
+
+// done returns true once the current entry has played for its duration or
+// number of loops.
+func (p *PlaylistPlayer) done() bool {
+	e := p.playlist.Entries[p.entry]
+
+	if e.Duration > 0 && time.Since(p.started) >= time.Duration(e.Duration) {
+		return true
+	}
+
+	loops := e.Loops
+	if loops == 0 && e.Duration == 0 {
+		loops = p.decoder.Meta().Loops
+	}
+	if loops == 0 && e.Duration == 0 {
+		loops = 1
+	}
+
+	return loops > 0 && p.decoder.Loops() >= loops
+}
+
+// Control applies "next", "previous", "hold", or "resume".
+func (p *PlaylistPlayer) Control(cmd string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return ErrNoPlaylist
+	}
+
+	switch cmd {
+	case "next":
+		p.advance()
+	case "previous":
+		for len(p.history) > 0 {
+			i := p.history[len(p.history)-1]
+			p.history = p.history[:len(p.history)-1]
+			if p.start(i) {
+				// Don't let start() push the entry we're leaving.
+				p.history = p.history[:len(p.history)-1]
+				p.syncPos(i)
+				break
+			}
+		}
+	case "hold":
+		p.held = true
+	case "resume":
+		p.held = false
+		p.started = time.Now()
+	default:
+		return ErrUnknownControl
+	}
+
+	return nil
+}
+
+// syncPos moves the sequential/shuffle position to entry i, so "next"
+// continues from there.
+func (p *PlaylistPlayer) syncPos(i int) {
+	for pos, e := range p.order {
+		if e == i {
+			p.pos = pos
+			return
+		}
+	}
+}
+
+// State describes what a PlaylistPlayer is currently doing.
+type PlaylistState struct {
+	Name    string        `json:"name"`
+	Entry   int           `json:"entry"`
+	Image   string        `json:"image"`
+	Held    bool          `json:"held"`
+	Elapsed Duration      `json:"elapsed"`
+	Current PlaylistEntry `json:"current"`
+}
+
+func (p *PlaylistPlayer) State() PlaylistState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e := p.playlist.Entries[p.entry]
+	return PlaylistState{
+		Name:    p.playlist.Name,
+		Entry:   p.entry,
+		Image:   e.Image,
+		Held:    p.held,
+		Elapsed: Duration(time.Since(p.started).Truncate(time.Second)),
+		Current: e,
+	}
+}
+
+// Playback controls the current entry's Decoder.
+func (p *PlaylistPlayer) Playback(pc *PlaybackCommand) (PlaybackState, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.decoder.Playback(pc)
+}
+
+func (p *PlaylistPlayer) Render(fc *FrameContext) Frame {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.held && p.done() {
+		p.advance()
+	}
+
+	f := p.renderer.Render(fc)
+	p.renderer, _ = settle(p.renderer)
+
+	return f
+}
+
+// Schema describes the current entry's params.
+func (p *PlaylistPlayer) Schema() []ParamSpec {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.renderer.Schema()
+}
+
+// Params returns the current entry's params.
+func (p *PlaylistPlayer) Params() Params {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.renderer.Params()
+}
+
+// SetParams changes the current entry's params.
+func (p *PlaylistPlayer) SetParams(params Params) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.renderer.SetParams(params)
+}
+
+// Reset starts the playlist over from its first entry.
+func (p *PlaylistPlayer) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pos = -1
+	p.order = nil
+	p.history = p.history[:0]
+	p.entry = -1
+	p.advance()
+}
+
+// Duration returns how long it takes to play every entry once, if every
+// entry has a fixed duration and they aren't picked at random.
+func (p *PlaylistPlayer) Duration() (time.Duration, bool) {
+	if p.playlist.Order == OrderWeighted {
+		return 0, false
+	}
+
+	var total time.Duration
+	for _, e := range p.playlist.Entries {
+		if e.Duration <= 0 {
+			return 0, false
+		}
+		total += time.Duration(e.Duration)
+	}
+
+	return total, true
+}
+
+func (p *PlaylistPlayer) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	p.renderer.Close()
+}
+
+// Playlists loads and saves Playlist files in a directory, and keeps
+// track of which one is playing.
+type Playlists struct {
+	Dir      string
+	Streamer *Streamer
+	Sender   *Sender
+
+	mu     sync.Mutex
+	active *PlaylistPlayer
+}
+
+func (ps *Playlists) path(name string) string {
+	return ps.Dir + name + ".json"
+}
+
+// List returns the names of all saved playlists.
+func (ps *Playlists) List() ([]string, error) {
+	files, err := ioutil.ReadDir(ps.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	names := []string{}
+	for _, file := range files {
+		n := file.Name()
+		if strings.HasSuffix(n, ".json") && !strings.HasPrefix(n, ".") && !file.IsDir() {
+			names = append(names, strings.TrimSuffix(n, ".json"))
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Load reads and validates the named playlist.
+func (ps *Playlists) Load(name string) (*Playlist, error) {
+	if !validPatternName(name) {
+		return nil, ErrInvalidName
+	}
+
+	b, err := ioutil.ReadFile(ps.path(name))
+	if err != nil {
+		return nil, err
+	}
+
+	pl := &Playlist{}
+	if err := json.Unmarshal(b, pl); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	pl.Name = name
+
+	if err := pl.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return pl, nil
+}
+
+// Save validates and writes a playlist, replacing any existing one.
+func (ps *Playlists) Save(pl *Playlist) error {
+	if err := pl.Validate(); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(pl, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(ps.Dir, 0o755); err != nil {
+		return err
+	}
+
+	tmp := ps.path("." + pl.Name)
+	if err := ioutil.WriteFile(tmp, b, 0o644); err != nil { //nolint:gosec // Served publicly anyway.
+		return err
+	}
+
+	return os.Rename(tmp, ps.path(pl.Name))
+}
+
+// Delete removes the named playlist.
+func (ps *Playlists) Delete(name string) error {
+	if !validPatternName(name) {
+		return ErrInvalidName
+	}
+
+	return os.Remove(ps.path(name))
+}
+
+// Play loads the named playlist and hands it to the Streamer.
+func (ps *Playlists) Play(name string) error {
+	_, err := ps.play(name)
+	return err
+}
+
+// play starts the named playlist, returning its player.
+func (ps *Playlists) play(name string) (*PlaylistPlayer, error) {
+	pl, err := ps.Load(name)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := NewPlaylistPlayer(pl, ps.Sender)
+	if err != nil {
+		return nil, err
+	}
+
+	ps.mu.Lock()
+	ps.active = p
+	ps.mu.Unlock()
+
+	ps.Streamer.SetRenderer(p)
+
+	return p, nil
+}
+
+// Active returns the playing PlaylistPlayer, or nil if something else has
+// replaced it.
+func (ps *Playlists) Active() *PlaylistPlayer {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.active != nil {
+		ps.active.mu.Lock()
+		closed := ps.active.closed
+		ps.active.mu.Unlock()
+		if closed {
+			ps.active = nil
+		}
+	}
+
+	return ps.active
+}
+
+// Control sends "next", "previous", "hold", or "resume" to the playing
+// playlist.
+func (ps *Playlists) Control(cmd string) error {
+	p := ps.Active()
+	if p == nil {
+		return ErrNoPlaylist
+	}
+
+	return p.Control(cmd)
+}
+
+// ServeHTTP handles the playlist API.  Saving and deleting playlists
+// requires the api_token.
+//
+//	GET    /api/playlists/              list playlists and what's playing
+//	GET    /api/playlists/<name>        fetch a playlist
+//	PUT    /api/playlists/<name>        create or replace a playlist
+//	DELETE /api/playlists/<name>        delete a playlist
+//	POST   /api/playlists/<name>/play   start playing a playlist
+//	POST   /api/playlists/-/<control>   next, previous, hold, or resume
+func (ps *Playlists) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, action := splitTwo(strings.TrimPrefix(r.URL.Path, "/api/playlists/"), "/")
+
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		names, err := ps.List()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list := struct {
+			Playlists []string       `json:"playlists"`
+			Playing   *PlaylistState `json:"playing,omitempty"`
+		}{Playlists: names}
+		if p := ps.Active(); p != nil {
+			state := p.State()
+			list.Playing = &state
+		}
+		writeJSON(w, list)
+	case name == "-" && r.Method == http.MethodPost:
+		p := ps.Active()
+		if p == nil {
+			http.Error(w, ErrNoPlaylist.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := p.Control(action); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, p.State())
+	case action == "play" && r.Method == http.MethodPost:
+		p, err := ps.play(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, p.State())
+	case action != "":
+		http.NotFound(w, r)
+	case r.Method == http.MethodGet:
+		pl, err := ps.Load(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, pl)
+	case r.Method == http.MethodPut:
+		if !authorized(w, r) {
+			return
+		}
+		pl := &Playlist{}
+		if err := readJSON(r, pl); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pl.Name = name
+		if err := ps.Save(pl); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, pl)
+	case r.Method == http.MethodDelete:
+		if !authorized(w, r) {
+			return
+		}
+		if err := ps.Delete(name); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Simplified strings.SplitN() that always returns two strings.
+func splitTwo(s, sep string) (one, two string) {
+	if part := strings.SplitN(s, sep, 2); len(part) == 2 {
+		return part[0], part[1]
+	}
+
+	return s, ""
+}
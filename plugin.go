@@ -0,0 +1,726 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// A plugin is a WebAssembly module in plugins/<name>/plugin.wasm, with an
+// optional plugin.json describing its params:
+//
+//	{"params": [{"name": "speed", "type": "number", "default": 1, "min": 0, "max": 4}]}
+//
+// It's a WASI reactor with no files, environment or network, that exports:
+//
+//	memory
+//	init(pixels i32) i32
+//		Called before the first frame, whenever the number of pixels
+//		changes, and to start over.  Returns the address of a pixels*3
+//		byte RGB frame buffer in memory, or 0 if it failed.
+//	render(t, dt, level, amplitude f64)
+//		Draws the next frame into the buffer.  t is seconds since
+//		starting and dt the seconds this frame covers; level is the
+//		audio level from 0 to 1, and amplitude in volts.
+//	set_param(index i32, value f64)
+//		Optional.  Sets the index'th param from plugin.json: numbers as
+//		they are, bools as 0 or 1, enums as the index of their value,
+//		and colors as 0xrrggbb.  Called for every param after init, and
+//		again as they change.
+//
+// Anything written to stdout or stderr is logged.
+var (
+	ErrUnknownPlugin = errors.New("no such plugin")
+	ErrPluginABI     = errors.New("plugin must export memory, init and render")
+	ErrPluginFailed  = errors.New("plugin failed")
+)
+
+const (
+	// The most memory a plugin may use, in 64 KiB pages.
+	pluginMemoryPages = 1024
+
+	// The largest plugin.wasm loaded.
+	maxPluginSize = 32 << 20
+
+	// How long a plugin may take to load and to init.  Frames may take
+	// half the frame delay, or pluginMinRender if that's longer.
+	pluginInitTime  = 2 * time.Second
+	pluginMinRender = 5 * time.Millisecond
+)
+
+var pluginWatcher = &Watcher{}
+
+// PluginManifest is a plugin's plugin.json.
+type PluginManifest struct {
+	Params []ParamSpec `json:"params"`
+}
+
+func (pm *PluginManifest) Validate() error {
+	for i, spec := range pm.Params {
+		if spec.Name == "" {
+			return fmt.Errorf("param %d has no name: %w", i, ErrInvalidValue)
+		}
+		if spec.Type == ParamString {
+			return fmt.Errorf("%s: plugins can't have string params: %w", spec.Name, ErrParamType)
+		}
+		if err := spec.check(spec.Default); err != nil {
+			return fmt.Errorf("%s default: %w", spec.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// pluginModule is an instance of a plugin's WebAssembly module.
+type pluginModule struct {
+	runtime  wazero.Runtime
+	module   api.Module
+	init     api.Function
+	render   api.Function
+	setParam api.Function
+
+	// Where the frame buffer is.
+	buf uint32
+}
+
+// loadPluginModule compiles and instantiates the plugin in dir, sending
+// its output to the log.
+func loadPluginModule(name, dir string) (*pluginModule, error) {
+	f, err := os.Open(dir + "plugin.wasm")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(f, maxPluginSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxPluginSize {
+		return nil, fmt.Errorf("%s: larger than %d bytes: %w", name, maxPluginSize, ErrPluginFailed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pluginInitTime)
+	defer cancel()
+
+	config := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(pluginMemoryPages).
+		WithCloseOnContextDone(true)
+	pm := &pluginModule{runtime: wazero.NewRuntimeWithConfig(ctx, config)}
+
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, pm.runtime); err != nil {
+		pm.close()
+		return nil, err
+	}
+
+	output := &pluginLog{name: name}
+	pm.module, err = pm.runtime.InstantiateWithConfig(ctx, b, wazero.NewModuleConfig().
+		WithName(name).
+		WithStdout(output).
+		WithStderr(output).
+		WithStartFunctions("_initialize"))
+	if err != nil {
+		pm.close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	pm.init = pm.module.ExportedFunction("init")
+	pm.render = pm.module.ExportedFunction("render")
+	pm.setParam = pm.module.ExportedFunction("set_param")
+	if pm.module.Memory() == nil || pm.init == nil || pm.render == nil {
+		pm.close()
+		return nil, fmt.Errorf("%s: %w", name, ErrPluginABI)
+	}
+
+	return pm, nil
+}
+
+// call runs fn until ctx is done, after which the module is closed.
+func (pm *pluginModule) call(ctx context.Context, fn api.Function, params ...uint64) ([]uint64, error) {
+	results, err := fn.Call(ctx, params...)
+	if err != nil && ctx.Err() != nil {
+		return nil, fmt.Errorf("ran out of time: %w", ErrPluginFailed)
+	}
+
+	return results, err
+}
+
+// start calls init for pixels, then sets every param.
+func (pm *pluginModule) start(ctx context.Context, pixels int, values []float64) error {
+	results, err := pm.call(ctx, pm.init, api.EncodeI32(int32(pixels)))
+	if err != nil {
+		return fmt.Errorf("init: %w", err)
+	}
+	pm.buf = api.DecodeU32(results[0])
+	if _, ok := pm.module.Memory().Read(pm.buf, uint32(pixels*3)); pm.buf == 0 || !ok {
+		return fmt.Errorf("init returned no frame buffer: %w", ErrPluginFailed)
+	}
+
+	for i, v := range values {
+		if err := pm.set(ctx, i, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// set sets the i'th param, if the plugin takes params.
+func (pm *pluginModule) set(ctx context.Context, i int, v float64) error {
+	if pm.setParam == nil {
+		return nil
+	}
+	if _, err := pm.call(ctx, pm.setParam, api.EncodeI32(int32(i)), api.EncodeF64(v)); err != nil {
+		return fmt.Errorf("set_param: %w", err)
+	}
+
+	return nil
+}
+
+func (pm *pluginModule) close() {
+	pm.runtime.Close(context.Background())
+}
+
+// pluginLog logs each line a plugin writes.
+type pluginLog struct {
+	name string
+	line []byte
+}
+
+func (pl *pluginLog) Write(b []byte) (int, error) {
+	pl.line = append(pl.line, b...)
+	for {
+		i := bytes.IndexByte(pl.line, '\n')
+		if i < 0 {
+			break
+		}
+		log.Printf("Plugin %s: %s", pl.name, pl.line[:i])
+		pl.line = pl.line[i+1:]
+	}
+	if len(pl.line) > 1024 {
+		log.Printf("Plugin %s: %s", pl.name, pl.line)
+		pl.line = pl.line[:0]
+	}
+
+	return len(b), nil
+}
+
+// Plugin is a Renderer that runs a WebAssembly plugin, sandboxed and with
+// limits on its memory and how long it may take to draw each frame.  If it
+// fails, it shows black until its files change and it's reloaded.
+//
+// init runs in the background, showing black until it's done, so a slow
+// plugin can't hold up the Streamer for longer than a frame may take.
+// Params are passed on just before the next frame, within its time limit.
+type Plugin struct {
+	mu       sync.Mutex
+	name     string
+	dir      string
+	manifest PluginManifest
+	values   Params
+	module   *pluginModule
+	err      error
+	t        float64
+
+	// The number of pixels module was started for, or 0 if it needs
+	// starting.  While starting is true, init runs in the background and
+	// nothing else may call module, and cancel stops it.
+	pixels   int
+	starting bool
+	started  chan struct{}
+	cancel   context.CancelFunc
+
+	// The params changed since the last frame, by index.
+	pending map[int]float64
+
+	// The watcher's change counter for this plugin, and its value when
+	// last loaded.  loading is true while a newer version loads.
+	changes *uint64
+	seen    uint64
+	loading bool
+	closed  bool
+
+	// run is held while calling the module, other than to start it.
+	run sync.Mutex
+
+	out Frame
+}
+
+// NewPlugin loads the named plugin from plugins/ under the root dir, and
+// sets any params given.
+func NewPlugin(name string, p Params) (*Plugin, error) {
+	if !validPatternName(name) {
+		return nil, fmt.Errorf("%q: %w", name, ErrInvalidName)
+	}
+
+	changes := pluginWatcher.version(name)
+	pl := &Plugin{
+		name:    name,
+		dir:     currentConfig().RootDir + "plugins/" + name + "/",
+		changes: changes,
+		seen:    atomic.LoadUint64(changes),
+	}
+	if _, err := os.Stat(pl.dir + "plugin.wasm"); os.IsNotExist(err) {
+		return nil, fmt.Errorf("%q: %w", name, ErrUnknownPlugin)
+	}
+
+	manifest, module, err := pl.load()
+	if err != nil {
+		return nil, err
+	}
+	pl.manifest, pl.module = manifest, module
+	pl.values = Params{}
+	for _, spec := range manifest.Params {
+		pl.values[spec.Name] = spec.Default
+	}
+
+	if err := pl.SetParams(p); err != nil {
+		pl.Close()
+		return nil, err
+	}
+
+	return pl, nil
+}
+
+// load reads the plugin's manifest and loads its module.
+func (pl *Plugin) load() (PluginManifest, *pluginModule, error) {
+	manifest := PluginManifest{}
+	b, err := ioutil.ReadFile(pl.dir + "plugin.json")
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			return manifest, nil, fmt.Errorf("%s: plugin.json: %w", pl.name, err)
+		}
+		if err := manifest.Validate(); err != nil {
+			return manifest, nil, fmt.Errorf("%s: plugin.json: %w", pl.name, err)
+		}
+	case !os.IsNotExist(err):
+		return manifest, nil, err
+	}
+
+	module, err := loadPluginModule(pl.name, pl.dir)
+	return manifest, module, err
+}
+
+// Name returns which plugin this is.
+func (pl *Plugin) Name() string {
+	return pl.name
+}
+
+func (pl *Plugin) Render(fc *FrameContext) Frame {
+	limit := fc.Delta / 2
+	if limit < pluginMinRender {
+		limit = pluginMinRender
+	}
+
+	pl.out = grow(pl.out, fc.Pixels*3)
+	pm, t, pending, ok := pl.ready(fc, limit)
+	if !ok {
+		for i := range pl.out {
+			pl.out[i] = 0
+		}
+		return pl.out
+	}
+
+	pl.run.Lock()
+	err := pl.render(pm, t, pending, limit, fc)
+	pl.run.Unlock()
+	if err != nil {
+		pl.fail(pm, err)
+		for i := range pl.out {
+			pl.out[i] = 0
+		}
+	}
+
+	return pl.out
+}
+
+// ready returns the module to render fc with, the time to draw it for, and
+// the params to pass on first.  If the module needs starting, it starts it
+// in the background and waits up to limit for it.
+func (pl *Plugin) ready(fc *FrameContext, limit time.Duration) (*pluginModule, float64, map[int]float64, bool) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	if seen := atomic.LoadUint64(pl.changes); seen != pl.seen && !pl.loading {
+		pl.loading = true
+		go pl.reload(seen)
+	}
+
+	pl.t += fc.Delta.Seconds()
+	pm := pl.module
+	if pm == nil || pl.err != nil {
+		return nil, 0, nil, false
+	}
+
+	if !pl.starting && pl.pixels != fc.Pixels {
+		ctx, cancel := context.WithTimeout(context.Background(), pluginInitTime)
+		pl.pixels, pl.pending = fc.Pixels, nil
+		pl.starting, pl.started, pl.cancel = true, make(chan struct{}), cancel
+		go pl.start(ctx, pm, fc.Pixels, pl.encoded())
+	}
+	if pl.starting {
+		started := pl.started
+		pl.mu.Unlock()
+		timer := time.NewTimer(limit)
+		select {
+		case <-started:
+		case <-timer.C:
+		}
+		timer.Stop()
+		pl.mu.Lock()
+
+		if pl.starting || pm != pl.module || pl.err != nil {
+			return nil, 0, nil, false
+		}
+	}
+
+	pending := pl.pending
+	pl.pending = nil
+
+	return pm, pl.t, pending, true
+}
+
+// start starts pm in the background for pixels with values for params.
+func (pl *Plugin) start(ctx context.Context, pm *pluginModule, pixels int, values []float64) {
+	err := pm.start(ctx, pixels, values)
+
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	pl.cancel()
+	pl.starting = false
+	close(pl.started)
+	if pm != pl.module {
+		// Closed or reloaded while starting.
+		pm.close()
+		return
+	}
+	if err != nil {
+		pl.failLocked(err)
+	}
+}
+
+func (pl *Plugin) render(pm *pluginModule, t float64, pending map[int]float64, limit time.Duration, fc *FrameContext) error {
+	ctx, cancel := context.WithTimeout(context.Background(), limit)
+	defer cancel()
+
+	for i, v := range pending {
+		if err := pm.set(ctx, i, v); err != nil {
+			return err
+		}
+	}
+
+	_, err := pm.call(ctx, pm.render,
+		api.EncodeF64(t),
+		api.EncodeF64(fc.Delta.Seconds()),
+		api.EncodeF64(fc.Audio.Level),
+		api.EncodeF64(fc.Audio.Amplitude))
+	if err != nil {
+		return fmt.Errorf("render: %w", err)
+	}
+
+	b, ok := pm.module.Memory().Read(pm.buf, uint32(len(pl.out)))
+	if !ok {
+		return fmt.Errorf("frame buffer is outside memory: %w", ErrPluginFailed)
+	}
+	copy(pl.out, b)
+
+	return nil
+}
+
+// fail stops running pm until the plugin's reloaded, if it's still the
+// plugin's module.
+func (pl *Plugin) fail(pm *pluginModule, err error) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	if pm == pl.module {
+		pl.failLocked(err)
+	}
+}
+
+func (pl *Plugin) failLocked(err error) {
+	log.Printf("Plugin %s: %v", pl.name, err)
+	pl.err = err
+}
+
+// reload loads the plugin again after its files change, carrying on with
+// the new version if it loads, or the old one if not.
+func (pl *Plugin) reload(seen uint64) {
+	manifest, module, err := pl.load()
+
+	pl.mu.Lock()
+	pl.loading, pl.seen = false, seen
+	if pl.closed {
+		pl.mu.Unlock()
+		if module != nil {
+			module.close()
+		}
+		return
+	}
+	if err != nil {
+		pl.mu.Unlock()
+		log.Printf("Plugin %s: not reloaded: %v", pl.name, err)
+		return
+	}
+
+	old := pl.module
+	pl.manifest, pl.module, pl.err = manifest, module, nil
+	pl.pixels, pl.pending = 0, nil
+
+	// Keep the params the new version still has, if they're still valid.
+	values := Params{}
+	for _, spec := range manifest.Params {
+		values[spec.Name] = spec.Default
+		if v, ok := pl.values[spec.Name]; ok && spec.check(v) == nil {
+			values[spec.Name] = v
+		}
+	}
+	pl.values = values
+
+	starting := pl.starting
+	if starting {
+		pl.cancel()
+	}
+	pl.mu.Unlock()
+
+	pl.retire(old, starting)
+}
+
+// retire closes pm once nothing's using it.  If it was starting, start
+// closes it instead.
+func (pl *Plugin) retire(pm *pluginModule, starting bool) {
+	if pm == nil || starting {
+		return
+	}
+
+	pl.run.Lock()
+	pm.close()
+	pl.run.Unlock()
+}
+
+// encodeParam returns v as the float64 that set_param takes for spec.
+func encodeParam(spec ParamSpec, v interface{}) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case int:
+		return float64(v)
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case string:
+		if spec.Type == ParamColor {
+			c, _ := parseColor(v)
+			return float64(int(c[0])<<16 | int(c[1])<<8 | int(c[2]))
+		}
+		for i, value := range spec.Enum {
+			if v == value {
+				return float64(i)
+			}
+		}
+	}
+
+	return math.NaN()
+}
+
+// encoded returns every param's value as set_param takes it.
+func (pl *Plugin) encoded() []float64 {
+	values := make([]float64, len(pl.manifest.Params))
+	for i, spec := range pl.manifest.Params {
+		values[i] = encodeParam(spec, pl.values[spec.Name])
+	}
+
+	return values
+}
+
+// Schema returns the params from the plugin's plugin.json.
+func (pl *Plugin) Schema() []ParamSpec {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	return append([]ParamSpec{}, pl.manifest.Params...)
+}
+
+// Params returns the plugin's params.
+func (pl *Plugin) Params() Params {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	p := Params{}
+	for name, v := range pl.values {
+		p[name] = v
+	}
+
+	return p
+}
+
+// SetParams changes the plugin's params, to be passed on to it before the
+// next frame.
+func (pl *Plugin) SetParams(p Params) error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	names := make([]string, len(pl.manifest.Params))
+	for i, spec := range pl.manifest.Params {
+		names[i] = spec.Name
+	}
+	if err := p.only(names...); err != nil {
+		return err
+	}
+	for _, spec := range pl.manifest.Params {
+		if v, ok := p[spec.Name]; ok {
+			if err := spec.check(v); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, spec := range pl.manifest.Params {
+		v, ok := p[spec.Name]
+		if !ok {
+			continue
+		}
+		pl.values[spec.Name] = v
+		if pl.pending == nil {
+			pl.pending = map[int]float64{}
+		}
+		pl.pending[i] = encodeParam(spec, v)
+	}
+
+	return nil
+}
+
+// Reset starts the plugin over from time zero, calling init again.
+func (pl *Plugin) Reset() {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	pl.t = 0
+	pl.pixels = 0
+}
+
+// Duration returns false, since plugins go on forever.
+func (pl *Plugin) Duration() (time.Duration, bool) {
+	return 0, false
+}
+
+func (pl *Plugin) Close() {
+	pl.mu.Lock()
+	old, starting := pl.module, pl.starting
+	pl.module, pl.closed = nil, true
+	if starting {
+		pl.cancel()
+	}
+	pl.mu.Unlock()
+
+	pl.retire(old, starting)
+}
+
+// PluginNames returns the names of the plugins in dir, sorted.
+func PluginNames(dir string) []string {
+	dirs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, d := range dirs {
+		if _, err := os.Stat(dir + d.Name() + "/plugin.wasm"); err == nil && validPatternName(d.Name()) {
+			names = append(names, d.Name())
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// pluginOf returns the Plugin that r is playing, if any.
+func pluginOf(r Renderer) (*Plugin, bool) {
+	switch f := r.(type) {
+	case *Transition:
+		return pluginOf(f.to)
+	case *Plugin:
+		return f, true
+	}
+
+	return nil, false
+}
+
+// PluginCommand starts the named plugin, or changes the params of the one
+// that's playing if it's the same.
+type PluginCommand struct {
+	Name   string `json:"name"`
+	Params Params `json:"params,omitempty"`
+}
+
+// PlayPlugin carries out pc.
+func (t *Streamer) PlayPlugin(pc *PluginCommand) error {
+	if pl, ok := pluginOf(t.Current()); ok && pl.Name() == pc.Name {
+		return pl.SetParams(pc.Params)
+	}
+
+	pl, err := NewPlugin(pc.Name, pc.Params)
+	if err != nil {
+		return err
+	}
+	t.SetRenderer(pl)
+
+	return nil
+}
+
+// PluginHandler serves the plugin API:
+//
+//	GET  /api/plugins   the names of the plugins
+//	POST /api/plugins   run a PluginCommand
+type PluginHandler struct {
+	Streamer *Streamer
+	Dir      string
+}
+
+func (h *PluginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		names := PluginNames(h.Dir)
+		if names == nil {
+			names = []string{}
+		}
+		writeJSON(w, names)
+	case http.MethodPost:
+		pc := &PluginCommand{}
+		if err := readJSON(r, pc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.Streamer.PlayPlugin(pc); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrUnknownPlugin) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
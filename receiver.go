@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"log"
 	"strconv"
-	"strings"
 )
 
 type Incoming struct {
@@ -14,9 +13,23 @@ type Incoming struct {
 	AudioDimming string `json:"audio_dimming"`
 	Color        string `json:"color"`
 	PixelList    string `json:"pixel_list"`
+
+	Playlist        string `json:"playlist"`
+	PlaylistControl string `json:"playlist_control"`
+
+	Script        string `json:"script"`
+	ScriptControl string `json:"script_control"`
+
+	Layer      *LayerCommand      `json:"layer"`
+	Playback   *PlaybackCommand   `json:"playback"`
+	Generator  *GeneratorCommand  `json:"generator"`
+	Params     *ParamsCommand     `json:"params"`
+	Expression *ExpressionCommand `json:"expression"`
+	Plugin     *PluginCommand     `json:"plugin"`
+	Texture    *TextureCommand    `json:"texture"`
 }
 
-func Receiver(incoming <-chan []byte, t *Streamer, s *Sender) {
+func Receiver(incoming <-chan []byte, t *Streamer, s *Sender, ps *Playlists, c *Compositor, pp *ParamsPublisher, eh *ExpressionHandler, ss *Scripts) {
 	for b := range incoming {
 		incoming := Incoming{}
 		err := json.Unmarshal(b, &incoming)
@@ -28,20 +41,19 @@ func Receiver(incoming <-chan []byte, t *Streamer, s *Sender) {
 		if incoming.Brightness != "" {
 			brightness, err := strconv.Atoi(incoming.Brightness)
 			if err == nil && brightness >= 0 && brightness <= 255 {
-				s.MaxBrightness = brightness
+				s.SetMaxBrightness(brightness)
 			}
 		}
 		if incoming.AudioDimming != "" {
 			audioDimming, err := strconv.Atoi(incoming.AudioDimming)
 			if err == nil && audioDimming >= 0 && audioDimming <= 255 {
-				s.AudioDimming = audioDimming
+				s.SetAudioDimming(audioDimming)
 			}
 		}
-		if incoming.Image != "" && !strings.Contains(incoming.Image, "/") {
-			imagePath := *rootDir + "images/" + incoming.Image + "/"
-			decoder := NewDecoder(imagePath)
+		if incoming.Image != "" {
+			decoder := NewPatternDecoder(incoming.Image)
 			if decoder != nil {
-				t.SetFramer(decoder)
+				t.SetRenderer(decoder)
 			}
 		}
 		if incoming.Color != "" && incoming.Color[0] == '#' {
@@ -50,11 +62,69 @@ func Receiver(incoming <-chan []byte, t *Streamer, s *Sender) {
 				s.SetColorFilter(b)
 			}
 		}
+		if incoming.Playlist != "" {
+			if err := ps.Play(incoming.Playlist); err != nil {
+				log.Println("reader: Error playing playlist", err)
+			}
+		}
+		if incoming.PlaylistControl != "" {
+			if err := ps.Control(incoming.PlaylistControl); err != nil {
+				log.Println("reader: Playlist control", err)
+			}
+		}
+		if incoming.Layer != nil {
+			if err := c.Do(incoming.Layer, t); err != nil {
+				log.Println("reader: Layer", err)
+			}
+		}
+		if incoming.Playback != nil {
+			if _, err := t.Playback(incoming.Playback); err != nil {
+				log.Println("reader: Playback", err)
+			}
+		}
+		if incoming.Generator != nil {
+			if _, err := t.Generate(incoming.Generator); err != nil {
+				log.Println("reader: Generator", err)
+			}
+		}
+		if incoming.Params != nil {
+			if _, err := pp.Do(incoming.Params); err != nil {
+				log.Println("reader: Params", err)
+			}
+		}
+		if incoming.Expression != nil {
+			if _, err := eh.Do(incoming.Expression); err != nil {
+				log.Println("reader: Expression", err)
+			}
+		}
+		if incoming.Plugin != nil {
+			if err := t.PlayPlugin(incoming.Plugin); err != nil {
+				log.Println("reader: Plugin", err)
+			}
+		}
+		if incoming.Texture != nil {
+			if err := t.PlayTexture(incoming.Texture); err != nil {
+				log.Println("reader: Texture", err)
+			}
+		}
+		if incoming.Script != "" {
+			if err := ss.Start(incoming.Script); err != nil {
+				log.Println("reader: Script", err)
+			}
+		}
+		if incoming.ScriptControl != "" {
+			if err := ss.Control(incoming.ScriptControl); err != nil {
+				log.Println("reader: ScriptControl", err)
+			}
+		}
 		if incoming.PixelList != "" {
-			f, err := PixelListToFrame(*numPixels, incoming.PixelList)
+			f, err := PixelListToFrame(currentConfig().NumPixels, incoming.PixelList)
 			if err == nil {
-				t.SetFramer(f)
+				t.SetRenderer(f)
 			}
 		}
+
+		// Most of the above can change params, so let clients know.
+		pp.Changed()
 	}
 }
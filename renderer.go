@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnknownParam = errors.New("unknown param")
+	ErrParamType    = errors.New("param has the wrong type")
+)
+
+// FrameContext tells a Renderer about the frame it's drawing.
+type FrameContext struct {
+	// When the frame is being drawn, and how much stream time has passed
+	// since the Streamer started, counting each frame as Delta.
+	Now  time.Time
+	Time time.Duration
+
+	// How much time this frame covers: the frame delay.
+	Delta time.Duration
+
+	// How many pixels the strip has.
+	Pixels int
+
+	// What the audio input is doing.
+	Audio AudioFeatures
+
+	// Where each pixel is: the layout in use, or a straight line.
+	Layout *Layout
+}
+
+// Params are a Renderer's adjustable settings, by name, with values as
+// they'd be decoded from JSON: float64, string, or bool.
+type Params map[string]interface{}
+
+// Renderer produces Frames like a Framer, but is told about each frame it
+// draws, and can be inspected and adjusted while it runs.  The same rules
+// apply to the Frames it returns: callers must not modify them, and they're
+// only valid until the next call to Render or Close.
+type Renderer interface {
+	Render(fc *FrameContext) Frame
+
+	// Schema describes the params, Params returns their current values,
+	// and SetParams changes any named in p, leaving the rest alone.  It
+	// changes nothing if any of them are invalid.
+	Schema() []ParamSpec
+	Params() Params
+	SetParams(p Params) error
+
+	// Reset starts over from the beginning.
+	Reset()
+
+	// Duration returns how long one pass through the content takes at the
+	// current settings, or false if it goes on forever.
+	Duration() (time.Duration, bool)
+
+	Close()
+}
+
+// AsRenderer adapts a Framer to a Renderer with no params, that can't be
+// reset and goes on forever.  Framers that are already Renderers are
+// returned as they are.
+func AsRenderer(f Framer) Renderer {
+	if r, ok := f.(Renderer); ok {
+		return r
+	}
+	return framerRenderer{f}
+}
+
+type framerRenderer struct {
+	Framer
+}
+
+func (fr framerRenderer) Render(*FrameContext) Frame {
+	return fr.NextFrame()
+}
+
+func (fr framerRenderer) Schema() []ParamSpec {
+	return nil
+}
+
+func (fr framerRenderer) Params() Params {
+	return Params{}
+}
+
+func (fr framerRenderer) SetParams(p Params) error {
+	return noParams(p)
+}
+
+func (fr framerRenderer) Reset() {
+}
+
+func (fr framerRenderer) Duration() (time.Duration, bool) {
+	return 0, false
+}
+
+// noParams is SetParams for Renderers without any.
+func noParams(p Params) error {
+	if len(p) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return fmt.Errorf("%s: %w", strings.Join(names, ", "), ErrUnknownParam)
+}
+
+// float returns the named param as a float64, if it's set.
+func (p Params) float(name string) (*float64, error) {
+	v, ok := p[name]
+	if !ok {
+		return nil, nil
+	}
+	switch v := v.(type) {
+	case float64:
+		return &v, nil
+	case int:
+		f := float64(v)
+		return &f, nil
+	}
+
+	return nil, fmt.Errorf("%s must be a number: %w", name, ErrParamType)
+}
+
+// string returns the named param as a string, if it's set.
+func (p Params) string(name string) (*string, error) {
+	v, ok := p[name]
+	if !ok {
+		return nil, nil
+	}
+	if s, ok := v.(string); ok {
+		return &s, nil
+	}
+
+	return nil, fmt.Errorf("%s must be a string: %w", name, ErrParamType)
+}
+
+// bool returns the named param as a bool, if it's set.
+func (p Params) bool(name string) (*bool, error) {
+	v, ok := p[name]
+	if !ok {
+		return nil, nil
+	}
+	if b, ok := v.(bool); ok {
+		return &b, nil
+	}
+
+	return nil, fmt.Errorf("%s must be true or false: %w", name, ErrParamType)
+}
+
+// only returns an error if p has any params not in names.
+func (p Params) only(names ...string) error {
+	rest := Params{}
+	for name, v := range p {
+		rest[name] = v
+	}
+	for _, name := range names {
+		delete(rest, name)
+	}
+
+	return noParams(rest)
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidTime  = errors.New(`must be "HH:MM", "sunrise", or "sunset", optionally followed by an offset like "+30m"`)
+	ErrNoAction     = errors.New("must set at least one of image, playlist, color, or brightness_cap")
+	ErrBothPatterns = errors.New("can't set both image and playlist")
+)
+
+// ScheduleAction is what to change when a ScheduleEntry or override takes
+// effect.  BrightnessCap limits MaxBrightness; 255 removes any cap, and 0
+// leaves it as it was.
+type ScheduleAction struct {
+	Image         string `json:"image,omitempty"`
+	Playlist      string `json:"playlist,omitempty"`
+	Color         string `json:"color,omitempty"`
+	BrightnessCap int    `json:"brightness_cap,omitempty"`
+}
+
+// ScheduleEntry applies an action every day at a time of day, or at an
+// offset from sunrise or sunset, like "03:00", "sunset", or "sunrise+30m".
+type ScheduleEntry struct {
+	At string `json:"at"`
+	ScheduleAction
+}
+
+// Schedule is the contents of the schedule file.
+type Schedule struct {
+	Entries []ScheduleEntry `json:"entries"`
+}
+
+// Override replaces the schedule until it expires.
+type Override struct {
+	ScheduleAction
+	Duration Duration  `json:"duration"`
+	Until    time.Time `json:"until"`
+}
+
+func (a *ScheduleAction) Validate() error {
+	if a.Image == "" && a.Playlist == "" && a.Color == "" && a.BrightnessCap == 0 {
+		return ErrNoAction
+	}
+	if a.Image != "" && a.Playlist != "" {
+		return ErrBothPatterns
+	}
+	if a.Image != "" && !validPatternName(a.Image) {
+		return fmt.Errorf("image %q: %w", a.Image, ErrInvalidName)
+	}
+	if a.Playlist != "" && !validPatternName(a.Playlist) {
+		return fmt.Errorf("playlist %q: %w", a.Playlist, ErrInvalidName)
+	}
+	if a.Color != "" {
+		if _, err := parseColor(a.Color); err != nil {
+			return fmt.Errorf("color %q: %w", a.Color, err)
+		}
+	}
+	if a.BrightnessCap < 0 || a.BrightnessCap > 255 {
+		return fmt.Errorf("brightness_cap %d must be >= 0 and <= 255: %w", a.BrightnessCap, ErrInvalidValue)
+	}
+
+	return nil
+}
+
+func (s *Schedule) Validate() error {
+	for i := range s.Entries {
+		e := &s.Entries[i]
+		if _, _, err := parseScheduleTime(e.At); err != nil {
+			return fmt.Errorf("entry %d: at %q: %w", i, e.At, err)
+		}
+		if err := e.ScheduleAction.Validate(); err != nil {
+			return fmt.Errorf("entry %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// parseScheduleTime splits "sunset-1h30m" into ("sunset", -90m), and
+// "21:30" into ("", 21h30m).
+func parseScheduleTime(at string) (base string, offset time.Duration, err error) {
+	at = strings.TrimSpace(at)
+	for _, b := range []string{"sunrise", "sunset"} {
+		if !strings.HasPrefix(at, b) {
+			continue
+		}
+		rest := at[len(b):]
+		if rest == "" {
+			return b, 0, nil
+		}
+		if rest[0] != '+' && rest[0] != '-' {
+			return "", 0, ErrInvalidTime
+		}
+		offset, err := time.ParseDuration(rest)
+		if err != nil {
+			return "", 0, ErrInvalidTime
+		}
+		return b, offset, nil
+	}
+
+	hs, ms := splitTwo(at, ":")
+	h, err := strconv.Atoi(hs)
+	if err != nil || h < 0 || h > 23 {
+		return "", 0, ErrInvalidTime
+	}
+	m, err := strconv.Atoi(ms)
+	if err != nil || m < 0 || m > 59 {
+		return "", 0, ErrInvalidTime
+	}
+
+	return "", time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// Scheduler switches patterns, color filters, and brightness caps at
+// configured times of day.
+type Scheduler struct {
+	File      string
+	Latitude  float64
+	Longitude float64
+	Streamer  *Streamer
+	Sender    *Sender
+	Playlists *Playlists
+
+	mu       sync.Mutex
+	schedule Schedule
+	override *Override
+	applied  time.Time
+	wake     chan struct{}
+
+	// What overrides replaced, to put back when they expire.
+	saved *savedLimits
+}
+
+// savedLimits are the Sender's limits from before an override, and which
+// of them overrides have changed.
+type savedLimits struct {
+	limits               senderLimits
+	brightnessCap, color bool
+}
+
+// ScheduledAction is a ScheduleEntry's occurrence on a specific day.
+type ScheduledAction struct {
+	ScheduleEntry
+	Time time.Time `json:"time"`
+}
+
+// Load reads and validates the schedule file.  A missing file is an empty
+// schedule.
+func (sc *Scheduler) Load() error {
+	schedule := Schedule{}
+
+	sc.mu.Lock()
+	file := sc.File
+	sc.mu.Unlock()
+
+	b, err := ioutil.ReadFile(file)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(b, &schedule); err != nil {
+			return fmt.Errorf("%s: %w", file, jsonErrorLine(b, err))
+		}
+		if err := schedule.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+
+	sc.mu.Lock()
+	sc.schedule = schedule
+	sc.applied = time.Time{}
+	sc.mu.Unlock()
+	sc.poke()
+
+	return nil
+}
+
+// Reconfigure changes the schedule file and location, and reloads.
+func (sc *Scheduler) Reconfigure(file string, lat, lon float64) error {
+	sc.mu.Lock()
+	sc.File = file
+	sc.Latitude = lat
+	sc.Longitude = lon
+	sc.mu.Unlock()
+
+	return sc.Load()
+}
+
+// poke wakes up Worker to apply a change.
+func (sc *Scheduler) poke() {
+	sc.mu.Lock()
+	wake := sc.wake
+	sc.mu.Unlock()
+
+	if wake == nil {
+		return
+	}
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// occurrences returns when each entry happens on the calendar day of date.
+func (sc *Scheduler) occurrences(date time.Time) []ScheduledAction {
+	day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
+	rise, set, sunOK := sunTimes(day, sc.Latitude, sc.Longitude)
+
+	o := make([]ScheduledAction, 0, len(sc.schedule.Entries))
+	for _, e := range sc.schedule.Entries {
+		base, offset, err := parseScheduleTime(e.At)
+		if err != nil {
+			continue
+		}
+
+		var t time.Time
+		switch base {
+		case "sunrise", "sunset":
+			if !sunOK {
+				continue
+			}
+			t = rise
+			if base == "sunset" {
+				t = set
+			}
+			t = t.Add(offset)
+		default:
+			// Not midnight plus offset, which is an hour out on days
+			// the clocks change.
+			h, m := int(offset/time.Hour), int(offset%time.Hour/time.Minute)
+			t = time.Date(day.Year(), day.Month(), day.Day(), h, m, 0, 0, day.Location())
+		}
+
+		o = append(o, ScheduledAction{ScheduleEntry: e, Time: t})
+	}
+
+	return o
+}
+
+// current returns the most recent and next scheduled actions as of now.
+func (sc *Scheduler) current(now time.Time) (active, next *ScheduledAction) {
+	for d := -1; d <= 1; d++ {
+		for _, a := range sc.occurrences(now.AddDate(0, 0, d)) {
+			a := a
+			if !a.Time.After(now) {
+				if active == nil || a.Time.After(active.Time) {
+					active = &a
+				}
+			} else if next == nil || a.Time.Before(next.Time) {
+				next = &a
+			}
+		}
+	}
+
+	return active, next
+}
+
+// apply makes the changes requested by an action.
+func (sc *Scheduler) apply(a *ScheduleAction) {
+	switch {
+	case a.Image != "":
+		decoder := NewPatternDecoder(a.Image)
+		if decoder == nil {
+			log.Println("Scheduler: no valid images in", a.Image)
+			break
+		}
+		sc.Streamer.SetRenderer(decoder)
+	case a.Playlist != "":
+		if err := sc.Playlists.Play(a.Playlist); err != nil {
+			log.Println("Scheduler: playlist", err)
+		}
+	}
+
+	if a.Color != "" {
+		if c, err := parseColor(a.Color); err == nil {
+			sc.Sender.SetColorFilter(c)
+		}
+	}
+
+	if a.BrightnessCap > 0 {
+		sc.Sender.SetBrightnessCap(a.BrightnessCap)
+	}
+}
+
+// update applies an override or scheduled action if it has changed since
+// the last call, and returns how long until something else might change.
+func (sc *Scheduler) update(now time.Time) time.Duration {
+	restore, action, wait := sc.due(now)
+	if restore != nil {
+		sc.Sender.setLimits(restore.limits, restore.brightnessCap, restore.color)
+	}
+	if action != nil {
+		sc.apply(action)
+	}
+
+	return wait
+}
+
+// due returns the limits to put back from before an override that has
+// expired, or nil; the override or scheduled action to apply if it has
+// changed since the last call, or nil; and how long until something else
+// might change.
+func (sc *Scheduler) due(now time.Time) (*savedLimits, *ScheduleAction, time.Duration) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	wait := time.Minute
+
+	var restore *savedLimits
+	if o := sc.override; o != nil {
+		if now.Before(o.Until) {
+			wait = minDuration(wait, o.Until.Sub(now))
+			if sc.applied.Equal(o.Until) {
+				return nil, nil, wait
+			}
+			log.Println("Scheduler: override until", o.Until.Format(time.Kitchen))
+			if sc.saved == nil {
+				sc.saved = &savedLimits{limits: sc.Sender.limits()}
+			}
+			sc.saved.brightnessCap = sc.saved.brightnessCap || o.BrightnessCap > 0
+			sc.saved.color = sc.saved.color || o.Color != ""
+			sc.applied = o.Until
+			a := o.ScheduleAction
+			return nil, &a, wait
+		}
+
+		sc.override = nil
+		sc.applied = time.Time{}
+		restore, sc.saved = sc.saved, nil
+	}
+
+	var action *ScheduleAction
+	active, next := sc.current(now)
+	if active != nil && !sc.applied.Equal(active.Time) {
+		log.Println("Scheduler: applying", active.At, "entry")
+		sc.applied = active.Time
+		action = &active.ScheduleAction
+	}
+	if next != nil {
+		wait = minDuration(wait, next.Time.Sub(now))
+	}
+
+	return restore, action, wait
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if b < a {
+		return b
+	}
+	return a
+}
+
+// Worker applies scheduled actions and overrides as their time comes.
+func (sc *Scheduler) Worker() {
+	wake := make(chan struct{}, 1)
+	sc.mu.Lock()
+	sc.wake = wake
+	sc.mu.Unlock()
+
+	for {
+		wait := sc.update(time.Now())
+		if wait < time.Second {
+			wait = time.Second
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-wake:
+			timer.Stop()
+		}
+	}
+}
+
+// SetOverride replaces the schedule with an action for a while.
+func (sc *Scheduler) SetOverride(o *Override) error {
+	if err := o.ScheduleAction.Validate(); err != nil {
+		return err
+	}
+	if o.Duration <= 0 {
+		return fmt.Errorf("duration must be > 0: %w", ErrInvalidValue)
+	}
+	o.Until = time.Now().Add(time.Duration(o.Duration))
+
+	sc.mu.Lock()
+	sc.override = o
+	sc.mu.Unlock()
+	sc.poke()
+
+	return nil
+}
+
+// ClearOverride returns to the schedule.
+func (sc *Scheduler) ClearOverride() {
+	sc.mu.Lock()
+	if sc.override != nil {
+		sc.override.Until = time.Now()
+	}
+	sc.mu.Unlock()
+	sc.poke()
+}
+
+// ScheduleState describes what is active now and what comes next.
+type ScheduleState struct {
+	Now      time.Time        `json:"now"`
+	Sunrise  *time.Time       `json:"sunrise,omitempty"`
+	Sunset   *time.Time       `json:"sunset,omitempty"`
+	Active   *ScheduledAction `json:"active,omitempty"`
+	Next     *ScheduledAction `json:"next,omitempty"`
+	Override *Override        `json:"override,omitempty"`
+	Entries  []ScheduleEntry  `json:"entries"`
+}
+
+func (sc *Scheduler) State() ScheduleState {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	now := time.Now()
+	state := ScheduleState{Now: now, Entries: sc.schedule.Entries}
+	if rise, set, ok := sunTimes(now, sc.Latitude, sc.Longitude); ok {
+		state.Sunrise = &rise
+		state.Sunset = &set
+	}
+	state.Active, state.Next = sc.current(now)
+	if sc.override != nil && now.Before(sc.override.Until) {
+		o := *sc.override
+		state.Override = &o
+	}
+	if state.Entries == nil {
+		state.Entries = []ScheduleEntry{}
+	}
+
+	return state
+}
+
+// ServeHTTP handles the schedule API:
+//
+//	GET    /api/schedule            what's active now and what comes next
+//	POST   /api/schedule/reload     re-read the schedule file
+//	POST   /api/schedule/override   override the schedule for a duration
+//	DELETE /api/schedule/override   cancel an override
+//
+// Reloading and overriding require the api_token.
+func (sc *Scheduler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/schedule"), "/"); {
+	case action == "" && r.Method == http.MethodGet:
+	case action == "reload" && r.Method == http.MethodPost:
+		if !authorized(w, r) {
+			return
+		}
+		if err := sc.Load(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case action == "override" && r.Method == http.MethodPost:
+		if !authorized(w, r) {
+			return
+		}
+		o := &Override{}
+		if err := readJSON(r, o); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := sc.SetOverride(o); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case action == "override" && r.Method == http.MethodDelete:
+		if !authorized(w, r) {
+			return
+		}
+		sc.ClearOverride()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	writeJSON(w, sc.State())
+}
@@ -0,0 +1,832 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// A script is a Lua program in scripts/<name>.lua that runs a show, for
+// example:
+//
+//	pattern("whisp", 10)        -- crossfade to whisp over 10 seconds
+//	wait(10)
+//	pattern("solid")
+//	color("#ff0000")
+//	on_audio(function(a) brightness(40 + 215 * a.level) end)
+//	wait(60)
+//	on_audio(nil)
+//	for _, name in ipairs({"fire", "rainbow", "waves"}) do
+//		generator(name)
+//		wait(30)
+//	end
+//
+// Scripts only have Lua's base, string, table and math libraries, with no
+// files, and with the string and table functions limited to making
+// strings of maxScriptString and tables of maxScriptTable.  They also
+// have these functions to run the show:
+//
+//	pattern(name[, seconds])        play a pattern, crossfading if given
+//	generator(name[, params])       play a generator, params a table
+//	plugin(name[, params])          play a plugin
+//	texture(name[, params])         project an image or video
+//	expression(source[, layout])    play a pixel expression
+//	playlist(name)                  play a playlist
+//	params(table)                   change the playing pattern's params
+//	brightness(0 to 255)            set the maximum brightness
+//	color("#rrggbb")                set the color filter
+//	fade(brightness, seconds)       fade the brightness over time
+//	wait(seconds)                   do nothing for a while
+//	on_audio(function(audio))       call function with each audio
+//	                                update while waiting or fading; the
+//	                                table has level, amplitude,
+//	                                max_amplitude and volts
+//	on_feedback(function(status))   likewise for controller feedback,
+//	                                with brightness (%) and watts
+//	audio()                         the latest audio table
+//	time()                          seconds since the script started
+//	print(...)                      log, and show on the control page
+//
+// Only one script runs at a time.  One that runs for scriptBusy without
+// waiting is stopped.
+var (
+	ErrNoScript     = errors.New("no script is running")
+	ErrScriptBusy   = errors.New("script ran too long without waiting")
+	ErrScriptMemory = errors.New("script used too much memory")
+	ErrScriptStop   = errors.New("script stopped")
+	ErrScriptLarge  = errors.New("script is too large")
+)
+
+const (
+	// How often audio and feedback are passed on during wait and fade.
+	scriptTick = 50 * time.Millisecond
+
+	scriptBusy    = 5 * time.Second
+	maxScriptSize = 64 << 10
+
+	// Lua has no allocation hooks, so a script's memory is bounded by
+	// the longest string and largest table the library functions will
+	// make, and by the size of its registry (the stack of values) and
+	// call stack.
+	maxScriptString   = 1 << 20
+	maxScriptTable    = 1 << 16
+	scriptRegistry    = 1 << 10
+	maxScriptRegistry = 1 << 16
+	scriptCallStack   = 200
+)
+
+// Scripts stores and runs show-control scripts.
+type Scripts struct {
+	Dir         string
+	Streamer    *Streamer
+	Sender      *Sender
+	Playlists   *Playlists
+	Params      *ParamsPublisher
+	Expressions *ExpressionHandler
+	Outgoing    chan<- []byte
+
+	// control is held while starting or stopping a script.
+	control sync.Mutex
+
+	mu      sync.Mutex
+	running *scriptRun
+}
+
+// ScriptsState lists the scripts and which is running.
+type ScriptsState struct {
+	Scripts []string `json:"scripts"`
+	Running string   `json:"running,omitempty"`
+}
+
+func (ss *Scripts) path(name string) string {
+	return ss.Dir + name + ".lua"
+}
+
+// List returns the names of the saved scripts.
+func (ss *Scripts) List() ([]string, error) {
+	files, err := ioutil.ReadDir(ss.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	names := []string{}
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name(), ".lua")
+		if !f.IsDir() && name != f.Name() && validPatternName(name) {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// Load returns the named script's source.
+func (ss *Scripts) Load(name string) (string, error) {
+	if !validPatternName(name) {
+		return "", ErrInvalidName
+	}
+
+	b, err := ioutil.ReadFile(ss.path(name))
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// Save checks the script's syntax and stores it.
+func (ss *Scripts) Save(name, source string) error {
+	if !validPatternName(name) {
+		return ErrInvalidName
+	}
+	if _, err := compileScript(name, source); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(ss.Dir, 0o755); err != nil {
+		return err
+	}
+	tmp := ss.path(name) + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(source), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, ss.path(name))
+}
+
+// Delete removes the named script.
+func (ss *Scripts) Delete(name string) error {
+	if !validPatternName(name) {
+		return ErrInvalidName
+	}
+
+	return os.Remove(ss.path(name))
+}
+
+// compileScript checks source and compiles it.
+func compileScript(name, source string) (*lua.FunctionProto, error) {
+	if len(source) > maxScriptSize {
+		return nil, fmt.Errorf("%s: %w", name, ErrScriptLarge)
+	}
+
+	chunk, err := parse.Parse(strings.NewReader(source), name)
+	if err != nil {
+		return nil, err
+	}
+
+	return lua.Compile(chunk, name)
+}
+
+// Running returns the name of the running script, or "".
+func (ss *Scripts) Running() string {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.running == nil {
+		return ""
+	}
+	return ss.running.name
+}
+
+// Start stops any running script, and starts the named one.
+func (ss *Scripts) Start(name string) error {
+	source, err := ss.Load(name)
+	if err != nil {
+		return err
+	}
+	proto, err := compileScript(name, source)
+	if err != nil {
+		return err
+	}
+
+	ss.control.Lock()
+	defer ss.control.Unlock()
+
+	ss.stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	run := &scriptRun{
+		ss:     ss,
+		name:   name,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		start:  time.Now(),
+	}
+
+	ss.mu.Lock()
+	ss.running = run
+	ss.mu.Unlock()
+
+	go run.run(proto)
+	ss.report("script_running", name)
+
+	return nil
+}
+
+// Stop stops the running script, and waits for it to finish.
+func (ss *Scripts) Stop() error {
+	ss.control.Lock()
+	defer ss.control.Unlock()
+
+	return ss.stop()
+}
+
+func (ss *Scripts) stop() error {
+	ss.mu.Lock()
+	run := ss.running
+	ss.mu.Unlock()
+
+	if run == nil {
+		return ErrNoScript
+	}
+	run.cancel()
+	<-run.done
+
+	return nil
+}
+
+// Control carries out a script control command: stop.
+func (ss *Scripts) Control(cmd string) error {
+	if cmd != "stop" {
+		return fmt.Errorf("%q: %w", cmd, ErrInvalidValue)
+	}
+
+	return ss.Stop()
+}
+
+// report sends a websocket message with one key.
+func (ss *Scripts) report(key, value string) {
+	if ss.Outgoing == nil {
+		return
+	}
+
+	b, err := json.Marshal(map[string]string{key: value})
+	if err != nil {
+		log.Println("Script:", err)
+		return
+	}
+
+	ss.Outgoing <- b
+}
+
+// scriptRun is a running script.
+type scriptRun struct {
+	ss     *Scripts
+	name   string
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	start  time.Time
+
+	// When the script last started running rather than waiting, in
+	// UnixNano, or 0 while it's waiting; and the error the watchdog
+	// stopped it with, if it did.
+	busy    int64
+	stopped atomic.Value
+
+	L         *lua.LState
+	onAudio   *lua.LFunction
+	onStatus  *lua.LFunction
+	statusSeq uint64
+}
+
+func (run *scriptRun) run(proto *lua.FunctionProto) {
+	defer close(run.done)
+
+	// The context is checked before every instruction, so cancelling
+	// it stops even a tight loop.
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   scriptCallStack,
+		RegistrySize:    scriptRegistry,
+		RegistryMaxSize: maxScriptRegistry,
+	})
+	defer L.Close()
+	run.L = L
+	run.open()
+	L.SetContext(run.ctx)
+
+	go run.watchdog()
+	atomic.StoreInt64(&run.busy, time.Now().UnixNano())
+
+	err := L.CallByParam(lua.P{Fn: L.NewFunctionFromProto(proto), Protect: true})
+	if stopped, ok := run.stopped.Load().(error); ok {
+		err = stopped
+	} else if run.ctx.Err() != nil {
+		err = ErrScriptStop
+	}
+	run.cancel()
+
+	if err != nil {
+		run.log(err.Error())
+	} else {
+		run.log("finished")
+	}
+
+	run.ss.mu.Lock()
+	if run.ss.running == run {
+		run.ss.running = nil
+	}
+	run.ss.mu.Unlock()
+
+	run.ss.report("script_running", "")
+}
+
+// watchdog stops the script if it runs for scriptBusy without waiting.
+func (run *scriptRun) watchdog() {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-run.ctx.Done():
+			return
+		case now := <-tick.C:
+			busy := atomic.LoadInt64(&run.busy)
+			if busy != 0 && now.Sub(time.Unix(0, busy)) > scriptBusy {
+				run.stop(ErrScriptBusy)
+				return
+			}
+		}
+	}
+}
+
+// stop has the watchdog stop the script with err.
+func (run *scriptRun) stop(err error) {
+	run.stopped.Store(err)
+	run.cancel()
+}
+
+// idle notes that the script is waiting, or running again.
+func (run *scriptRun) idle(waiting bool) {
+	if waiting {
+		atomic.StoreInt64(&run.busy, 0)
+	} else {
+		atomic.StoreInt64(&run.busy, time.Now().UnixNano())
+	}
+}
+
+// log logs a line from the script, and sends it to websocket clients.
+func (run *scriptRun) log(line string) {
+	log.Printf("Script %s: %s", run.name, line)
+	run.ss.report("script_log", run.name+": "+line)
+}
+
+// open sets up the libraries and functions scripts can use.
+func (run *scriptRun) open() {
+	L := run.L
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "require", "module", "_printregs"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	if str, ok := L.GetGlobal(lua.StringLibName).(*lua.LTable); ok {
+		str.RawSetString("rep", L.NewFunction(stringRep))
+		for _, name := range []string{"format", "gsub"} {
+			if fn, ok := str.RawGetString(name).(*lua.LFunction); ok {
+				str.RawSetString(name, L.NewFunction(limitStrings("string."+name, fn.GFunction)))
+			}
+		}
+	}
+	if tab, ok := L.GetGlobal(lua.TabLibName).(*lua.LTable); ok {
+		if fn, ok := tab.RawGetString("concat").(*lua.LFunction); ok {
+			tab.RawSetString("concat", L.NewFunction(tableConcat(fn.GFunction)))
+		}
+		if fn, ok := tab.RawGetString("insert").(*lua.LFunction); ok {
+			tab.RawSetString("insert", L.NewFunction(tableInsert(fn.GFunction)))
+		}
+	}
+
+	for name, fn := range map[string]lua.LGFunction{
+		"pattern":     run.pattern,
+		"generator":   run.generator,
+		"plugin":      run.plugin,
+		"texture":     run.texture,
+		"expression":  run.expression,
+		"playlist":    run.playlist,
+		"params":      run.params,
+		"brightness":  run.brightness,
+		"color":       run.color,
+		"fade":        run.fade,
+		"wait":        run.wait,
+		"on_audio":    run.setOnAudio,
+		"on_feedback": run.setOnFeedback,
+		"audio":       run.audio,
+		"time":        run.time,
+		"print":       run.print,
+	} {
+		L.SetGlobal(name, L.NewFunction(fn))
+	}
+}
+
+// tooLong raises ErrScriptMemory from the function name, which would make
+// a string longer than maxScriptString.
+func tooLong(L *lua.LState, name string) {
+	check(L, fmt.Errorf("%s: result would be longer than %d bytes: %w", name, maxScriptString, ErrScriptMemory))
+}
+
+// stringRep is string.rep, limited to making strings of maxScriptString.
+func stringRep(L *lua.LState) int {
+	s := L.CheckString(1)
+	n := L.CheckInt(2)
+	if n > 0 && len(s) > 0 && n > maxScriptString/len(s) {
+		tooLong(L, "string.rep")
+	}
+	if n < 0 {
+		n = 0
+	}
+	L.Push(lua.LString(strings.Repeat(s, n)))
+
+	return 1
+}
+
+// limitStrings wraps the function name so that it raises an error rather
+// than return a string longer than maxScriptString.  Its arguments are
+// limited too, so it can't make one much longer.
+func limitStrings(name string, fn lua.LGFunction) lua.LGFunction {
+	return func(L *lua.LState) int {
+		n := fn(L)
+		for i := L.GetTop() - n + 1; i <= L.GetTop(); i++ {
+			if s, ok := L.Get(i).(lua.LString); ok && len(s) > maxScriptString {
+				tooLong(L, name)
+			}
+		}
+
+		return n
+	}
+}
+
+// tableConcat wraps table.concat so that it raises an error rather than
+// make a string longer than maxScriptString.
+func tableConcat(fn lua.LGFunction) lua.LGFunction {
+	return func(L *lua.LState) int {
+		t := L.CheckTable(1)
+		sep := len(L.OptString(2, ""))
+		i := L.OptInt(3, 1)
+		j := L.OptInt(4, t.Len())
+
+		size := 0
+		for ; i <= j; i++ {
+			// Leave it to table.concat to raise an error about
+			// values it can't join.
+			v := t.RawGetInt(i)
+			if !lua.LVCanConvToString(v) {
+				break
+			}
+			size += len(lua.LVAsString(v))
+			if i < j {
+				size += sep
+			}
+			if size > maxScriptString {
+				tooLong(L, "table.concat")
+			}
+		}
+
+		return fn(L)
+	}
+}
+
+// tableInsert wraps table.insert so that it raises an error rather than
+// grow a table past maxScriptTable.
+func tableInsert(fn lua.LGFunction) lua.LGFunction {
+	return func(L *lua.LState) int {
+		if L.CheckTable(1).Len() >= maxScriptTable {
+			check(L, fmt.Errorf("table.insert: table would have more than %d elements: %w", maxScriptTable, ErrScriptMemory))
+		}
+
+		return fn(L)
+	}
+}
+
+// check raises err as a Lua error, if it's set.
+func check(L *lua.LState, err error) {
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+}
+
+// luaParams converts a table of params to Params.
+func luaParams(L *lua.LState, t *lua.LTable) Params {
+	p := Params{}
+	if t == nil {
+		return p
+	}
+
+	t.ForEach(func(k, v lua.LValue) {
+		switch v := v.(type) {
+		case lua.LNumber:
+			p[k.String()] = float64(v)
+		case lua.LBool:
+			p[k.String()] = bool(v)
+		default:
+			p[k.String()] = v.String()
+		}
+	})
+
+	return p
+}
+
+func (run *scriptRun) pattern(L *lua.LState) int {
+	name := L.CheckString(1)
+	seconds := float64(L.OptNumber(2, 0))
+
+	decoder := NewPatternDecoder(name)
+	if decoder == nil {
+		L.RaiseError("%q: no such pattern, or it has no images", name)
+	}
+	if seconds > 0 {
+		run.ss.Streamer.TransitionTo(decoder, TransitionConfig{
+			Type:     TransitionCrossfade,
+			Duration: Duration(seconds * float64(time.Second)),
+		})
+	} else {
+		run.ss.Streamer.SetRenderer(decoder)
+	}
+
+	return 0
+}
+
+func (run *scriptRun) generator(L *lua.LState) int {
+	g, err := NewGenerator(&GeneratorCommand{Name: L.CheckString(1)})
+	check(L, err)
+	check(L, g.SetParams(luaParams(L, L.OptTable(2, nil))))
+	run.ss.Streamer.SetRenderer(g)
+
+	return 0
+}
+
+func (run *scriptRun) plugin(L *lua.LState) int {
+	check(L, run.ss.Streamer.PlayPlugin(&PluginCommand{
+		Name:   L.CheckString(1),
+		Params: luaParams(L, L.OptTable(2, nil)),
+	}))
+
+	return 0
+}
+
+func (run *scriptRun) texture(L *lua.LState) int {
+	check(L, run.ss.Streamer.PlayTexture(&TextureCommand{
+		Name:   L.CheckString(1),
+		Params: luaParams(L, L.OptTable(2, nil)),
+	}))
+
+	return 0
+}
+
+func (run *scriptRun) expression(L *lua.LState) int {
+	_, err := run.ss.Expressions.Do(&ExpressionCommand{Source: L.CheckString(1), Layout: L.OptString(2, "")})
+	check(L, err)
+
+	return 0
+}
+
+func (run *scriptRun) playlist(L *lua.LState) int {
+	check(L, run.ss.Playlists.Play(L.CheckString(1)))
+
+	return 0
+}
+
+func (run *scriptRun) params(L *lua.LState) int {
+	_, err := run.ss.Params.Do(&ParamsCommand{Pattern: luaParams(L, L.CheckTable(1))})
+	check(L, err)
+
+	return 0
+}
+
+func (run *scriptRun) brightness(L *lua.LState) int {
+	check(L, run.ss.Sender.SetParams(Params{"brightness": float64(L.CheckNumber(1))}))
+	run.ss.Params.Changed()
+
+	return 0
+}
+
+func (run *scriptRun) color(L *lua.LState) int {
+	check(L, run.ss.Sender.SetParams(Params{"color": L.CheckString(1)}))
+	run.ss.Params.Changed()
+
+	return 0
+}
+
+// fade moves the brightness to its target evenly over time.
+func (run *scriptRun) fade(L *lua.LState) int {
+	to := float64(L.CheckNumber(1))
+	d := time.Duration(float64(L.CheckNumber(2)) * float64(time.Second))
+	if to < 0 || to > 255 {
+		L.ArgError(1, "brightness must be >= 0 and <= 255")
+	}
+	from := run.ss.Sender.Params()["brightness"].(float64)
+
+	run.sleep(d, func(f float64) {
+		check(L, run.ss.Sender.SetParams(Params{"brightness": from + (to-from)*f}))
+	})
+	run.ss.Params.Changed()
+
+	return 0
+}
+
+func (run *scriptRun) wait(L *lua.LState) int {
+	run.sleep(time.Duration(float64(L.CheckNumber(1))*float64(time.Second)), nil)
+
+	return 0
+}
+
+// sleep waits for d, passing on events, and calling each if set with how
+// far through it is, from 0 to 1.
+func (run *scriptRun) sleep(d time.Duration, each func(f float64)) {
+	start := time.Now()
+	tick := time.NewTicker(scriptTick)
+	defer tick.Stop()
+
+	run.idle(true)
+	defer run.idle(false)
+
+	for {
+		f := 1.0
+		if d > 0 {
+			f = float64(time.Since(start)) / float64(d)
+		}
+		if each != nil {
+			each(f)
+		}
+		if f >= 1 {
+			return
+		}
+		run.events()
+
+		select {
+		case <-run.ctx.Done():
+			run.L.RaiseError("%v", ErrScriptStop)
+		case <-tick.C:
+		}
+	}
+}
+
+// events calls the script's handlers if there's been new feedback.
+func (run *scriptRun) events() {
+	status, seq := run.ss.Sender.LatestStatus()
+	if seq == run.statusSeq {
+		return
+	}
+	run.statusSeq = seq
+
+	run.idle(false)
+	defer run.idle(true)
+
+	if run.onAudio != nil {
+		run.call(run.onAudio, run.audioTable())
+	}
+	if run.onStatus != nil {
+		t := run.L.NewTable()
+		t.RawSetString("brightness", lua.LNumber(status.Brightness))
+		t.RawSetString("watts", lua.LNumber(status.SupplyWatts))
+		run.call(run.onStatus, t)
+	}
+}
+
+// call calls a handler, passing on any error.
+func (run *scriptRun) call(fn *lua.LFunction, arg lua.LValue) {
+	if err := run.L.CallByParam(lua.P{Fn: fn, Protect: true}, arg); err != nil {
+		run.L.RaiseError("%v", err)
+	}
+}
+
+func (run *scriptRun) audioTable() *lua.LTable {
+	a := audio.get()
+	t := run.L.NewTable()
+	t.RawSetString("level", lua.LNumber(a.Level))
+	t.RawSetString("amplitude", lua.LNumber(a.Amplitude))
+	t.RawSetString("max_amplitude", lua.LNumber(a.MaxAmplitude))
+	t.RawSetString("volts", lua.LNumber(a.Volts))
+
+	return t
+}
+
+func (run *scriptRun) setOnAudio(L *lua.LState) int {
+	run.onAudio = L.OptFunction(1, nil)
+
+	return 0
+}
+
+func (run *scriptRun) setOnFeedback(L *lua.LState) int {
+	run.onStatus = L.OptFunction(1, nil)
+
+	return 0
+}
+
+func (run *scriptRun) audio(L *lua.LState) int {
+	L.Push(run.audioTable())
+
+	return 1
+}
+
+func (run *scriptRun) time(L *lua.LState) int {
+	L.Push(lua.LNumber(time.Since(run.start).Seconds()))
+
+	return 1
+}
+
+func (run *scriptRun) print(L *lua.LState) int {
+	parts := make([]string, L.GetTop())
+	for i := range parts {
+		parts[i] = L.ToStringMeta(L.Get(i + 1)).String()
+	}
+	run.log(strings.Join(parts, "\t"))
+
+	return 0
+}
+
+// ServeHTTP serves the script API.  Changing scripts needs the api_token.
+//
+//	GET    /api/scripts/              list scripts and which is running
+//	GET    /api/scripts/<name>        fetch a script's source
+//	PUT    /api/scripts/<name>        create or replace a script
+//	DELETE /api/scripts/<name>        delete a script
+//	POST   /api/scripts/<name>/start  stop any running script and start this one
+//	POST   /api/scripts/-/stop        stop the running script
+func (ss *Scripts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, action := splitTwo(strings.TrimPrefix(r.URL.Path, "/api/scripts/"), "/")
+
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		names, err := ss.List()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, ScriptsState{Scripts: names, Running: ss.Running()})
+	case name == "-" && r.Method == http.MethodPost:
+		if err := ss.Control(action); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case action == "start" && r.Method == http.MethodPost:
+		if err := ss.Start(name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case action != "":
+		http.NotFound(w, r)
+	case r.Method == http.MethodGet:
+		source, err := ss.Load(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(source))
+	case r.Method == http.MethodPut:
+		if !authorized(w, r) {
+			return
+		}
+		b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxScriptSize+1))
+		if err != nil {
+			http.Error(w, ErrScriptLarge.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err := ss.Save(name, string(b)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		if !authorized(w, r) {
+			return
+		}
+		if err := ss.Delete(name); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -5,7 +5,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"sync"
 	"time"
 
 	"github.com/tarm/serial"
@@ -19,9 +22,31 @@ type Sender struct {
 	NumPixels     int
 	AudioDimming  int
 	MaxBrightness int
+	BrightnessCap int
 	Brightness    int
 	ColorFilter   Frame
 	StatusChan    chan<- []byte
+
+	// mu guards the fields above that change while the Sender is running.
+	// Change them with the Set methods once it's started.
+	mu sync.Mutex
+
+	// The brightness and color filter the playing pattern replaced, to
+	// put back when something else plays, or nil if it didn't replace
+	// them or they've been changed since.
+	savedBrightness *int
+	savedColor      *Frame
+
+	// Pool receives Frames back once they've been sent.
+	Pool FramePool
+
+	header [2]byte
+	buf    Frame
+
+	// The latest Status, and how many there have been.
+	statusMu  sync.Mutex
+	status    Status
+	statusSeq uint64
 }
 
 type Feedback struct {
@@ -69,7 +94,9 @@ func (s *Sender) send(fc <-chan Frame) (Err error) {
 	go func() { _ = s.reader(p) }()
 
 	for frame := range fc {
-		if err := s.sendFrame(p, frame); err != nil {
+		err := s.sendFrame(p, frame)
+		s.Pool.Put(frame)
+		if err != nil {
 			return err
 		}
 	}
@@ -78,6 +105,14 @@ func (s *Sender) send(fc <-chan Frame) (Err error) {
 }
 
 func (s *Sender) SetColorFilter(f Frame) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.savedColor = nil
+	s.setColorFilter(f)
+}
+
+func (s *Sender) setColorFilter(f Frame) {
 	if len(f) == 3 && f[0] == 0xff && f[1] == 0xff && f[2] == 0xff {
 		s.ColorFilter = Frame{}
 	} else {
@@ -88,18 +123,244 @@ func (s *Sender) SetColorFilter(f Frame) {
 	}
 }
 
-func (s *Sender) sendFrame(p *serial.Port, f Frame) error {
-	var err error
-	f, err = f.Resize(s.NumPixels)
+// SetMaxBrightness sets the brightness, keeping it when the pattern
+// changes.
+func (s *Sender) SetMaxBrightness(b int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.savedBrightness = nil
+	s.MaxBrightness = b
+}
+
+// SetBrightnessCap limits the brightness, or removes the limit if b is 0.
+func (s *Sender) SetBrightnessCap(b int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.BrightnessCap = b
+}
+
+// SetAudioDimming sets how much the brightness follows the audio level.
+func (s *Sender) SetAudioDimming(d int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.AudioDimming = d
+}
+
+// SetPattern puts back the brightness and color filter the last pattern
+// replaced, then replaces them with the ones the new pattern asks for, if
+// it asks for any: a brightness above 0 and a non-nil color.
+func (s *Sender) SetPattern(brightness int, color Frame) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.savedBrightness != nil {
+		s.MaxBrightness = *s.savedBrightness
+		s.savedBrightness = nil
+	}
+	if s.savedColor != nil {
+		s.ColorFilter = *s.savedColor
+		s.savedColor = nil
+	}
+
+	if brightness > 0 {
+		saved := s.MaxBrightness
+		s.savedBrightness = &saved
+		s.MaxBrightness = brightness
+	}
+	if color != nil {
+		saved := s.ColorFilter
+		s.savedColor = &saved
+		s.setColorFilter(color)
+	}
+}
+
+// senderLimits are the Sender's brightness cap and color filter, saved to
+// put back later.
+type senderLimits struct {
+	brightnessCap int
+	color         Frame
+	savedColor    *Frame
+}
+
+// limits returns the brightness cap and color filter.
+func (s *Sender) limits() senderLimits {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return senderLimits{brightnessCap: s.BrightnessCap, color: s.ColorFilter, savedColor: s.savedColor}
+}
+
+// setLimits puts back the brightness cap and/or color filter from limits.
+func (s *Sender) setLimits(l senderLimits, brightnessCap, color bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if brightnessCap {
+		s.BrightnessCap = l.brightnessCap
+	}
+	if color {
+		s.ColorFilter = resizeFilter(l.color, s.NumPixels)
+		s.savedColor = nil
+		if l.savedColor != nil {
+			f := resizeFilter(*l.savedColor, s.NumPixels)
+			s.savedColor = &f
+		}
+	}
+}
+
+// Schema describes the effects the Sender applies to every frame.
+func (s *Sender) Schema() []ParamSpec {
+	return []ParamSpec{
+		{Name: "brightness", Type: ParamNumber, Default: 255, Min: 0, Max: 255, Step: 1},
+		{Name: "audio_dimming", Type: ParamNumber, Default: 0, Min: 0, Max: 255, Step: 1},
+		{Name: "color", Type: ParamColor, Default: "#ffffff"},
+	}
+}
+
+// Params returns the current effects.
+func (s *Sender) Params() Params {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	color := "#ffffff"
+	if f := s.ColorFilter; len(f) >= 3 {
+		color = fmt.Sprintf("#%02x%02x%02x", f[0], f[1], f[2])
+	}
+
+	return Params{
+		"brightness":    float64(s.MaxBrightness),
+		"audio_dimming": float64(s.AudioDimming),
+		"color":         color,
+	}
+}
+
+// SetParams changes any of the effects, or none if any are invalid.
+func (s *Sender) SetParams(p Params) error {
+	e, err := parseEffects(p)
 	if err != nil {
 		return err
 	}
+	s.setEffects(e)
+
+	return nil
+}
+
+// effectParams are the Sender params to change, or nil to leave alone.
+type effectParams struct {
+	brightness, dimming *float64
+	color               Frame
+}
+
+// parseEffects checks Sender params without applying them.
+func parseEffects(p Params) (effectParams, error) {
+	if err := p.only("brightness", "audio_dimming", "color"); err != nil {
+		return effectParams{}, err
+	}
+
+	brightness, err := p.float("brightness")
+	if err != nil {
+		return effectParams{}, err
+	}
+	if brightness != nil && (*brightness < 0 || *brightness > 255) {
+		return effectParams{}, fmt.Errorf("brightness %g must be >= 0 and <= 255: %w", *brightness, ErrInvalidValue)
+	}
+	dimming, err := p.float("audio_dimming")
+	if err != nil {
+		return effectParams{}, err
+	}
+	if dimming != nil && (*dimming < 0 || *dimming > 255) {
+		return effectParams{}, fmt.Errorf("audio_dimming %g must be >= 0 and <= 255: %w", *dimming, ErrInvalidValue)
+	}
+	name, err := p.string("color")
+	if err != nil {
+		return effectParams{}, err
+	}
+	var color Frame
+	if name != nil {
+		if color, err = parseColor(*name); err != nil {
+			return effectParams{}, fmt.Errorf("color %q: %w", *name, err)
+		}
+	}
+
+	return effectParams{brightness: brightness, dimming: dimming, color: color}, nil
+}
+
+// setEffects applies params checked by parseEffects.
+func (s *Sender) setEffects(e effectParams) {
+	if e.brightness != nil {
+		s.SetMaxBrightness(int(*e.brightness))
+	}
+	if e.dimming != nil {
+		s.SetAudioDimming(int(*e.dimming))
+	}
+	if e.color != nil {
+		s.SetColorFilter(e.color)
+	}
+}
+
+// SetNumPixels changes the number of bytes sent per frame, resizing the
+// color filters to match.
+func (s *Sender) SetNumPixels(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ColorFilter = resizeFilter(s.ColorFilter, n)
+	if s.savedColor != nil {
+		f := resizeFilter(*s.savedColor, n)
+		s.savedColor = &f
+	}
+	s.NumPixels = n
+}
+
+// resizeFilter returns color filter f for n bytes.
+func resizeFilter(f Frame, n int) Frame {
+	if len(f) < 3 {
+		return f
+	}
+	f2, err := append(Frame{}, f[:3]...).Resize(n)
+	if err != nil {
+		return f
+	}
 
-	if len(s.ColorFilter) == s.NumPixels {
-		f = f.Mult(s.ColorFilter)
+	return f2
+}
+
+// maxBrightness returns MaxBrightness, limited by BrightnessCap if set.
+func (s *Sender) maxBrightness() int {
+	if s.BrightnessCap > 0 && s.BrightnessCap < s.MaxBrightness {
+		return s.BrightnessCap
 	}
+	return s.MaxBrightness
+}
 
-	n, err := p.Write([]byte{'*', byte(s.Brightness)})
+func (s *Sender) sendFrame(p io.Writer, f Frame) error {
+	s.mu.Lock()
+	numPixels, filter, brightness := s.NumPixels, s.ColorFilter, s.Brightness
+	s.mu.Unlock()
+
+	// An empty Frame is black, not a reason to reopen the port.
+	if len(f) == 0 {
+		s.buf = grow(s.buf, numPixels)
+		for i := range s.buf {
+			s.buf[i] = 0
+		}
+	} else {
+		var err error
+		if s.buf, err = f.ResizeInto(s.buf, numPixels); err != nil {
+			return err
+		}
+	}
+	f = s.buf
+
+	if len(filter) == numPixels {
+		f = f.MultInto(f, filter)
+	}
+
+	s.header = [2]byte{'*', byte(brightness)}
+	n, err := p.Write(s.header[:])
 	if err != nil {
 		return err
 	}
@@ -117,6 +378,15 @@ func (s *Sender) sendFrame(p *serial.Port, f Frame) error {
 	return nil
 }
 
+// LatestStatus returns the latest Status from the controller, and a count
+// that goes up with each one.
+func (s *Sender) LatestStatus() (Status, uint64) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	return s.status, s.statusSeq
+}
+
 func (s *Sender) reader(p *serial.Port) error {
 	r := bufio.NewReader(p)
 
@@ -141,21 +411,39 @@ func (s *Sender) reader(p *serial.Port) error {
 
 		maxAmp := recent.Amplitude()
 		liveAmp := live.Amplitude()
+		features := AudioFeatures{
+			Volts:        float64(int(recent.Avg)) / 1000,
+			Amplitude:    float64(liveAmp) / 1000,
+			MaxAmplitude: float64(maxAmp) / 1000,
+		}
+		if maxAmp >= 50 {
+			features.Level = math.Min(1, float64(liveAmp)/float64(maxAmp))
+		}
+		audio.set(features)
+
+		s.mu.Lock()
+		ceiling := s.maxBrightness()
 		if maxAmp < 50 {
-			s.Brightness = s.MaxBrightness // Less than .05 volts is probably noise. Ignore it.
+			s.Brightness = ceiling // Less than .05 volts is probably noise. Ignore it.
 		} else {
-			r := s.MaxBrightness * s.AudioDimming / 255
-			s.Brightness = s.MaxBrightness - r + liveAmp*r/maxAmp
+			r := ceiling * s.AudioDimming / 255
+			s.Brightness = ceiling - r + liveAmp*r/maxAmp
 		}
+		s.mu.Unlock()
+
+		status := Status{
+			Brightness:        feedback.Brightness * 100 / 255,
+			SupplyWatts:       feedback.SupplyMilliwatts / 1000,
+			AudioVolts:        float32(int(recent.Avg)) / 1000,
+			AudioAmplitude:    float32(liveAmp) / 1000,
+			AudioMaxAmplitude: float32(maxAmp) / 1000,
+		}
+		s.statusMu.Lock()
+		s.status = status
+		s.statusSeq++
+		s.statusMu.Unlock()
 
 		if s.StatusChan != nil {
-			status := Status{
-				Brightness:        feedback.Brightness * 100 / 255,
-				SupplyWatts:       feedback.SupplyMilliwatts / 1000,
-				AudioVolts:        float32(int(recent.Avg)) / 1000,
-				AudioAmplitude:    float32(liveAmp) / 1000,
-				AudioMaxAmplitude: float32(maxAmp) / 1000,
-			}
 			b, err := json.Marshal(status)
 			if err == nil {
 				s.StatusChan <- b
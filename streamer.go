@@ -1,13 +1,34 @@
 package main
 
 import (
+	"sync"
 	"time"
 )
 
 type Streamer struct {
-	fc chan Framer
+	// Pool supplies the Frames sent to the Worker's channel.  Whoever
+	// receives a Frame from that channel owns it, and should Put it back
+	// when done with it.
+	Pool FramePool
+
+	// Changed, if set, is called from the Worker each time it starts
+	// playing a new Renderer.  It mustn't block.
+	Changed func()
+
+	rc chan rendererChange
+	dc chan time.Duration
+	tc chan TransitionConfig
+
+	mu      sync.Mutex
+	current Renderer
 }
 
+// Framer produces Frames.  The Frame returned by NextFrame still belongs to
+// the Framer: callers must not modify it, and it's only valid until the
+// next call to NextFrame or Close, so Framers can reuse their buffers.
+//
+// Framer is the original, simpler form of Renderer, and can still be
+// played through SetFramer.
 type Framer interface {
 	NextFrame() Frame
 	Close()
@@ -15,44 +36,131 @@ type Framer interface {
 
 func NewStreamer() *Streamer {
 	t := &Streamer{
-		fc: make(chan Framer, 1),
+		rc: make(chan rendererChange, 1),
+		dc: make(chan time.Duration, 1),
+		tc: make(chan TransitionConfig, 1),
 	}
 
 	return t
 }
 
+// rendererChange is a switch to a new Renderer, and how to switch if not
+// the usual way.
+type rendererChange struct {
+	r  Renderer
+	tc *TransitionConfig
+}
+
+// SetRenderer switches to playing r.
+func (t *Streamer) SetRenderer(r Renderer) {
+	t.rc <- rendererChange{r: r}
+}
+
+// TransitionTo switches to playing r with tc, rather than the transition
+// set by SetTransition.
+func (t *Streamer) TransitionTo(r Renderer, tc TransitionConfig) {
+	t.rc <- rendererChange{r: r, tc: &tc}
+}
+
+// SetFramer switches to playing framer.
 func (t *Streamer) SetFramer(framer Framer) {
-	t.fc <- framer
+	t.SetRenderer(AsRenderer(framer))
+}
+
+// SetDelay changes the delay between frames.
+func (t *Streamer) SetDelay(delay time.Duration) {
+	t.dc <- delay
+}
+
+// SetTransition changes how SetRenderer switches to a new Renderer.
+func (t *Streamer) SetTransition(tc TransitionConfig) {
+	t.tc <- tc
+}
+
+// Current returns the Renderer that's playing.
+func (t *Streamer) Current() Renderer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current
+}
+
+func (t *Streamer) setCurrent(r Renderer) {
+	t.mu.Lock()
+	t.current = r
+	t.mu.Unlock()
 }
 
 func (t *Streamer) Close() {
-	close(t.fc)
+	close(t.rc)
 }
 
 func (t *Streamer) Worker(sc chan<- Frame, delay time.Duration) {
-	framer := <-t.fc
-	if framer == nil {
+	r := (<-t.rc).r
+	if r == nil {
 		return
 	}
+	t.setCurrent(r)
+	if t.Changed != nil {
+		t.Changed()
+	}
 
 	tick := time.NewTicker(delay)
+	transition := TransitionConfig{}
+	var last time.Time
+	fc := FrameContext{}
 
 loop:
 	for {
 		select {
-		case fr := <-t.fc:
-			if fr == nil {
+		case next := <-t.rc:
+			if next.r == nil {
 				break loop
 			}
-			framer.Close()
-			framer = fr
-		case <-tick.C:
-			f := framer.NextFrame()
-			sc <- f
+			tc := transition
+			if next.tc != nil {
+				tc = *next.tc
+			}
+			r = NewTransition(r, next.r, tc, delay)
+			t.setCurrent(r)
+			if t.Changed != nil {
+				t.Changed()
+			}
+		case d := <-t.dc:
+			delay = d
+			tick.Reset(d)
+			last = time.Time{}
+		case tc := <-t.tc:
+			transition = tc
+		case now := <-tick.C:
+			fc.Now = now
+			fc.Delta = delay
+			fc.Time += delay
+			if c := currentConfig(); c != nil {
+				fc.Pixels = c.NumPixels
+			}
+			fc.Audio = audio.get()
+			fc.Layout = layouts.Current(fc.Pixels)
+
+			f := r.Render(&fc)
+			if next, ok := settle(r); ok {
+				r = next
+				t.setCurrent(r)
+			}
+			out := t.Pool.Get(len(f))
+			copy(out, f)
+			sc <- out
+
+			// The ticker drops ticks we were too slow to receive.
+			var missed int64
+			if !last.IsZero() {
+				missed = int64((now.Sub(last)+delay/2)/delay) - 1
+			}
+			last = now
+			metrics.ticked(missed, time.Since(now))
 		}
 	}
 
-	framer.Close()
+	r.Close()
 	tick.Stop()
 	close(sc)
 }
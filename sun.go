@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	julianUnixEpoch = 2440587.5
+	julian2000      = 2451545.0
+	degrees         = math.Pi / 180
+)
+
+// sunTimes returns sunrise and sunset on the calendar day of date (in
+// date's location) at the given latitude and longitude in degrees, using
+// the NOAA sunrise equation.  It's accurate to a minute or two, which is
+// plenty for scheduling.  ok is false if the sun doesn't rise or set that
+// day.
+func sunTimes(date time.Time, lat, lon float64) (rise, set time.Time, ok bool) {
+	noon := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, date.Location())
+	n := math.Round(timeToJulian(noon) - julian2000 - 0.0008)
+
+	meanSolarNoon := n - lon/360
+	m := math.Mod(357.5291+0.98560028*meanSolarNoon, 360) * degrees
+	c := 1.9148*math.Sin(m) + 0.02*math.Sin(2*m) + 0.0003*math.Sin(3*m)
+	lambda := math.Mod(m/degrees+c+180+102.9372, 360) * degrees
+	transit := julian2000 + meanSolarNoon + 0.0053*math.Sin(m) - 0.0069*math.Sin(2*lambda)
+
+	sinDecl := math.Sin(lambda) * math.Sin(23.4397*degrees)
+	cosDecl := math.Cos(math.Asin(sinDecl))
+	cosHour := (math.Sin(-0.833*degrees) - math.Sin(lat*degrees)*sinDecl) / (math.Cos(lat*degrees) * cosDecl)
+	if cosHour < -1 || cosHour > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	hour := math.Acos(cosHour) / degrees / 360
+
+	loc := date.Location()
+	return julianToTime(transit - hour).In(loc), julianToTime(transit + hour).In(loc), true
+}
+
+func timeToJulian(t time.Time) float64 {
+	return float64(t.Unix())/86400 + julianUnixEpoch
+}
+
+func julianToTime(j float64) time.Time {
+	return time.Unix(int64(math.Round((j-julianUnixEpoch)*86400)), 0)
+}
@@ -0,0 +1,788 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	xdraw "golang.org/x/image/draw"
+
+	"github.com/die-net/led-controller/anim"
+	"github.com/die-net/led-controller/videoimport"
+)
+
+var ErrUnknownTexture = errors.New("no such texture")
+
+// Texture filters.
+const (
+	FilterArea     = "area"
+	FilterBilinear = "bilinear"
+)
+
+const (
+	// Longest side that images and animations are scaled down to, and
+	// that videos are decoded at.
+	maxTextureSize      = 512
+	maxVideoTextureSize = 256
+
+	// Decoded frames a video can get ahead by.
+	videoFrames = 2
+)
+
+// Textures ending in these are played as video.
+var videoExtensions = map[string]bool{
+	".avi":  true,
+	".m4v":  true,
+	".mkv":  true,
+	".mov":  true,
+	".mp4":  true,
+	".webm": true,
+}
+
+// Texture is a Renderer that projects an image, animated image or video
+// from the root dir's textures/ onto the pixels where they physically are,
+// like a slide projector.  Each pixel is sampled at its position in a
+// layout, fitted to the texture, and then moved by the pan, zoom, rotate
+// and scroll params.
+//
+// With the area filter, each pixel shows the average of the texture around
+// it, as far as the next pixel, so fine detail doesn't flicker.  Bilinear
+// is sharper and cheaper.
+type Texture struct {
+	mu         sync.Mutex
+	name       string
+	layoutName string
+	layout     *Layout // nil for the one in use.
+
+	// The current frame, as w x h RGB bytes, and for area filtering, a
+	// summed-area table of it built when first needed.
+	w, h   int
+	pix    []byte
+	sum    []uint32
+	summed bool
+
+	// Animations play through strip's frames.  Videos are decoded by
+	// ffmpeg as they play.
+	strip    *anim.Strip
+	frame    int
+	path     string
+	fps      float64
+	duration time.Duration
+	video    *videoFeed
+
+	// Seconds of playback so far, scaled by speed, and when the current
+	// frame ends.
+	t, until float64
+
+	// How far scrolling has moved, in texture widths and heights.
+	scrollX, scrollY float64
+
+	// The usual distance between pixels in layout, for area filtering.
+	spacingOf *Layout
+	spacing   float64
+
+	params textureParams
+	out    Frame
+}
+
+type textureParams struct {
+	speed      float64
+	filter     string
+	zoom       float64
+	panX, panY float64
+	rotate     float64
+	scrollX    float64
+	scrollY    float64
+	tile       bool
+}
+
+// TextureNames returns the names of the files in dir that can be played
+// as textures.
+func TextureNames(dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() && validPatternName(f.Name()) {
+			names = append(names, f.Name())
+		}
+	}
+
+	return names
+}
+
+// NewTexture loads the texture that tc names.
+func NewTexture(tc *TextureCommand) (*Texture, error) {
+	if !validPatternName(tc.Name) {
+		return nil, fmt.Errorf("%q: %w", tc.Name, ErrInvalidName)
+	}
+	path := currentConfig().RootDir + "textures/" + tc.Name
+	if fi, err := os.Stat(path); err != nil || fi.IsDir() {
+		return nil, fmt.Errorf("%q: %w", tc.Name, ErrUnknownTexture)
+	}
+
+	x := &Texture{
+		name:       tc.Name,
+		layoutName: tc.Layout,
+		path:       path,
+		params: textureParams{
+			speed:  1,
+			filter: FilterArea,
+			zoom:   1,
+			tile:   true,
+		},
+	}
+	if tc.Layout != "" {
+		var err error
+		if x.layout, err = layouts.Load(tc.Layout); err != nil {
+			return nil, err
+		}
+	}
+	if err := x.SetParams(tc.Params); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if videoExtensions[strings.ToLower(filepath.Ext(tc.Name))] {
+		err = x.openVideo()
+	} else {
+		err = x.openImage()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", tc.Name, err)
+	}
+
+	return x, nil
+}
+
+// textureSize scales width x height down to fit in limit x limit, if it
+// doesn't already.
+func textureSize(width, height, limit int) (int, int) {
+	if width <= limit && height <= limit {
+		return width, height
+	}
+
+	scale := float64(limit) / float64(width)
+	if height > width {
+		scale = float64(limit) / float64(height)
+	}
+	w := int(math.Max(1, math.Round(float64(width)*scale)))
+	h := int(math.Max(1, math.Round(float64(height)*scale)))
+
+	return w, h
+}
+
+// openImage decodes a still or animated image.
+func (x *Texture) openImage() error {
+	data, err := ioutil.ReadFile(x.path)
+	if err != nil {
+		return err
+	}
+
+	// Images are decoded at full size before they're scaled down.
+	c, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if c.Width > 0 && c.Height > maxImagePixels/c.Width {
+		return fmt.Errorf("%dx%d: %w", c.Width, c.Height, ErrImageTooLarge)
+	}
+
+	// Scale each composited frame of an animation down, and keep it whole.
+	var scaled *image.RGBA
+	sample := func(dst []byte, canvas *image.RGBA) []byte {
+		if scaled == nil {
+			w, h := textureSize(canvas.Rect.Dx(), canvas.Rect.Dy(), maxTextureSize)
+			scaled = image.NewRGBA(image.Rect(0, 0, w, h))
+		}
+		xdraw.BiLinear.Scale(scaled, scaled.Rect, canvas, canvas.Rect, xdraw.Src, nil)
+
+		return anim.Flatten(dst, scaled)
+	}
+	strip, err := anim.DecodeAnimation(data, sample)
+	if err == nil {
+		x.strip = strip
+		x.w, x.h = scaled.Rect.Dx(), scaled.Rect.Dy()
+		x.pix, _ = strip.Frame(nil, 0)
+		x.until = strip.RowDelay(0).Seconds()
+		return nil
+	}
+	if !errors.Is(err, anim.ErrNotAnimated) {
+		return err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	b := img.Bounds()
+	w, h := textureSize(b.Dx(), b.Dy(), maxTextureSize)
+	if w <= 0 || h <= 0 {
+		return fmt.Errorf("%dx%d image: %w", w, h, ErrInvalidValue)
+	}
+	scaled = image.NewRGBA(image.Rect(0, 0, w, h))
+	xdraw.BiLinear.Scale(scaled, scaled.Rect, img, b, xdraw.Src, nil)
+	x.w, x.h = w, h
+	x.pix = anim.Flatten(nil, scaled)
+
+	return nil
+}
+
+// openVideo starts decoding a video.
+func (x *Texture) openVideo() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	info, err := videoimport.Probe(ctx, x.path)
+	if err != nil {
+		return err
+	}
+	x.w, x.h = textureSize(info.Width, info.Height, maxVideoTextureSize)
+	x.fps, x.duration = info.FPS, info.Duration
+
+	x.video, err = startVideo(x.path, x.w, x.h)
+
+	return err
+}
+
+// videoFeed decodes a video in the background, a few frames ahead.
+type videoFeed struct {
+	stream *videoimport.Stream
+	ready  chan []byte
+	free   chan []byte
+	done   chan struct{}
+}
+
+func startVideo(path string, width, height int) (*videoFeed, error) {
+	s, err := videoimport.OpenStream(context.Background(), path, width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	// One buffer being shown, and the rest being decoded into or ready.
+	v := &videoFeed{
+		stream: s,
+		ready:  make(chan []byte, videoFrames),
+		free:   make(chan []byte, videoFrames+1),
+		done:   make(chan struct{}),
+	}
+	for i := 0; i < videoFrames+1; i++ {
+		v.free <- make([]byte, width*height*3)
+	}
+	go v.decode(path)
+
+	return v, nil
+}
+
+func (v *videoFeed) decode(path string) {
+	for {
+		var buf []byte
+		select {
+		case buf = <-v.free:
+		case <-v.done:
+			return
+		}
+
+		if err := v.stream.ReadFrame(buf); err != nil {
+			select {
+			case <-v.done:
+			default:
+				log.Println("Texture:", path, err)
+			}
+			return
+		}
+
+		select {
+		case v.ready <- buf:
+		case <-v.done:
+			return
+		}
+	}
+}
+
+func (v *videoFeed) stop() {
+	close(v.done)
+	v.stream.Close()
+}
+
+func (x *Texture) Render(fc *FrameContext) Frame {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	dt := fc.Delta.Seconds()
+	x.t += dt * x.params.speed
+	x.scrollX = math.Mod(x.scrollX+x.params.scrollX*dt, 1)
+	x.scrollY = math.Mod(x.scrollY+x.params.scrollY*dt, 1)
+	x.advance()
+
+	x.out = grow(x.out, fc.Pixels*3)
+	l := x.layout
+	if l == nil {
+		l = fc.Layout
+	}
+	if x.pix == nil || l == nil {
+		for i := range x.out {
+			x.out[i] = 0
+		}
+		return x.out
+	}
+
+	// Fit the layout to the texture, then turn, zoom and move it about the
+	// texture's center.
+	w, h := float64(x.w), float64(x.h)
+	scale, ox, oy := l.fitting(w, h)
+	sin, cos := math.Sincos(-x.params.rotate * math.Pi / 180)
+	cx, cy := w/2, h/2
+	shiftX := cx - (x.params.panX+x.scrollX)*w
+	shiftY := cy - (x.params.panY+x.scrollY)*h
+	zoom := x.params.zoom
+
+	// Area filter over a box as wide as the space between pixels, unless
+	// that's no bigger than a texel.
+	radius := 0.0
+	if x.params.filter == FilterArea {
+		if x.spacingOf != l {
+			x.spacingOf, x.spacing = l, l.Spacing()
+		}
+		if radius = x.spacing * scale / zoom / 2; radius > 0.5 {
+			x.buildSum()
+		} else {
+			radius = 0
+		}
+	}
+
+	for i := 0; i < fc.Pixels; i++ {
+		o := x.out[i*3 : i*3+3]
+		if i >= len(l.Points) {
+			o[0], o[1], o[2] = 0, 0, 0
+			continue
+		}
+
+		p := &l.Points[i]
+		dx, dy := ox+p[0]*scale-cx, oy+p[1]*scale-cy
+		sx := (dx*cos-dy*sin)/zoom + shiftX
+		sy := (dx*sin+dy*cos)/zoom + shiftY
+
+		var c [3]float64
+		if radius > 0 {
+			c = x.area(sx, sy, radius)
+		} else {
+			c = x.bilinear(sx, sy)
+		}
+		o[0], o[1], o[2] = channel(c[0]/255), channel(c[1]/255), channel(c[2]/255)
+	}
+
+	return x.out
+}
+
+// advance moves on to the frame that should be showing at x.t.
+func (x *Texture) advance() {
+	switch {
+	case x.strip != nil:
+		frames, changed := x.strip.Bounds().Dy(), false
+		for x.t >= x.until {
+			x.frame = (x.frame + 1) % frames
+			x.until += x.strip.RowDelay(x.frame).Seconds()
+			changed = true
+		}
+		if changed {
+			x.pix, _ = x.strip.Frame(x.pix, x.frame)
+			x.summed = false
+		}
+	case x.video != nil:
+	next:
+		for x.t >= x.until {
+			select {
+			case buf := <-x.video.ready:
+				if x.pix != nil {
+					x.video.free <- x.pix
+				}
+				x.pix = buf
+				x.summed = false
+				x.until += 1 / x.fps
+			default:
+				// Decoding has fallen behind; catch up when it can.
+				x.until = x.t
+				break next
+			}
+		}
+	}
+}
+
+// bilinear returns the texture's color at sx, sy, blending the four
+// nearest texels.
+func (x *Texture) bilinear(sx, sy float64) [3]float64 {
+	w, h := float64(x.w), float64(x.h)
+	if !x.params.tile && (sx < 0 || sy < 0 || sx >= w || sy >= h) {
+		return [3]float64{}
+	}
+
+	fx, fy := math.Floor(sx-0.5), math.Floor(sy-0.5)
+	ax, ay := sx-0.5-fx, sy-0.5-fy
+	x0, y0 := x.texel(int(fx), x.w), x.texel(int(fy), x.h)
+	x1, y1 := x.texel(int(fx)+1, x.w), x.texel(int(fy)+1, x.h)
+
+	var c [3]float64
+	for k := range c {
+		p00 := float64(x.pix[(y0*x.w+x0)*3+k])
+		p10 := float64(x.pix[(y0*x.w+x1)*3+k])
+		p01 := float64(x.pix[(y1*x.w+x0)*3+k])
+		p11 := float64(x.pix[(y1*x.w+x1)*3+k])
+		c[k] = (p00*(1-ax)+p10*ax)*(1-ay) + (p01*(1-ax)+p11*ax)*ay
+	}
+
+	return c
+}
+
+// texel wraps or clamps i to a texel from 0 to n-1.
+func (x *Texture) texel(i, n int) int {
+	if x.params.tile {
+		if i %= n; i < 0 {
+			i += n
+		}
+		return i
+	}
+
+	return clampInt(i, 0, n-1)
+}
+
+// area returns the average color of the texture within radius of sx, sy.
+func (x *Texture) area(sx, sy, radius float64) [3]float64 {
+	x0, y0, x1, y1 := sx-radius, sy-radius, sx+radius, sy+radius
+
+	var c [3]float64
+	if x.params.tile {
+		// Most boxes don't cross an edge once they're moved into the
+		// first tile, and don't need the slower periodic sums.
+		w, h := float64(x.w), float64(x.h)
+		mx, my := math.Floor(x0/w)*w, math.Floor(y0/h)*h
+		if x1-mx <= w && y1-my <= h {
+			x0, y0, x1, y1 = x0-mx, y0-my, x1-mx, y1-my
+			a, b := x.integral(x1, y1), x.integral(x0, y1)
+			d, e := x.integral(x1, y0), x.integral(x0, y0)
+			size := (x1 - x0) * (y1 - y0)
+			for k := range c {
+				c[k] = (a[k] - b[k] - d[k] + e[k]) / size
+			}
+			return c
+		}
+
+		a, b := x.periodic(x1, y1), x.periodic(x0, y1)
+		d, e := x.periodic(x1, y0), x.periodic(x0, y0)
+		size := (x1 - x0) * (y1 - y0)
+		for k := range c {
+			c[k] = (a[k] - b[k] - d[k] + e[k]) / size
+		}
+		return c
+	}
+
+	w, h := float64(x.w), float64(x.h)
+	x0, y0 = math.Max(x0, 0), math.Max(y0, 0)
+	x1, y1 = math.Min(x1, w), math.Min(y1, h)
+	size := (x1 - x0) * (y1 - y0)
+	if x1 <= x0 || y1 <= y0 {
+		return c
+	}
+
+	a, b := x.integral(x1, y1), x.integral(x0, y1)
+	d, e := x.integral(x1, y0), x.integral(x0, y0)
+	for k := range c {
+		c[k] = (a[k] - b[k] - d[k] + e[k]) / size
+	}
+
+	return c
+}
+
+// periodic returns the sum of each channel over [0, sx) x [0, sy) of the
+// texture tiled forever, from a summed-area table of one tile.
+func (x *Texture) periodic(sx, sy float64) [3]float64 {
+	w, h := float64(x.w), float64(x.h)
+	qx, qy := math.Floor(sx/w), math.Floor(sy/h)
+	rx, ry := sx-qx*w, sy-qy*h
+
+	all, right := x.integral(w, h), x.integral(w, ry)
+	below, part := x.integral(rx, h), x.integral(rx, ry)
+
+	var v [3]float64
+	for k := range v {
+		v[k] = qx*qy*all[k] + qx*right[k] + qy*below[k] + part[k]
+	}
+
+	return v
+}
+
+// integral returns the sum of each channel over [0, sx) x [0, sy), for sx
+// from 0 to w and sy from 0 to h.  Between texel corners, the table is
+// interpolated, which is exact for texels of solid color.
+func (x *Texture) integral(sx, sy float64) [3]float64 {
+	xi, yi := clampInt(int(sx), 0, x.w-1), clampInt(int(sy), 0, x.h-1)
+	ax, ay := sx-float64(xi), sy-float64(yi)
+
+	stride := (x.w + 1) * 3
+	o := yi*stride + xi*3
+
+	var v [3]float64
+	for k := range v {
+		s00 := float64(x.sum[o+k])
+		s10 := float64(x.sum[o+3+k])
+		s01 := float64(x.sum[o+stride+k])
+		s11 := float64(x.sum[o+stride+3+k])
+		v[k] = s00 + ax*(s10-s00) + ay*(s01-s00) + ax*ay*(s11-s10-s01+s00)
+	}
+
+	return v
+}
+
+// buildSum makes the summed-area table of the current frame, if it hasn't
+// been made yet.
+func (x *Texture) buildSum() {
+	if x.summed {
+		return
+	}
+
+	stride := (x.w + 1) * 3
+	if n := stride * (x.h + 1); len(x.sum) != n {
+		x.sum = make([]uint32, n)
+	}
+	for y := 0; y < x.h; y++ {
+		var r, g, b uint32
+		row := x.pix[y*x.w*3 : (y+1)*x.w*3]
+		for i := 0; i < x.w; i++ {
+			r += uint32(row[i*3])
+			g += uint32(row[i*3+1])
+			b += uint32(row[i*3+2])
+
+			o := (y+1)*stride + (i+1)*3
+			x.sum[o] = x.sum[o-stride] + r
+			x.sum[o+1] = x.sum[o-stride+1] + g
+			x.sum[o+2] = x.sum[o-stride+2] + b
+		}
+	}
+	x.summed = true
+}
+
+// Schema describes the texture's params.  Pan and scroll are in texture
+// widths and heights, and rotation is clockwise.
+func (x *Texture) Schema() []ParamSpec {
+	return []ParamSpec{
+		speedSpec(1),
+		{Name: "filter", Type: ParamEnum, Default: FilterArea, Enum: []string{FilterArea, FilterBilinear}},
+		{Name: "zoom", Type: ParamNumber, Default: 1.0, Min: 0.1, Max: 20, Log: true, Units: "x"},
+		{Name: "pan_x", Type: ParamNumber, Default: 0.0, Min: -1, Max: 1, Step: 0.01},
+		{Name: "pan_y", Type: ParamNumber, Default: 0.0, Min: -1, Max: 1, Step: 0.01},
+		{Name: "rotate", Type: ParamNumber, Default: 0.0, Min: -180, Max: 180, Step: 1, Units: "degrees"},
+		{Name: "scroll_x", Type: ParamNumber, Default: 0.0, Min: -2, Max: 2, Step: 0.01, Units: "per second"},
+		{Name: "scroll_y", Type: ParamNumber, Default: 0.0, Min: -2, Max: 2, Step: 0.01, Units: "per second"},
+		{Name: "tile", Type: ParamBool, Default: true},
+	}
+}
+
+// Params returns the texture's params.
+func (x *Texture) Params() Params {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	tp := x.params
+	return Params{
+		"speed":    tp.speed,
+		"filter":   tp.filter,
+		"zoom":     tp.zoom,
+		"pan_x":    tp.panX,
+		"pan_y":    tp.panY,
+		"rotate":   tp.rotate,
+		"scroll_x": tp.scrollX,
+		"scroll_y": tp.scrollY,
+		"tile":     tp.tile,
+	}
+}
+
+// SetParams changes any of the texture's params.
+func (x *Texture) SetParams(p Params) error {
+	schema := x.Schema()
+	names := make([]string, len(schema))
+	for i, spec := range schema {
+		names[i] = spec.Name
+		if v, ok := p[spec.Name]; ok {
+			if err := spec.check(v); err != nil {
+				return err
+			}
+		}
+	}
+	if err := p.only(names...); err != nil {
+		return err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for name, f := range map[string]*float64{
+		"speed":    &x.params.speed,
+		"zoom":     &x.params.zoom,
+		"pan_x":    &x.params.panX,
+		"pan_y":    &x.params.panY,
+		"rotate":   &x.params.rotate,
+		"scroll_x": &x.params.scrollX,
+		"scroll_y": &x.params.scrollY,
+	} {
+		if v, _ := p.float(name); v != nil {
+			*f = *v
+		}
+	}
+	if v, _ := p.string("filter"); v != nil {
+		x.params.filter = *v
+	}
+	if v, _ := p.bool("tile"); v != nil {
+		x.params.tile = *v
+	}
+
+	return nil
+}
+
+// Reset starts an animation or video over, and puts scrolling back where
+// it started.
+func (x *Texture) Reset() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.t, x.scrollX, x.scrollY = 0, 0, 0
+	switch {
+	case x.strip != nil:
+		x.frame = 0
+		x.pix, _ = x.strip.Frame(x.pix, 0)
+		x.summed = false
+		x.until = x.strip.RowDelay(0).Seconds()
+	case x.video != nil:
+		x.video.stop()
+		x.pix, x.until = nil, 0
+		video, err := startVideo(x.path, x.w, x.h)
+		if err != nil {
+			log.Println("Texture:", x.name, err)
+			x.video = nil
+			return
+		}
+		x.video = video
+	}
+}
+
+// Duration returns how long an animation or video takes to play through,
+// or false for a still image.
+func (x *Texture) Duration() (time.Duration, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	var d time.Duration
+	switch {
+	case x.strip != nil:
+		for i := 0; i < x.strip.Bounds().Dy(); i++ {
+			d += x.strip.RowDelay(i)
+		}
+	case x.video != nil && x.duration > 0:
+		d = x.duration
+	default:
+		return 0, false
+	}
+
+	return time.Duration(float64(d) / x.params.speed), true
+}
+
+func (x *Texture) Close() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.video != nil {
+		x.video.stop()
+		x.video = nil
+	}
+}
+
+// Name returns which texture this is.
+func (x *Texture) Name() string {
+	return x.name
+}
+
+// textureOf returns the Texture that r is playing, if any.
+func textureOf(r Renderer) (*Texture, bool) {
+	switch f := r.(type) {
+	case *Transition:
+		return textureOf(f.to)
+	case *Texture:
+		return f, true
+	}
+
+	return nil, false
+}
+
+// TextureCommand plays the named file from textures/, mapped onto the
+// pixels with an optional layout file instead of the one in use, or
+// changes the params of the texture that's playing if it's the same.
+type TextureCommand struct {
+	Name   string `json:"name"`
+	Layout string `json:"layout,omitempty"`
+	Params Params `json:"params,omitempty"`
+}
+
+// PlayTexture carries out tc.
+func (t *Streamer) PlayTexture(tc *TextureCommand) error {
+	if x, ok := textureOf(t.Current()); ok && x.Name() == tc.Name && x.layoutName == tc.Layout {
+		return x.SetParams(tc.Params)
+	}
+
+	x, err := NewTexture(tc)
+	if err != nil {
+		return err
+	}
+	t.SetRenderer(x)
+
+	return nil
+}
+
+// TextureHandler serves the texture API:
+//
+//	GET  /api/textures   the names of the textures
+//	POST /api/textures   run a TextureCommand
+type TextureHandler struct {
+	Streamer *Streamer
+	Dir      string
+}
+
+func (h *TextureHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		names := TextureNames(h.Dir)
+		if names == nil {
+			names = []string{}
+		}
+		writeJSON(w, names)
+	case http.MethodPost:
+		tc := &TextureCommand{}
+		if err := readJSON(r, tc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.Streamer.PlayTexture(tc); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrUnknownTexture) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
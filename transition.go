@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	TransitionCut       = "cut"
+	TransitionCrossfade = "crossfade"
+	TransitionFadeBlack = "fadeblack"
+	TransitionWipe      = "wipe"
+	TransitionDissolve  = "dissolve"
+)
+
+var ErrInvalidTransition = errors.New("transition must be cut, crossfade, fadeblack, wipe, or dissolve")
+
+// TransitionConfig describes how to switch from one Renderer to another.
+type TransitionConfig struct {
+	Type     string   `json:"type"`
+	Duration Duration `json:"duration"`
+}
+
+func (tc TransitionConfig) Validate() error {
+	switch tc.Type {
+	case "", TransitionCut, TransitionCrossfade, TransitionFadeBlack, TransitionWipe, TransitionDissolve:
+	default:
+		return fmt.Errorf("%q: %w", tc.Type, ErrInvalidTransition)
+	}
+
+	if tc.Duration < 0 {
+		return fmt.Errorf("duration must be >= 0: %w", ErrInvalidValue)
+	}
+
+	return nil
+}
+
+// frames returns how many frames the transition lasts at the given delay
+// between frames, or 0 for a cut.
+func (tc TransitionConfig) frames(delay time.Duration) int {
+	if tc.Type == "" || tc.Type == TransitionCut || tc.Duration <= 0 || delay <= 0 {
+		return 0
+	}
+
+	return int(time.Duration(tc.Duration) / delay)
+}
+
+// blender mixes an outgoing and incoming Frame.
+type blender struct {
+	kind  string
+	order []int
+
+	// Holds whichever Frame is shorter, repeated to the other's length.
+	resized Frame
+}
+
+// blend writes a mix of a and b, pos/total of the way from a to b, into
+// dst and returns it.
+func (bl *blender) blend(dst, a, b Frame, pos, total int) Frame {
+	if len(a) == 0 || total <= 0 || pos >= total {
+		return append(dst[:0], b...)
+	}
+	if len(b) == 0 {
+		return append(dst[:0], a...)
+	}
+	bl.resized, a, b = sameSizeInto(bl.resized, a, b)
+
+	switch bl.kind {
+	case TransitionFadeBlack:
+		half := total / 2
+		if pos < half {
+			return a.ScaleInto(dst, 256-pos*256/half)
+		}
+		return b.ScaleInto(dst, (pos-half)*256/(total-half))
+	case TransitionWipe:
+		pixels := len(a) / 3
+		edge := pixels * pos / total * 3
+		dst = grow(dst, len(a))
+		copy(dst, b[:edge])
+		copy(dst[edge:], a[edge:])
+		return dst
+	case TransitionDissolve:
+		pixels := len(a) / 3
+		if len(bl.order) != pixels {
+			bl.order = rand.Perm(pixels)
+		}
+		dst = grow(dst, len(a))
+		copy(dst, a)
+		for _, p := range bl.order[:pixels*pos/total] {
+			copy(dst[p*3:p*3+3], b[p*3:p*3+3])
+		}
+		return dst
+	default:
+		return a.LerpInto(dst, b, pos*256/total)
+	}
+}
+
+// Transition is a Renderer that blends from one Renderer to another over
+// a number of frames, then closes the outgoing one.  Everything but
+// rendering goes to the incoming Renderer.
+type Transition struct {
+	blender
+	from   Renderer
+	to     Renderer
+	frame  int
+	frames int
+	buf    Frame
+}
+
+// NewTransition returns a Renderer that switches from one Renderer to
+// another as described by tc, or just to if it's a cut.
+func NewTransition(from, to Renderer, tc TransitionConfig, delay time.Duration) Renderer {
+	frames := tc.frames(delay)
+	if from == nil || frames <= 0 {
+		if from != nil {
+			from.Close()
+		}
+		return to
+	}
+
+	return &Transition{
+		blender: blender{kind: tc.Type},
+		from:    from,
+		to:      to,
+		frames:  frames,
+	}
+}
+
+func (tr *Transition) Render(fc *FrameContext) Frame {
+	if tr.from == nil {
+		return tr.to.Render(fc)
+	}
+
+	tr.frame++
+	tr.buf = tr.blend(tr.buf, tr.from.Render(fc), tr.to.Render(fc), tr.frame, tr.frames)
+
+	if tr.frame >= tr.frames {
+		tr.from.Close()
+		tr.from = nil
+	}
+
+	return tr.buf
+}
+
+func (tr *Transition) Schema() []ParamSpec {
+	return tr.to.Schema()
+}
+
+func (tr *Transition) Params() Params {
+	return tr.to.Params()
+}
+
+func (tr *Transition) SetParams(p Params) error {
+	return tr.to.SetParams(p)
+}
+
+func (tr *Transition) Reset() {
+	tr.to.Reset()
+}
+
+func (tr *Transition) Duration() (time.Duration, bool) {
+	return tr.to.Duration()
+}
+
+func (tr *Transition) Close() {
+	if tr.from != nil {
+		tr.from.Close()
+		tr.from = nil
+	}
+	tr.to.Close()
+}
+
+// settle returns the incoming Renderer of a finished Transition, so we
+// don't keep a chain of them around, and whether r was one.  Renderers
+// can't be compared to tell, since a Frame isn't comparable.
+func settle(r Renderer) (Renderer, bool) {
+	if tr, ok := r.(*Transition); ok && tr.from == nil {
+		return tr.to, true
+	}
+	return r, false
+}
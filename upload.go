@@ -0,0 +1,603 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/die-net/led-controller/anim"
+	"github.com/die-net/led-controller/videoimport"
+)
+
+const (
+	// Largest upload we'll accept.
+	maxUploadSize = 512 << 20
+
+	// Largest single file we'll extract from an uploaded zip.
+	maxUploadFile = 64 << 20
+
+	// Most files, and most bytes once unzipped, we'll install from one
+	// upload.
+	maxUploadFiles = 10000
+	maxUploadTotal = 1 << 30
+
+	// Most pixels a still image may have, so decoding it can't run us
+	// out of memory.
+	maxImagePixels = 32 << 20
+
+	// Size of generated thumbnails.
+	thumbSize = 80
+)
+
+var (
+	ErrPatternExists  = errors.New("pattern already exists")
+	ErrNoImages       = errors.New("upload contains no images")
+	ErrImageTooWide   = errors.New("image is longer than num_pixels")
+	ErrImageTooLarge  = errors.New("image has too many pixels")
+	ErrFileTooLarge   = errors.New("file too large")
+	ErrUploadTooLarge = errors.New("upload too large once unzipped")
+	ErrTooManyFiles   = errors.New("upload has too many files")
+	ErrBadUploadName  = errors.New("invalid file name")
+	ErrDuplicateImage = errors.New("duplicate file name")
+)
+
+// PatternStore installs, renames, deletes, and exports pattern directories
+// under images/.
+type PatternStore struct {
+	Dir     string
+	Library *Library
+}
+
+// upload is a file to be installed in a pattern directory, saved at path
+// in the staging directory.
+type upload struct {
+	name string
+	path string
+}
+
+// uploadMeta reads and checks the metadata sidecar among uploads.  A
+// missing sidecar is empty metadata.
+func uploadMeta(uploads []*upload) (*PatternMeta, error) {
+	meta := &PatternMeta{}
+	for _, u := range uploads {
+		if u.name != metaFile {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(u.path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, meta); err != nil {
+			return nil, fmt.Errorf("%s: %w", u.name, jsonErrorLine(data, err))
+		}
+		if err := meta.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", u.name, err)
+		}
+	}
+
+	return meta, nil
+}
+
+// validateUpload checks an uploaded file, decoding images through the
+// same path as patternReader.read().  Still images played by column run
+// the strip down their height rather than across their width.
+func validateUpload(u *upload, numPixels int, columns bool) (image.Image, error) {
+	if u.name == metaFile {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(u.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.name == pathFile {
+		if _, err := videoimport.ParsePath(data, math.MaxInt32, math.MaxInt32); err != nil {
+			return nil, fmt.Errorf("%s: %w", u.name, err)
+		}
+		return nil, nil
+	}
+
+	// Animations are sampled to fit however the pattern plays them.
+	if s, err := anim.DecodeAnimation(data, anim.Flatten); !errors.Is(err, anim.ErrNotAnimated) {
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", u.name, err)
+		}
+		if w := s.Bounds().Dx(); w > numPixels {
+			return nil, fmt.Errorf("%s: %d pixels per frame > %d: %w", u.name, w, numPixels, ErrImageTooWide)
+		}
+		return s, nil
+	}
+
+	// Check the size before decoding.  Animations are mapped a frame at a
+	// time, so they can be as long as they like.
+	c, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", u.name, err)
+	}
+	if columns && format != "leda" {
+		if c.Height > numPixels {
+			return nil, fmt.Errorf("%s: height %d > %d: %w", u.name, c.Height, numPixels, ErrImageTooWide)
+		}
+	} else if c.Width > numPixels {
+		return nil, fmt.Errorf("%s: width %d > %d: %w", u.name, c.Width, numPixels, ErrImageTooWide)
+	}
+	if format != "leda" && c.Width > 0 && c.Height > maxImagePixels/c.Width {
+		return nil, fmt.Errorf("%s: %dx%d: %w", u.name, c.Width, c.Height, ErrImageTooLarge)
+	}
+
+	img, err := decodeImage(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", u.name, err)
+	}
+
+	return img, nil
+}
+
+// uploadName returns the base name to install an uploaded file as, or ""
+// if it should be skipped.
+func uploadName(name string) (string, error) {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	switch {
+	case name == metaFile || name == pathFile:
+		return name, nil
+	case name == thumbFile || name == "." || strings.HasPrefix(name, "."):
+		// We generate our own thumbnail, and skip hidden files.
+		return "", nil
+	case strings.HasPrefix(name, "_") || !validPatternName(name):
+		return "", fmt.Errorf("%q: %w", name, ErrBadUploadName)
+	}
+
+	return name, nil
+}
+
+// readUploads extracts files from multipart form data into dir, expanding
+// any zips.
+func readUploads(form *multipart.Form, dir string) ([]*upload, error) {
+	uploads := []*upload{}
+	seen := map[string]bool{}
+	var total int64
+
+	add := func(name string, r io.Reader) error {
+		name, err := uploadName(name)
+		if err != nil || name == "" {
+			return err
+		}
+		if seen[name] {
+			return fmt.Errorf("%q: %w", name, ErrDuplicateImage)
+		}
+		seen[name] = true
+		if len(uploads) == maxUploadFiles {
+			return fmt.Errorf("more than %d: %w", maxUploadFiles, ErrTooManyFiles)
+		}
+
+		path := filepath.Join(dir, name)
+		n, err := writeUpload(path, io.LimitReader(r, maxUploadFile+1))
+		if err != nil {
+			return err
+		}
+		if n > maxUploadFile {
+			return fmt.Errorf("%q: %w", name, ErrFileTooLarge)
+		}
+		if total += n; total > maxUploadTotal {
+			return fmt.Errorf("more than %d bytes: %w", maxUploadTotal, ErrUploadTooLarge)
+		}
+
+		uploads = append(uploads, &upload{name: name, path: path})
+		return nil
+	}
+
+	for _, headers := range form.File {
+		for _, fh := range headers {
+			f, err := fh.Open()
+			if err != nil {
+				return nil, err
+			}
+
+			if strings.HasSuffix(strings.ToLower(fh.Filename), ".zip") {
+				err = readZip(f, fh.Size, add)
+			} else {
+				err = add(fh.Filename, f)
+			}
+			_ = f.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return uploads, nil
+}
+
+// writeUpload copies r to a new file at path, returning how many bytes it
+// wrote.
+func writeUpload(path string, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644) //nolint:gosec // Served publicly anyway.
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return n, err
+}
+
+// readZip calls add for every file in a zip archive.
+func readZip(r io.ReaderAt, size int64, add func(string, io.Reader) error) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	if len(zr.File) > maxUploadFiles {
+		return fmt.Errorf("%d files: %w", len(zr.File), ErrTooManyFiles)
+	}
+
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() || strings.HasPrefix(zf.Name, "__MACOSX/") {
+			continue
+		}
+
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		err = add(zf.Name, rc)
+		_ = rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// makeThumb scales img to fill a thumbSize square, averaging each box of
+// source pixels.
+func makeThumb(img image.Image) image.Image {
+	b := img.Bounds()
+	thumb := image.NewRGBA(image.Rect(0, 0, thumbSize, thumbSize))
+
+	for ty := 0; ty < thumbSize; ty++ {
+		y0 := b.Min.Y + ty*b.Dy()/thumbSize
+		y1 := b.Min.Y + (ty+1)*b.Dy()/thumbSize
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for tx := 0; tx < thumbSize; tx++ {
+			x0 := b.Min.X + tx*b.Dx()/thumbSize
+			x1 := b.Min.X + (tx+1)*b.Dx()/thumbSize
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, bl, n uint32
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					pr, pg, pb, _ := img.At(x, y).RGBA()
+					r += pr >> 8
+					g += pg >> 8
+					bl += pb >> 8
+					n++
+				}
+			}
+			thumb.Set(tx, ty, color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(bl / n), A: 0xff})
+		}
+	}
+
+	return thumb
+}
+
+// Install extracts the files uploaded in form, validates them, generates a
+// thumbnail, and atomically installs them as images/<name>, replacing any
+// existing pattern only if replace is set.
+func (ps *PatternStore) Install(name string, form *multipart.Form, replace bool) (err error) {
+	if !validPatternName(name) {
+		return fmt.Errorf("%q: %w", name, ErrInvalidName)
+	}
+
+	dest := filepath.Join(ps.Dir, name)
+	if _, err := os.Stat(dest); err == nil && !replace {
+		return fmt.Errorf("%q: %w", name, ErrPatternExists)
+	}
+
+	staging, err := ps.stage(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(staging)
+		}
+	}()
+
+	uploads, err := readUploads(form, staging)
+	if err != nil {
+		return err
+	}
+
+	meta, err := uploadMeta(uploads)
+	if err != nil {
+		return err
+	}
+
+	numPixels := currentConfig().NumPixels
+	var first image.Image
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].name < uploads[j].name })
+	for _, u := range uploads {
+		img, err := validateUpload(u, numPixels, meta.Columns)
+		if err != nil {
+			return err
+		}
+		if first == nil && img != nil {
+			first = img
+		}
+	}
+	if first == nil {
+		return ErrNoImages
+	}
+
+	if err := writeThumb(staging, first); err != nil {
+		return err
+	}
+
+	return ps.install(name, staging, replace)
+}
+
+// stage creates a hidden directory under Dir to assemble a new pattern in.
+func (ps *PatternStore) stage(name string) (string, error) {
+	staging, err := ioutil.TempDir(ps.Dir, ".upload-"+name+"-")
+	if err != nil {
+		return "", err
+	}
+
+	return staging, os.Chmod(staging, 0o755)
+}
+
+// writeThumb writes img as the thumbnail in dir.
+func writeThumb(dir string, img image.Image) error {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, makeThumb(img), &jpeg.Options{Quality: 85}); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, thumbFile), buf.Bytes(), 0o644) //nolint:gosec // Served publicly anyway.
+}
+
+// install atomically moves a staging directory into place as
+// images/<name>, replacing any existing pattern only if replace is set.
+func (ps *PatternStore) install(name, staging string, replace bool) error {
+	dest := filepath.Join(ps.Dir, name)
+
+	// Move any existing pattern out of the way, so the new one appears
+	// all at once.
+	var old string
+	if _, err := os.Stat(dest); err == nil {
+		if !replace {
+			return fmt.Errorf("%q: %w", name, ErrPatternExists)
+		}
+		old = staging + ".old"
+		if err := os.Rename(dest, old); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(staging, dest); err != nil {
+		if old != "" {
+			_ = os.Rename(old, dest)
+		}
+		return err
+	}
+	if old != "" {
+		if err := os.RemoveAll(old); err != nil {
+			log.Println("Patterns: removing", old, err)
+		}
+	}
+
+	ps.Library.Invalidate(name)
+
+	return nil
+}
+
+// Delete removes a pattern directory.
+func (ps *PatternStore) Delete(name string) error {
+	if !validPatternName(name) {
+		return fmt.Errorf("%q: %w", name, ErrInvalidName)
+	}
+
+	dest := filepath.Join(ps.Dir, name)
+	if _, err := os.Stat(dest); err != nil {
+		return err
+	}
+
+	// Rename first so the pattern disappears atomically.
+	trash, err := ioutil.TempDir(ps.Dir, ".delete-"+name+"-")
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(dest, filepath.Join(trash, name)); err != nil {
+		_ = os.Remove(trash)
+		return err
+	}
+
+	ps.Library.Invalidate(name)
+
+	return os.RemoveAll(trash)
+}
+
+// Rename moves a pattern directory to a new name.
+func (ps *PatternStore) Rename(name, to string) error {
+	if !validPatternName(name) || !validPatternName(to) {
+		return ErrInvalidName
+	}
+
+	dest := filepath.Join(ps.Dir, to)
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("%q: %w", to, ErrPatternExists)
+	}
+
+	if err := os.Rename(filepath.Join(ps.Dir, name), dest); err != nil {
+		return err
+	}
+
+	ps.Library.Invalidate(name)
+	ps.Library.Invalidate(to)
+
+	return nil
+}
+
+// Export writes a pattern directory as a zip.
+func (ps *PatternStore) Export(w io.Writer, name string) error {
+	if !validPatternName(name) {
+		return ErrInvalidName
+	}
+
+	dir := filepath.Join(ps.Dir, name)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	for _, fi := range files {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		if err := addZipFile(zw, filepath.Join(dir, fi.Name()), name+"/"+fi.Name()); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func addZipFile(zw *zip.Writer, file, name string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	// Images are already compressed.
+	method := zip.Store
+	if strings.HasSuffix(name, ".json") {
+		method = zip.Deflate
+	}
+
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// ServeHTTP handles the pattern management API.  Everything but export
+// requires the api_token.
+//
+//	POST   /api/patterns/<name>           upload images or a zip as multipart form data
+//	PUT    /api/patterns/<name>           same, replacing any existing pattern
+//	DELETE /api/patterns/<name>           delete a pattern
+//	POST   /api/patterns/<name>/rename    rename to {"name": "new"}
+//	GET    /api/patterns/<name>/export    download a pattern as a zip
+func (ps *PatternStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, action := splitTwo(strings.TrimPrefix(r.URL.Path, "/api/patterns/"), "/")
+	if !validPatternName(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if action == "export" && r.Method == http.MethodGet {
+		if fi, err := os.Stat(filepath.Join(ps.Dir, name)); err != nil || !fi.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+
+		// Stream the zip rather than build it in memory.  Once it's
+		// started, an error can only cut it short.
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.zip"`)
+		if err := ps.Export(w, name); err != nil {
+			log.Println("Error exporting", name, err)
+		}
+		return
+	}
+
+	if !authorized(w, r) {
+		return
+	}
+
+	var err error
+	switch {
+	case action == "" && (r.Method == http.MethodPost || r.Method == http.MethodPut):
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+		if err = r.ParseMultipartForm(32 << 20); err != nil {
+			break
+		}
+		defer func() {
+			_ = r.MultipartForm.RemoveAll()
+		}()
+
+		err = ps.Install(name, r.MultipartForm, r.Method == http.MethodPut)
+	case action == "" && r.Method == http.MethodDelete:
+		err = ps.Delete(name)
+	case action == "rename" && r.Method == http.MethodPost:
+		to := struct {
+			Name string `json:"name"`
+		}{}
+		if err = readJSON(r, &to); err != nil {
+			break
+		}
+		err = ps.Rename(name, to.Name)
+		name = to.Name
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrPatternExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case os.IsNotExist(err):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	for _, p := range ps.Library.Patterns() {
+		if p.Name == name {
+			writeJSON(w, p)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
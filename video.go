@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/die-net/led-controller/videoimport"
+)
+
+var (
+	ErrImportRunning = errors.New("an import with that name is already running")
+	ErrNoVideo       = errors.New("no video uploaded")
+	ErrPathTooLong   = errors.New("pixel path is longer than num_pixels")
+)
+
+// ImportJob is the state of a video import.
+type ImportJob struct {
+	Name    string `json:"name"`
+	Stage   string `json:"stage"`
+	Percent int    `json:"percent"`
+	Error   string `json:"error,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+// importStatus is sent to websocket clients as an import progresses.
+type importStatus struct {
+	VideoImport string     `json:"video_import"`
+	Job         *ImportJob `json:"video_import_job"`
+}
+
+// VideoImporter converts uploaded videos into patterns in the background.
+type VideoImporter struct {
+	Store    *PatternStore
+	Outgoing chan<- []byte
+
+	mu   sync.Mutex
+	jobs map[string]*ImportJob
+}
+
+// Jobs returns every import since startup, sorted by name.
+func (vi *VideoImporter) Jobs() []ImportJob {
+	vi.mu.Lock()
+	defer vi.mu.Unlock()
+
+	o := make([]ImportJob, 0, len(vi.jobs))
+	for _, job := range vi.jobs {
+		o = append(o, *job)
+	}
+	sort.Slice(o, func(i, j int) bool { return o[i].Name < o[j].Name })
+
+	return o
+}
+
+// Start converts video into a pattern called name, sampled along
+// o.Pixels.  The video file is removed when the import finishes.
+func (vi *VideoImporter) Start(name, video string, o *videoimport.Options, replace bool) (ImportJob, error) {
+	if !validPatternName(name) {
+		return ImportJob{}, fmt.Errorf("%q: %w", name, ErrInvalidName)
+	}
+	if n := currentConfig().NumPixels; len(o.Pixels) > n {
+		return ImportJob{}, fmt.Errorf("%d > %d: %w", len(o.Pixels), n, ErrPathTooLong)
+	}
+	if _, err := os.Stat(filepath.Join(vi.Store.Dir, name)); err == nil && !replace {
+		return ImportJob{}, fmt.Errorf("%q: %w", name, ErrPatternExists)
+	}
+
+	vi.mu.Lock()
+	defer vi.mu.Unlock()
+
+	if job, ok := vi.jobs[name]; ok && job.cancel != nil {
+		return ImportJob{}, fmt.Errorf("%q: %w", name, ErrImportRunning)
+	}
+	if vi.jobs == nil {
+		vi.jobs = map[string]*ImportJob{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &ImportJob{Name: name, Stage: videoimport.StageDecoding, cancel: cancel}
+	vi.jobs[name] = job
+	go vi.run(ctx, job, video, o, replace)
+
+	return *job, nil
+}
+
+// Cancel stops a running import.
+func (vi *VideoImporter) Cancel(name string) bool {
+	vi.mu.Lock()
+	defer vi.mu.Unlock()
+
+	job, ok := vi.jobs[name]
+	if !ok || job.cancel == nil {
+		return false
+	}
+	job.cancel()
+
+	return true
+}
+
+func (vi *VideoImporter) run(ctx context.Context, job *ImportJob, video string, o *videoimport.Options, replace bool) {
+	defer func() {
+		_ = os.Remove(video)
+	}()
+
+	err := vi.convert(ctx, job, video, o, replace)
+
+	vi.mu.Lock()
+	job.cancel()
+	job.cancel = nil
+	if err != nil {
+		job.Error = err.Error()
+	} else {
+		job.Stage = videoimport.StageDone
+		job.Percent = 100
+	}
+	vi.mu.Unlock()
+
+	if err != nil {
+		log.Println("Video import:", job.Name, err)
+	}
+	vi.report(job)
+}
+
+func (vi *VideoImporter) convert(ctx context.Context, job *ImportJob, video string, o *videoimport.Options, replace bool) (err error) {
+	staging, err := vi.Store.stage(job.Name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(staging)
+		}
+	}()
+
+	progress := func(p videoimport.Progress) {
+		if p.Stage == videoimport.StageDone {
+			// Not done until it's installed.
+			return
+		}
+		vi.mu.Lock()
+		job.Stage = p.Stage
+		job.Percent = p.Percent
+		vi.mu.Unlock()
+		vi.report(job)
+	}
+
+	files, err := videoimport.Convert(ctx, video, filepath.Join(staging, job.Name+"-%04d.jpg"), o, progress)
+	if err != nil {
+		return err
+	}
+
+	first, err := readImage(files[0])
+	if err != nil {
+		return err
+	}
+	if err := writeThumb(staging, first); err != nil {
+		return err
+	}
+
+	return vi.Store.install(job.Name, staging, replace)
+}
+
+// report sends a job's state to websocket clients.
+func (vi *VideoImporter) report(job *ImportJob) {
+	if vi.Outgoing == nil {
+		return
+	}
+
+	vi.mu.Lock()
+	status := importStatus{Job: &ImportJob{}}
+	*status.Job = *job
+	vi.mu.Unlock()
+
+	switch {
+	case status.Job.Error != "":
+		status.VideoImport = fmt.Sprintf("%s: failed: %s", job.Name, status.Job.Error)
+	case status.Job.Percent < 0:
+		status.VideoImport = fmt.Sprintf("%s: %s", job.Name, status.Job.Stage)
+	default:
+		status.VideoImport = fmt.Sprintf("%s: %s %d%%", job.Name, status.Job.Stage, status.Job.Percent)
+	}
+
+	b, err := json.Marshal(status)
+	if err == nil {
+		vi.Outgoing <- b
+	}
+}
+
+// importOptions builds conversion options from the form values that
+// accompany an uploaded video.
+func importOptions(form *multipart.Form) (*videoimport.Options, error) {
+	o := videoimport.DefaultOptions()
+
+	value := func(key string) string {
+		if v := form.Value[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	for key, p := range map[string]*int{"video_width": &o.VideoWidth, "video_height": &o.VideoHeight, "frames_per_image": &o.FramesPerImage} {
+		if v := value(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > 4096 {
+				return nil, fmt.Errorf("%s %q: %w", key, v, ErrInvalidValue)
+			}
+			*p = n
+		}
+	}
+
+	var err error
+	if name := value("layout"); name != "" {
+		var l *Layout
+		if name == "-" {
+			l = layouts.Current(currentConfig().NumPixels)
+		} else if l, err = layouts.Load(name); err != nil {
+			return nil, err
+		}
+		o.Pixels = layoutPath(l, o.VideoWidth, o.VideoHeight)
+		if len(o.Pixels) == 0 {
+			err = videoimport.ErrNoPixels
+		}
+	} else if headers := form.File["path"]; len(headers) > 0 {
+		var b []byte
+		if b, err = readFormFile(headers[0]); err != nil {
+			return nil, err
+		}
+		o.Pixels, err = videoimport.ParsePath(b, o.VideoWidth, o.VideoHeight)
+	} else {
+		boxes := value("boxes")
+		if boxes == "" {
+			boxes = videoimport.DefaultBoxes
+		}
+		o.Pixels, err = videoimport.Boxes(boxes, o.VideoWidth, o.VideoHeight)
+	}
+
+	return o, err
+}
+
+// layoutPath fits l's x and y to a width x height video, as a pixel path.
+func layoutPath(l *Layout, width, height int) []image.Point {
+	fit := l.Fit(float64(width-1), float64(height-1))
+	pixels := make([]image.Point, len(fit))
+	for i, p := range fit {
+		pixels[i] = image.Point{int(math.Round(p[0])), int(math.Round(p[1]))}
+	}
+
+	return pixels
+}
+
+func readFormFile(fh *multipart.FileHeader) ([]byte, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	return ioutil.ReadAll(io.LimitReader(f, maxUploadFile))
+}
+
+// saveVideo copies the uploaded video to a temporary file that outlives
+// the request.
+func saveVideo(form *multipart.Form) (string, error) {
+	headers := form.File["video"]
+	if len(headers) == 0 {
+		return "", ErrNoVideo
+	}
+
+	src, err := headers[0].Open()
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+
+	dst, err := ioutil.TempFile("", "led-import-*"+filepath.Ext(headers[0].Filename))
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(dst.Name())
+		return "", err
+	}
+
+	return dst.Name(), dst.Close()
+}
+
+// ServeHTTP handles the video import API.  Starting and canceling imports
+// requires the api_token.
+//
+//	GET    /api/videos          every import and its progress
+//	POST   /api/videos/<name>   import multipart form data: "video", and
+//	                            either a "layout" name (or "-" for the one
+//	                            in use) fitted to the video, a "path" file
+//	                            of [x, y] pairs, or "boxes" like
+//	                            -pixelBoxes; optionally
+//	                            "video_width", "video_height",
+//	                            "frames_per_image", and "replace"
+//	DELETE /api/videos/<name>   cancel a running import
+func (vi *VideoImporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/videos"), "/")
+
+	if name == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, vi.Jobs())
+		return
+	}
+
+	if !validPatternName(name) {
+		http.NotFound(w, r)
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer func() {
+			_ = r.MultipartForm.RemoveAll()
+		}()
+
+		o, err := importOptions(r.MultipartForm)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		video, err := saveVideo(r.MultipartForm)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		replace, _ := strconv.ParseBool(r.FormValue("replace"))
+		job, err := vi.Start(name, video, o, replace)
+		if err != nil {
+			_ = os.Remove(video)
+			code := http.StatusBadRequest
+			if errors.Is(err, ErrPatternExists) || errors.Is(err, ErrImportRunning) {
+				code = http.StatusConflict
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+
+		b, _ := json.Marshal(job)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write(b)
+	case http.MethodDelete:
+		if !vi.Cancel(name) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,113 @@
+package videoimport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Info is what ffprobe says about a video.
+type Info struct {
+	Width    int
+	Height   int
+	FPS      float64
+	Duration time.Duration // 0 if unknown.
+}
+
+// Probe asks ffprobe for the size, frame rate and length of video's first
+// video stream.
+func Probe(ctx context.Context, video string) (Info, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "v:0", "-show_entries", "stream=width,height,r_frame_rate:format=duration", "-of", "default=noprint_wrappers=1", video)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return Info{}, fmt.Errorf("ffprobe: %w: %s", err, msg)
+		}
+		return Info{}, fmt.Errorf("ffprobe: %w", err)
+	}
+
+	info := Info{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value := splitTwo(scanner.Text(), "=")
+		switch key {
+		case "width":
+			info.Width, _ = strconv.Atoi(value)
+		case "height":
+			info.Height, _ = strconv.Atoi(value)
+		case "r_frame_rate":
+			num, den := splitTwo(value, "/")
+			n, _ := strconv.ParseFloat(num, 64)
+			d, err := strconv.ParseFloat(den, 64)
+			if err != nil || d == 0 {
+				d = 1
+			}
+			info.FPS = n / d
+		case "duration":
+			if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+				info.Duration = time.Duration(seconds * float64(time.Second))
+			}
+		}
+	}
+	if info.Width <= 0 || info.Height <= 0 {
+		return Info{}, ErrNoFrames
+	}
+	if info.FPS <= 0 || info.FPS > 240 {
+		info.FPS = 30
+	}
+
+	return info, nil
+}
+
+// Stream decodes a video with ffmpeg as it's read, as RGB frames scaled to
+// Width x Height, looping forever.  ffmpeg only runs as far ahead as the
+// pipe it writes to allows.
+type Stream struct {
+	Width  int
+	Height int
+
+	cmd    *exec.Cmd
+	out    io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// OpenStream starts decoding video.
+func OpenStream(ctx context.Context, video string, width, height int) (*Stream, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	scale := fmt.Sprintf("scale=%d:%d", width, height)
+	args := []string{"-v", "error", "-nostats", "-stream_loop", "-1", "-i", video, "-an", "-sws_flags", "area", "-vf", scale, "-f", "rawvideo", "-pix_fmt", "rgb24", "pipe:1"}
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("ffmpeg: %w", err)
+	}
+
+	return &Stream{Width: width, Height: height, cmd: cmd, out: out, cancel: cancel}, nil
+}
+
+// ReadFrame reads the next frame into dst, which must hold Width * Height
+// * 3 bytes.
+func (s *Stream) ReadFrame(dst []byte) error {
+	_, err := io.ReadFull(s.out, dst[:s.Width*s.Height*3])
+	return err
+}
+
+// Close stops ffmpeg.
+func (s *Stream) Close() {
+	s.cancel()
+	_ = s.cmd.Wait()
+}
@@ -0,0 +1,356 @@
+// Package videoimport converts video into pattern images by sampling each
+// decoded frame along a pixel path, so that the X axis of each output image
+// is the LEDs in the order they're sent to the controller, and the Y axis
+// is time.
+package videoimport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png" // Register PNG decoder for frames.
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidBoxes = errors.New("width and height must be >= 2 and < video width and height")
+	ErrInvalidPath  = errors.New("pixel path point outside the video")
+	ErrNoPixels     = errors.New("pixel path is empty")
+	ErrNoFrames     = errors.New("video contains no frames")
+)
+
+// Stages reported in Progress.
+const (
+	StageDecoding = "decoding"
+	StageSampling = "sampling"
+	StageDone     = "done"
+)
+
+// DefaultBoxes is the pixel path that the original installation used.
+const DefaultBoxes = "143x114,103x82,67x52,30x21"
+
+// Options control how a video is converted.
+type Options struct {
+	// Size to scale the video to before sampling.
+	VideoWidth  int
+	VideoHeight int
+
+	// Maximum number of frames (rows) in each output image.
+	FramesPerImage int
+
+	// Number of goroutines sampling frames.  Defaults to the number of CPUs.
+	Workers int
+
+	// Points within the scaled video to sample, in LED order.
+	Pixels []image.Point
+}
+
+// DefaultOptions returns the options the video-to-jpg tool has always used.
+func DefaultOptions() *Options {
+	return &Options{
+		VideoWidth:     256,
+		VideoHeight:    144,
+		FramesPerImage: 1800,
+		Workers:        runtime.NumCPU(),
+	}
+}
+
+// Progress is reported while a conversion is running.  Percent is -1 if
+// the total is unknown.
+type Progress struct {
+	Stage   string `json:"stage"`
+	Percent int    `json:"percent"`
+}
+
+// Boxes builds a pixel path from a comma-separated list of concentric
+// boxes, like "143x114,103x82", centered in a width x height video.  Each
+// box is traced counterclockwise starting at its bottom left corner.
+func Boxes(boxes string, width, height int) ([]image.Point, error) {
+	pixels := []image.Point{}
+
+	for _, boxStr := range strings.Split(boxes, ",") {
+		ws, hs := splitTwo(strings.TrimSpace(boxStr), "x")
+		w, _ := strconv.Atoi(ws)
+		h, _ := strconv.Atoi(hs)
+		ox := (width - w) / 2
+		oy := (height - h) / 2
+		if w < 2 || h < 2 || ox <= 0 || oy <= 0 {
+			return nil, fmt.Errorf("%q: %w", boxStr, ErrInvalidBoxes)
+		}
+		for y := oy + h; y >= oy; y-- {
+			pixels = append(pixels, image.Point{ox, y})
+		}
+		for x := ox; x <= ox+w; x++ {
+			pixels = append(pixels, image.Point{x, oy})
+		}
+		for y := oy; y <= oy+h; y++ {
+			pixels = append(pixels, image.Point{ox + w, y})
+		}
+		for x := ox + w; x >= ox; x-- {
+			pixels = append(pixels, image.Point{x, oy + h})
+		}
+	}
+
+	return pixels, nil
+}
+
+// ParsePath reads a pixel path as a JSON array of [x, y] pairs, in LED
+// order, checking that each point falls within a width x height video.
+func ParsePath(b []byte, width, height int) ([]image.Point, error) {
+	pairs := [][2]int{}
+	if err := json.Unmarshal(b, &pairs); err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return nil, ErrNoPixels
+	}
+
+	bounds := image.Rect(0, 0, width, height)
+	pixels := make([]image.Point, len(pairs))
+	for i, p := range pairs {
+		pixels[i] = image.Point{p[0], p[1]}
+		if !pixels[i].In(bounds) {
+			return nil, fmt.Errorf("point %d %v: %w", i, pixels[i], ErrInvalidPath)
+		}
+	}
+
+	return pixels, nil
+}
+
+// Convert decodes video with ffmpeg and writes one JPEG per FramesPerImage
+// frames, named by formatting outPattern with a count starting at 1.  It
+// returns the files written.  progress, if non-nil, is called as the
+// conversion proceeds.
+func Convert(ctx context.Context, video, outPattern string, o *Options, progress func(Progress)) ([]string, error) {
+	if len(o.Pixels) == 0 {
+		return nil, ErrNoPixels
+	}
+	if progress == nil {
+		progress = func(Progress) {}
+	}
+
+	workDir, err := ioutil.TempDir("", "video-to-jpg")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(workDir)
+
+	progress(Progress{Stage: StageDecoding, Percent: 0})
+	if err := videoToFrames(ctx, video, workDir, o, progress); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(workDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, ErrNoFrames
+	}
+
+	total := len(files)
+	done := 0
+	written := []string{}
+	for count := 1; len(files) > 0; count++ {
+		frames := len(files)
+		if frames > o.FramesPerImage && o.FramesPerImage > 0 {
+			frames = o.FramesPerImage
+		}
+
+		f := files[:frames]
+		files = files[frames:]
+
+		img := image.NewRGBA(image.Rect(0, 0, len(o.Pixels), frames))
+		if err := sampleFrames(ctx, img, workDir, f, o); err != nil {
+			return written, err
+		}
+
+		filename := fmt.Sprintf(outPattern, count)
+		if err := writeJpeg(img, filename); err != nil {
+			return written, err
+		}
+		written = append(written, filename)
+
+		done += frames
+		progress(Progress{Stage: StageSampling, Percent: done * 100 / total})
+	}
+
+	progress(Progress{Stage: StageDone, Percent: 100})
+
+	return written, nil
+}
+
+// sampleFrames sets each row of img to the pixel path sampled from the
+// corresponding frame.
+func sampleFrames(ctx context.Context, img *image.RGBA, workDir string, files []os.FileInfo, o *Options) error {
+	workers := o.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	rows := make(chan int, 100)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for y := range rows {
+				src, err := readImage(filepath.Join(workDir, files[y].Name()))
+				if err != nil {
+					errs <- err
+					return
+				}
+				for x, pixel := range o.Pixels {
+					img.Set(x, y, src.At(pixel.X, pixel.Y))
+				}
+			}
+		}()
+	}
+
+	var err error
+feed:
+	for y := range files {
+		select {
+		case rows <- y:
+		case err = <-errs:
+			break feed
+		case <-ctx.Done():
+			err = ctx.Err()
+			break feed
+		}
+	}
+	close(rows)
+	wg.Wait()
+
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+
+	return err
+}
+
+// videoToFrames runs ffmpeg to write every frame of video, scaled, as a
+// JPEG in workDir, reporting progress against the duration from ffprobe.
+func videoToFrames(ctx context.Context, video, workDir string, o *Options, progress func(Progress)) error {
+	duration := probeDuration(ctx, video)
+
+	outFile := filepath.Join(workDir, "frame-%06d.jpg")
+	scale := fmt.Sprintf("scale=%d:%d", o.VideoWidth, o.VideoHeight)
+	args := []string{"-y", "-v", "error", "-nostats", "-progress", "pipe:1", "-i", video, "-threads", "4", "-pix_fmt", "yuv420p", "-sws_flags", "lanczos", "-vf", scale, "-ss", "00:00:00.000", "-f", "image2", outFile}
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	readProgress(stdout, duration, progress)
+
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("ffmpeg: %w: %s", err, msg)
+		}
+		return fmt.Errorf("ffmpeg: %w", err)
+	}
+
+	return nil
+}
+
+// readProgress parses ffmpeg's -progress output until EOF.
+func readProgress(r io.Reader, duration time.Duration, progress func(Progress)) {
+	last := -1
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value := splitTwo(scanner.Text(), "=")
+		// Despite the name, out_time_ms is in microseconds.
+		if key != "out_time_ms" && key != "out_time_us" {
+			continue
+		}
+
+		percent := -1
+		if us, err := strconv.ParseInt(value, 10, 64); err == nil && duration > 0 {
+			percent = int(time.Duration(us) * time.Microsecond * 100 / duration)
+			if percent > 99 {
+				percent = 99
+			}
+		}
+		if percent != last {
+			last = percent
+			progress(Progress{Stage: StageDecoding, Percent: percent})
+		}
+	}
+}
+
+// probeDuration returns the length of video, or 0 if ffprobe can't tell.
+func probeDuration(ctx context.Context, video string) time.Duration {
+	out, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "csv=p=0", video).Output()
+	if err != nil {
+		return 0
+	}
+
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0
+	}
+
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func readImage(filename string) (image.Image, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+func writeJpeg(img image.Image, filename string) error {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 75})
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, buf.Bytes(), 0o644) //nolint:gosec // Served publicly anyway.
+}
+
+// Simplified strings.SplitN() that always returns two strings.
+func splitTwo(s, sep string) (one, two string) {
+	if part := strings.SplitN(s, sep, 2); len(part) == 2 {
+		return part[0], part[1]
+	}
+
+	return s, ""
+}
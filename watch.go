@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long the pattern directories must be quiet before a change is
+// passed on, so copying in many files causes one rescan, not hundreds.
+const watchSettle = 250 * time.Millisecond
+
+// Watcher notices files being added to or removed from the directories
+// under Dir, like the pattern directories under images/, so playing
+// Decoders and Plugins can pick up the change.
+type Watcher struct {
+	Dir string
+
+	mu       sync.Mutex
+	versions map[string]*uint64
+}
+
+var patternWatcher = &Watcher{}
+
+// version returns the change counter for the named pattern, which goes up
+// each time its directory changes.  It's safe to read atomically at any
+// time.
+func (w *Watcher) version(name string) *uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.versions == nil {
+		w.versions = map[string]*uint64{}
+	}
+	v, ok := w.versions[name]
+	if !ok {
+		v = new(uint64)
+		w.versions[name] = v
+	}
+
+	return v
+}
+
+// changed marks the named pattern as changed.
+func (w *Watcher) changed(name string) {
+	atomic.AddUint64(w.version(name), 1)
+}
+
+// Worker watches Dir until it fails, passing on changes to each pattern
+// once it has settled.
+func (w *Watcher) Worker() {
+	names := make(chan string, 64)
+	go func() {
+		if err := watchPatterns(w.Dir, names); err != nil {
+			log.Println("Watcher:", err)
+		}
+		close(names)
+	}()
+
+	pending := map[string]bool{}
+	settle := time.NewTimer(watchSettle)
+	settle.Stop()
+
+	for {
+		select {
+		case name, ok := <-names:
+			if !ok {
+				return
+			}
+			if !validPatternName(name) {
+				continue
+			}
+			pending[name] = true
+			settle.Reset(watchSettle)
+		case <-settle.C:
+			for name := range pending {
+				w.changed(name)
+				delete(pending, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// Changes to the list of patterns.
+	watchRoot = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR
+
+	// Changes to the files in a pattern.
+	watchPattern = watchRoot | syscall.IN_CLOSE_WRITE
+)
+
+// watchPatterns sends the name of each pattern under dir as its files
+// change, using inotify.  It only returns if watching fails.
+func watchPatterns(dir string, names chan<- string) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("inotify: %w", err)
+	}
+	f := os.NewFile(uintptr(fd), "inotify")
+	defer f.Close()
+
+	root, err := syscall.InotifyAddWatch(fd, dir, watchRoot)
+	if err != nil {
+		return fmt.Errorf("%s: %w", dir, err)
+	}
+
+	// Which pattern each watch is for, and the other way around.
+	patterns := map[int32]string{}
+	watches := map[string]int32{}
+	add := func(name string) {
+		wd, err := syscall.InotifyAddWatch(fd, filepath.Join(dir, name), watchPattern)
+		if err != nil {
+			return
+		}
+		patterns[int32(wd)] = name
+		watches[name] = int32(wd)
+	}
+
+	dirs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		if d.IsDir() && validPatternName(d.Name()) {
+			add(d.Name())
+		}
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			return fmt.Errorf("inotify: %w", err)
+		}
+
+		for b := buf[:n]; len(b) >= syscall.SizeofInotifyEvent; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&b[0]))
+			end := syscall.SizeofInotifyEvent + int(ev.Len)
+			if end > len(b) {
+				break
+			}
+			name := string(bytes.TrimRight(b[syscall.SizeofInotifyEvent:end], "\x00"))
+			b = b[end:]
+
+			switch {
+			case ev.Wd == int32(root) && ev.Mask&syscall.IN_ISDIR != 0:
+				// A whole pattern appeared or went away, perhaps by being
+				// replaced with a new upload.
+				if wd, ok := watches[name]; ok {
+					_, _ = syscall.InotifyRmWatch(fd, uint32(wd))
+					delete(patterns, wd)
+					delete(watches, name)
+				}
+				if ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 && validPatternName(name) {
+					add(name)
+				}
+				names <- name
+			case ev.Mask&syscall.IN_IGNORED != 0:
+				// The watch went away with its directory.
+				if p, ok := patterns[ev.Wd]; ok && watches[p] == ev.Wd {
+					delete(watches, p)
+				}
+				delete(patterns, ev.Wd)
+			case ev.Mask&syscall.IN_Q_OVERFLOW != 0:
+				// We missed something; assume everything changed.
+				for p := range watches {
+					names <- p
+				}
+			default:
+				if p, ok := patterns[ev.Wd]; ok {
+					names <- p
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+// How often to look for changes where we can't be told about them.
+const watchPoll = 2 * time.Second
+
+// watchPatterns sends the name of each pattern under dir as its files
+// change, by polling the modification time of each pattern directory.
+func watchPatterns(dir string, names chan<- string) error {
+	seen := map[string]time.Time{}
+	for first := true; ; first = false {
+		dirs, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		found := map[string]bool{}
+		for _, d := range dirs {
+			if !d.IsDir() || !validPatternName(d.Name()) {
+				continue
+			}
+			name := d.Name()
+			found[name] = true
+
+			// The directory itself has the time files were added or
+			// removed; the newest file catches ones written in place.
+			t := d.ModTime()
+			if files, err := ioutil.ReadDir(filepath.Join(dir, name)); err == nil {
+				for _, fi := range files {
+					if fi.ModTime().After(t) {
+						t = fi.ModTime()
+					}
+				}
+			}
+
+			if old, ok := seen[name]; (ok && !old.Equal(t)) || (!ok && !first) {
+				names <- name
+			}
+			seen[name] = t
+		}
+
+		for name := range seen {
+			if !found[name] {
+				delete(seen, name)
+				names <- name
+			}
+		}
+
+		time.Sleep(watchPoll)
+	}
+}
@@ -17,6 +17,10 @@ type Router struct {
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Greet, if set, returns a message to send each client as it
+	// connects.
+	Greet func() []byte
 }
 
 func NewRouter() *Router {
@@ -34,6 +38,11 @@ func (r *Router) Worker() {
 		select {
 		case client := <-r.register:
 			r.clients[client] = true
+			if r.Greet != nil {
+				if b := r.Greet(); b != nil {
+					client.send <- b
+				}
+			}
 		case client := <-r.unregister:
 			if _, ok := r.clients[client]; ok {
 				delete(r.clients, client)